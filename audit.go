@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	fmt "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/rc"
+)
+
+// An auditEntry records one run of a destructive command.  It never holds
+// any secret values; just the paths and keys that were touched.
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Target  string    `json:"target"`
+	URL     string    `json:"url,omitempty"`
+	Command string    `json:"command"`
+	Args    []string  `json:"args"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// auditJournal is where the audit trail is kept: $SAFE_AUDIT_LOG, or
+// ~/.safe_audit.log by default.
+func auditJournal() string {
+	if file := os.Getenv("SAFE_AUDIT_LOG"); file != "" {
+		return file
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".safe_audit.log")
+}
+
+// auditArgs strips the values out of a command's arguments, leaving only
+// the paths and keys that it touched.
+func auditArgs(command string, args []string) []string {
+	out := []string{}
+	switch command {
+	case "curl":
+		//METHOD path [data...] -- the request body could be anything
+		if len(args) > 2 {
+			args = args[:2]
+		}
+
+	case "vault":
+		//Only keep the Vault CLI sub-command and anything that looks like a
+		// path or a key; anything else could be a token or a password
+		positional := 0
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "-") || strings.Contains(arg, "=") {
+				out = append(out, strings.SplitN(arg, "=", 2)[0])
+				continue
+			}
+			if positional == 0 || strings.Contains(arg, "/") {
+				out = append(out, arg)
+			}
+			positional++
+		}
+		return out
+	}
+
+	for _, arg := range args {
+		//key=value becomes just key
+		out = append(out, strings.SplitN(arg, "=", 2)[0])
+	}
+	return out
+}
+
+// recordAudit appends a run of command to the audit journal.  Failing to
+// do so doesn't stop anything; by the time we know, the damage is done.
+func recordAudit(target, command string, args []string, cmdErr error) {
+	entry := auditEntry{
+		Time:    time.Now().UTC(),
+		Target:  target,
+		Command: command,
+		Args:    auditArgs(command, args),
+	}
+	if u, err := user.Current(); err == nil {
+		entry.User = u.Username
+	} else {
+		entry.User = os.Getenv("USER")
+	}
+	cfg := rc.Read()
+	if entry.Target == "" {
+		entry.Target = cfg.Current
+	}
+	if v, _, err := cfg.Find(entry.Target); err == nil && v != nil {
+		entry.URL = v.URL
+	}
+	if cmdErr != nil {
+		entry.Error = cmdErr.Error()
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(auditJournal(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "@Y{unable to write to the audit journal %s: %s}\n", auditJournal(), err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(b, '\n'))
+}
+
+// pendingAudit is the destructive command that is running, so that it is
+// still recorded if it ends through exit(), or a signal, instead of by
+// returning.
+var (
+	pendingAudit *auditEntry
+	pendingLock  sync.Mutex
+)
+
+// startAudit notes that a destructive command is about to run.
+func startAudit(target, command string, args []string) {
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	pendingAudit = &auditEntry{Target: target, Command: command, Args: args}
+}
+
+// auditTouched notes what the destructive command that is running touched,
+// for commands whose arguments don't say: the target that it changed, if
+// that isn't the current one, and the paths that it wrote to.
+func auditTouched(target string, paths ...string) {
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	if pendingAudit == nil {
+		return
+	}
+	if target != "" {
+		pendingAudit.Target = target
+	}
+	pendingAudit.Args = append(pendingAudit.Args, paths...)
+}
+
+// finishAudit records the destructive command that was running, if there
+// is one that hasn't been recorded yet.
+func finishAudit(cmdErr error) {
+	pendingLock.Lock()
+	p := pendingAudit
+	pendingAudit = nil
+	pendingLock.Unlock()
+	if p != nil {
+		recordAudit(p.Target, p.Command, p.Args, cmdErr)
+	}
+}
+
+type auditFilter struct {
+	Target  string
+	User    string
+	Command string
+	Path    string
+	Since   time.Time
+}
+
+func (f auditFilter) matches(e auditEntry) bool {
+	if f.Target != "" && e.Target != f.Target && e.URL != f.Target {
+		return false
+	}
+	if f.User != "" && e.User != f.User {
+		return false
+	}
+	if f.Command != "" && e.Command != f.Command && !strings.HasPrefix(e.Command, f.Command+" ") {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if f.Path != "" {
+		prefix := strings.TrimSuffix(f.Path, "/")
+		for _, arg := range e.Args {
+			if arg == prefix || strings.HasPrefix(arg, prefix+"/") || strings.HasPrefix(arg, prefix+":") {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// readAudit returns the entries in the audit journal that match the filter,
+// oldest first.
+func readAudit(filter auditFilter) ([]auditEntry, error) {
+	f, err := os.Open(auditJournal())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []auditEntry{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []auditEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s, line %d: %s", auditJournal(), n, err)
+		}
+		if filter.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func printAudit(entries []auditEntry) {
+	if len(entries) == 0 {
+		fmt.Fprintf(os.Stderr, "@Y{no matching history}\n")
+		return
+	}
+
+	t := table{}
+	t.setHeader("when", "user", "target", "command", "status")
+	for _, e := range entries {
+		status := fmt.Sprintf("@G{ok}")
+		if e.Error != "" {
+			status = fmt.Sprintf("@R{failed: %s}", strings.SplitN(e.Error, "\n", 2)[0])
+		}
+		t.addRow(e.Time.Local().Format("2006-01-02 15:04:05"), e.User, fmt.Sprintf("@C{%s}", e.Target),
+			fmt.Sprintf("@M{%s} %s", e.Command, strings.Join(e.Args, " ")), status)
+	}
+	t.print()
+}
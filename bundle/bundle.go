@@ -0,0 +1,363 @@
+package bundle
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/openpgp"
+	// OpenPGP keys that state no hash preferences are assumed to want
+	// RIPEMD160, and openpgp.Encrypt refuses them unless it is linked in.
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+// Version is the envelope format version written by Seal.
+const Version = 1
+
+const (
+	stanzaX25519  = "X25519"
+	stanzaOpenPGP = "openpgp"
+	signatureType = "ssh-ed25519"
+
+	wrapLabel      = "safe-bundle/v1/X25519"
+	payloadLabel   = "safe-bundle/v1/payload"
+	signatureLabel = "safe-bundle/v1/signature\n"
+)
+
+// Bundle is the on-disk envelope.  The payload (the export JSON) is encrypted
+// once, under a random file key, and that file key is then wrapped for each
+// recipient: with X25519 and HKDF-SHA256 for X25519 recipients, or as an
+// OpenPGP message for OpenPGP recipients.  The recipient stanzas are bound to the payload as associated
+// data, so nobody can add or swap recipients without breaking decryption.
+type Bundle struct {
+	Version    int        `json:"safe_bundle"`
+	Recipients []Stanza   `json:"recipients"`
+	Nonce      string     `json:"nonce"`
+	Payload    string     `json:"payload"`
+	Signature  *Signature `json:"signature,omitempty"`
+}
+
+type Stanza struct {
+	Type      string `json:"type"`
+	Ephemeral string `json:"ephemeral,omitempty"`
+	Key       string `json:"key"`
+}
+
+// Signature covers everything in the bundle except itself.  The public key
+// travels with the signature, so that importers can pin it via --verify-with.
+type Signature struct {
+	Type      string `json:"type"`
+	PublicKey string `json:"public_key"`
+	Value     string `json:"value"`
+}
+
+// IsBundle returns true if b looks like an encrypted bundle, rather than a
+// plaintext export.
+func IsBundle(b []byte) bool {
+	var probe map[string]interface{}
+	if err := json.Unmarshal(b, &probe); err != nil {
+		return false
+	}
+	_, ok := probe["safe_bundle"]
+	return ok
+}
+
+// SignedBy returns the public key (in authorized_keys format) that a bundle
+// claims to be signed by, or "" if it is not signed.  The claim is only worth
+// anything once Open has checked it against a pinned key.
+func SignedBy(data []byte) (string, error) {
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return "", fmt.Errorf("malformed bundle: %s", err)
+	}
+	if b.Signature == nil {
+		return "", nil
+	}
+	return b.Signature.PublicKey, nil
+}
+
+// Seal encrypts plaintext to all of the given recipients and, if signer is
+// not nil, signs the result.  The returned bytes are JSON.
+func Seal(plaintext []byte, recipients []*Recipient, signer ed25519.PrivateKey) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("at least one recipient is required")
+	}
+
+	fileKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+
+	b := Bundle{Version: Version}
+	for _, r := range recipients {
+		s, err := wrap(fileKey, r)
+		if err != nil {
+			return nil, err
+		}
+		b.Recipients = append(b.Recipients, s)
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aead, err := payloadCipher(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	ad, err := json.Marshal(b.Recipients)
+	if err != nil {
+		return nil, err
+	}
+	b.Nonce = base64.StdEncoding.EncodeToString(nonce)
+	b.Payload = base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, plaintext, ad))
+
+	if signer != nil {
+		pub, err := marshalVerifyKey(signer.Public().(ed25519.PublicKey))
+		if err != nil {
+			return nil, err
+		}
+		msg, err := b.signedBytes()
+		if err != nil {
+			return nil, err
+		}
+		b.Signature = &Signature{
+			Type:      signatureType,
+			PublicKey: pub,
+			Value:     base64.StdEncoding.EncodeToString(ed25519.Sign(signer, msg)),
+		}
+	}
+
+	return json.Marshal(b)
+}
+
+// Open verifies and decrypts a bundle produced by Seal.  If verify is not
+// nil, the bundle must carry a valid signature made by that exact key.  A
+// signature that is present is always checked, pinned or not.
+func Open(data []byte, identities []*Identity, verify ed25519.PublicKey) ([]byte, error) {
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("malformed bundle: %s", err)
+	}
+	if b.Version != Version {
+		return nil, fmt.Errorf("unsupported bundle version %d", b.Version)
+	}
+
+	if err := b.verify(verify); err != nil {
+		return nil, err
+	}
+
+	var fileKey []byte
+	for _, id := range identities {
+		for _, s := range b.Recipients {
+			if k, err := unwrap(s, id); err == nil {
+				fileKey = k
+				break
+			}
+		}
+		if fileKey != nil {
+			break
+		}
+	}
+	if fileKey == nil {
+		return nil, fmt.Errorf("none of the given identities can decrypt this bundle")
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(b.Nonce)
+	if err != nil || len(nonce) != chacha20poly1305.NonceSize {
+		return nil, fmt.Errorf("malformed bundle: bad nonce")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(b.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed bundle: bad payload encoding")
+	}
+	aead, err := payloadCipher(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	ad, err := json.Marshal(b.Recipients)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("bundle failed integrity check; refusing to decrypt tampered data")
+	}
+	return plaintext, nil
+}
+
+func (b Bundle) signedBytes() ([]byte, error) {
+	b.Signature = nil
+	msg, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(signatureLabel), msg...), nil
+}
+
+func (b Bundle) verify(pinned ed25519.PublicKey) error {
+	if b.Signature == nil {
+		if pinned != nil {
+			return fmt.Errorf("bundle is not signed, but a signature was required")
+		}
+		return nil
+	}
+
+	if b.Signature.Type != signatureType {
+		return fmt.Errorf("unsupported bundle signature type '%s'", b.Signature.Type)
+	}
+	pub, err := parseVerifyKey([]byte(b.Signature.PublicKey))
+	if err != nil {
+		return fmt.Errorf("malformed bundle signature: %s", err)
+	}
+	if pinned != nil && !bytes.Equal(pub, pinned) {
+		return fmt.Errorf("bundle was signed by %s, not by the expected key", b.Signature.PublicKey)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(b.Signature.Value)
+	if err != nil {
+		return fmt.Errorf("malformed bundle signature: %s", err)
+	}
+	msg, err := b.signedBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, msg, sig) {
+		return fmt.Errorf("bundle signature is invalid; refusing to import tampered data")
+	}
+	return nil
+}
+
+func wrap(fileKey []byte, r *Recipient) (Stanza, error) {
+	if r.entity != nil {
+		return wrapOpenPGP(fileKey, r)
+	}
+
+	eph := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(eph); err != nil {
+		return Stanza{}, err
+	}
+	ephPub, err := curve25519.X25519(eph, curve25519.Basepoint)
+	if err != nil {
+		return Stanza{}, err
+	}
+	shared, err := curve25519.X25519(eph, r.key)
+	if err != nil {
+		return Stanza{}, err
+	}
+
+	aead, err := wrapCipher(shared, ephPub, r.key)
+	if err != nil {
+		return Stanza{}, err
+	}
+	return Stanza{
+		Type:      stanzaX25519,
+		Ephemeral: base64.StdEncoding.EncodeToString(ephPub),
+		Key:       base64.StdEncoding.EncodeToString(aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil)),
+	}, nil
+}
+
+func unwrap(s Stanza, id *Identity) ([]byte, error) {
+	if s.Type == stanzaOpenPGP {
+		return unwrapOpenPGP(s, id)
+	}
+	if s.Type != stanzaX25519 {
+		return nil, fmt.Errorf("unsupported stanza type '%s'", s.Type)
+	}
+	if id.key == nil {
+		return nil, fmt.Errorf("not an X25519 identity")
+	}
+	ephPub, err := base64.StdEncoding.DecodeString(s.Ephemeral)
+	if err != nil || len(ephPub) != curve25519.PointSize {
+		return nil, fmt.Errorf("malformed stanza")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(s.Key)
+	if err != nil {
+		return nil, fmt.Errorf("malformed stanza")
+	}
+
+	shared, err := curve25519.X25519(id.key, ephPub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := wrapCipher(shared, ephPub, id.Recipient().key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), wrapped, nil)
+}
+
+func wrapOpenPGP(fileKey []byte, r *Recipient) (Stanza, error) {
+	var buf bytes.Buffer
+	w, err := openpgp.Encrypt(&buf, []*openpgp.Entity{r.entity}, nil, nil, nil)
+	if err != nil {
+		return Stanza{}, fmt.Errorf("unable to encrypt to OpenPGP key %s: %s", r, err)
+	}
+	if _, err := w.Write(fileKey); err != nil {
+		return Stanza{}, err
+	}
+	if err := w.Close(); err != nil {
+		return Stanza{}, err
+	}
+	return Stanza{
+		Type: stanzaOpenPGP,
+		Key:  base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}, nil
+}
+
+func unwrapOpenPGP(s Stanza, id *Identity) ([]byte, error) {
+	if id.entity == nil {
+		return nil, fmt.Errorf("not an OpenPGP identity")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(s.Key)
+	if err != nil {
+		return nil, fmt.Errorf("malformed stanza")
+	}
+
+	md, err := openpgp.ReadMessage(bytes.NewReader(wrapped), openpgp.EntityList{id.entity}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !md.IsEncrypted {
+		return nil, fmt.Errorf("malformed stanza")
+	}
+	fileKey, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, err
+	}
+	if len(fileKey) != chacha20poly1305.KeySize {
+		return nil, fmt.Errorf("malformed stanza")
+	}
+	return fileKey, nil
+}
+
+func wrapCipher(shared, ephPub, recipient []byte) (cipher.AEAD, error) {
+	if subtle.ConstantTimeCompare(shared, make([]byte, len(shared))) == 1 {
+		return nil, fmt.Errorf("invalid X25519 shared secret")
+	}
+	salt := append(append([]byte{}, ephPub...), recipient...)
+	return derive(shared, salt, wrapLabel)
+}
+
+func payloadCipher(fileKey, nonce []byte) (cipher.AEAD, error) {
+	return derive(fileKey, nonce, payloadLabel)
+}
+
+func derive(secret, salt []byte, label string) (cipher.AEAD, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(label)), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
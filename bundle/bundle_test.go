@@ -0,0 +1,251 @@
+package bundle_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/safe/bundle"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+var _ = Describe("Bundle", func() {
+	var alice, bob, eve *bundle.Identity
+	var signer ed25519.PrivateKey
+	var plaintext = []byte(`[{"export_version":2,"data":{"secret/x":{"versions":[{"value":{"k":"v"}}]}}}]`)
+
+	BeforeEach(func() {
+		var err error
+		alice, err = bundle.NewIdentity()
+		Expect(err).NotTo(HaveOccurred())
+		bob, err = bundle.NewIdentity()
+		Expect(err).NotTo(HaveOccurred())
+		eve, err = bundle.NewIdentity()
+		Expect(err).NotTo(HaveOccurred())
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Describe("keys", func() {
+		It("round-trips recipients and identities through their string forms", func() {
+			r, err := bundle.ParseRecipient(alice.Recipient().String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.String()).To(HavePrefix("age1"))
+			Expect(r.String()).To(Equal(alice.Recipient().String()))
+
+			id, err := bundle.ParseIdentity(alice.String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id.String()).To(HavePrefix("AGE-SECRET-KEY-1"))
+			Expect(id.Recipient().String()).To(Equal(alice.Recipient().String()))
+		})
+
+		It("rejects corrupted recipients", func() {
+			s := []byte(alice.Recipient().String())
+			if s[10] == 'q' {
+				s[10] = 'p'
+			} else {
+				s[10] = 'q'
+			}
+			_, err := bundle.ParseRecipient(string(s))
+			Expect(err).To(HaveOccurred())
+		})
+
+	})
+
+	Describe("OpenPGP keys", func() {
+		var dir string
+		var entity *openpgp.Entity
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "safe-pgp")
+			Expect(err).NotTo(HaveOccurred())
+			entity, err = openpgp.NewEntity("Alice", "", "alice@example.com", &packet.Config{RSABits: 1024})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+			os.Unsetenv("SAFE_PGP_PASSPHRASE")
+		})
+
+		// armored writes the public or secret keys of the entity to a file,
+		// the way gpg --armor --export{,-secret-keys} would.
+		armored := func(name, blockType string, serialize func(io.Writer) error) string {
+			path := filepath.Join(dir, name)
+			f, err := os.Create(path)
+			Expect(err).NotTo(HaveOccurred())
+			defer f.Close()
+			w, err := armor.Encode(f, blockType, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(serialize(w)).To(Succeed())
+			Expect(w.Close()).To(Succeed())
+			return path
+		}
+		public := func() string {
+			return armored("public.asc", openpgp.PublicKeyType, entity.Serialize)
+		}
+		secret := func() string {
+			return armored("secret.asc", openpgp.PrivateKeyType, func(w io.Writer) error {
+				return entity.SerializePrivate(w, nil)
+			})
+		}
+
+		It("encrypts to OpenPGP public keys, alongside X25519 recipients", func() {
+			recipients, err := bundle.LoadRecipients([]string{public(), bob.Recipient().String()})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recipients).To(HaveLen(2))
+			Expect(recipients[0].String()).To(Equal(fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)))
+
+			b, err := bundle.Seal(plaintext, recipients, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			identities, err := bundle.LoadIdentities([]string{secret()})
+			Expect(err).NotTo(HaveOccurred())
+			out, err := bundle.Open(b, identities, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(out).To(Equal(plaintext))
+
+			out, err = bundle.Open(b, []*bundle.Identity{bob}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(out).To(Equal(plaintext))
+		})
+
+		It("does not decrypt for other OpenPGP keys", func() {
+			recipients, err := bundle.LoadRecipients([]string{public()})
+			Expect(err).NotTo(HaveOccurred())
+			b, err := bundle.Seal(plaintext, recipients, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			entity, err = openpgp.NewEntity("Eve", "", "eve@example.com", &packet.Config{RSABits: 1024})
+			Expect(err).NotTo(HaveOccurred())
+			identities, err := bundle.LoadIdentities([]string{secret()})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = bundle.Open(b, append(identities, alice), nil)
+			Expect(err).To(MatchError(ContainSubstring("none of the given identities")))
+		})
+
+		It("unlocks secret keys with $SAFE_PGP_PASSPHRASE", func() {
+			// testdata/locked.asc was made by gpg, with the passphrase 'sekrit'.
+			locked := filepath.Join("testdata", "locked.asc")
+			_, err := bundle.LoadIdentities([]string{locked})
+			Expect(err).To(MatchError(ContainSubstring("set $SAFE_PGP_PASSPHRASE")))
+
+			os.Setenv("SAFE_PGP_PASSPHRASE", "wrong")
+			_, err = bundle.LoadIdentities([]string{locked})
+			Expect(err).To(MatchError(ContainSubstring("wrong passphrase")))
+
+			os.Setenv("SAFE_PGP_PASSPHRASE", "sekrit")
+			identities, err := bundle.LoadIdentities([]string{locked})
+			Expect(err).NotTo(HaveOccurred())
+			b, err := bundle.Seal(plaintext, []*bundle.Recipient{identities[0].Recipient()}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			out, err := bundle.Open(b, identities, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(out).To(Equal(plaintext))
+		})
+	})
+
+	Describe("Seal / Open", func() {
+		It("decrypts for every recipient, and nobody else", func() {
+			b, err := bundle.Seal(plaintext, []*bundle.Recipient{alice.Recipient(), bob.Recipient()}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bundle.IsBundle(b)).To(BeTrue())
+			Expect(bundle.IsBundle(plaintext)).To(BeFalse())
+
+			for _, id := range []*bundle.Identity{alice, bob} {
+				out, err := bundle.Open(b, []*bundle.Identity{id}, nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(out).To(Equal(plaintext))
+			}
+
+			_, err = bundle.Open(b, []*bundle.Identity{eve}, nil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("verifies signatures, pinned or not", func() {
+			b, err := bundle.Seal(plaintext, []*bundle.Recipient{alice.Recipient()}, signer)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = bundle.Open(b, []*bundle.Identity{alice}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = bundle.Open(b, []*bundle.Identity{alice}, signer.Public().(ed25519.PublicKey))
+			Expect(err).NotTo(HaveOccurred())
+
+			other, _, _ := ed25519.GenerateKey(rand.Reader)
+			_, err = bundle.Open(b, []*bundle.Identity{alice}, other)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("reports who a bundle claims to be signed by", func() {
+			b, err := bundle.Seal(plaintext, []*bundle.Recipient{alice.Recipient()}, signer)
+			Expect(err).NotTo(HaveOccurred())
+			by, err := bundle.SignedBy(b)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(by).To(HavePrefix("ssh-ed25519 "))
+
+			b, err = bundle.Seal(plaintext, []*bundle.Recipient{alice.Recipient()}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bundle.SignedBy(b)).To(BeEmpty())
+		})
+
+		It("requires a signature when a verify key is pinned", func() {
+			b, err := bundle.Seal(plaintext, []*bundle.Recipient{alice.Recipient()}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = bundle.Open(b, []*bundle.Identity{alice}, signer.Public().(ed25519.PublicKey))
+			Expect(err).To(HaveOccurred())
+		})
+
+		tamper := func(b []byte, fn func(*bundle.Bundle)) []byte {
+			var env bundle.Bundle
+			Expect(json.Unmarshal(b, &env)).To(Succeed())
+			fn(&env)
+			out, err := json.Marshal(env)
+			Expect(err).NotTo(HaveOccurred())
+			return out
+		}
+
+		It("refuses tampered payloads", func() {
+			b, err := bundle.Seal(plaintext, []*bundle.Recipient{alice.Recipient()}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			b = tamper(b, func(env *bundle.Bundle) {
+				p := []byte(env.Payload)
+				if p[0] == 'A' {
+					p[0] = 'B'
+				} else {
+					p[0] = 'A'
+				}
+				env.Payload = string(p)
+			})
+			_, err = bundle.Open(b, []*bundle.Identity{alice}, nil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("refuses bundles with an added recipient", func() {
+			b, err := bundle.Seal(plaintext, []*bundle.Recipient{alice.Recipient()}, signer)
+			Expect(err).NotTo(HaveOccurred())
+			extra, err := bundle.Seal(plaintext, []*bundle.Recipient{eve.Recipient()}, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			var e bundle.Bundle
+			Expect(json.Unmarshal(extra, &e)).To(Succeed())
+			b = tamper(b, func(env *bundle.Bundle) {
+				env.Recipients = append(env.Recipients, e.Recipients...)
+			})
+
+			_, err = bundle.Open(b, []*bundle.Identity{alice}, nil)
+			Expect(err).To(HaveOccurred())
+			_, err = bundle.Open(b, []*bundle.Identity{eve}, nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
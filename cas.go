@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	fmt "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// casTries is how many times updateSecret will read, modify and write a
+// secret that keeps being changed out from under it, before giving up.
+const casTries = 3
+
+// errUnchanged can be returned by the modify function given to updateSecret,
+// when it turns out there is nothing to write.
+var errUnchanged = errors.New("unchanged")
+
+// updateSecret reads the secret at path, has modify change it, and writes it
+// back with check-and-set, so that other writes made in the meantime aren't
+// silently lost.  If someone else did write to the secret, the whole thing
+// is tried again against what they wrote.  modify may be called more than
+// once, and should not ask the user for anything twice.
+func updateSecret(v *vault.Vault, path string, modify func(s *vault.Secret, exists bool) error) error {
+	for try := 1; ; try++ {
+		s, err := v.Read(path)
+		if err != nil && !vault.IsNotFound(err) {
+			return err
+		}
+		if err = modify(s, err == nil); err != nil {
+			if err == errUnchanged {
+				return nil
+			}
+			return err
+		}
+
+		err = v.Write(path, s)
+		if !vault.IsCASConflict(err) {
+			return err
+		}
+		if try == casTries {
+			return fmt.Errorf("%s (gave up after %d tries)", err, try)
+		}
+		fmt.Fprintf(os.Stderr, "@Y{%s was changed by someone else while it was being updated; trying again}\n", path)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	fmt "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/rc"
+)
+
+// A completionNode is a command (or the top level) as go-cli sees it: the
+// names it goes by, the flags it takes, and its sub-commands.
+type completionNode struct {
+	names []string
+	flags []completionFlag
+	subs  []*completionNode
+	raw   bool
+}
+
+type completionFlag struct {
+	names      []string
+	takesValue bool
+}
+
+// A completion is one candidate, and (optionally) what it is.
+type completion struct {
+	Word        string
+	Description string
+}
+
+// completionTree builds the completion tree from the `cli:` tags of the
+// Options structure, just as go-cli builds its parser.
+func completionTree(t reflect.Type, names []string, raw bool) *completionNode {
+	n := &completionNode{names: names, raw: raw}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, ok := field.Tag.Lookup("cli")
+		if !ok || field.PkgPath != "" {
+			continue
+		}
+		names := strings.Split(tag, ",")
+		for i := range names {
+			names[i] = strings.TrimSpace(names[i])
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			raw := false
+			for i := range names {
+				if strings.HasSuffix(names[i], "!") {
+					names[i], raw = strings.TrimSuffix(names[i], "!"), true
+				}
+			}
+			n.subs = append(n.subs, completionTree(field.Type, names, raw))
+			continue
+		}
+		n.flags = append(n.flags, completionFlag{names: names, takesValue: field.Type.Kind() != reflect.Bool})
+	}
+	return n
+}
+
+func (n *completionNode) sub(name string) *completionNode {
+	for _, sub := range n.subs {
+		for _, s := range sub.names {
+			if s == name {
+				return sub
+			}
+		}
+	}
+	return nil
+}
+
+func (n *completionNode) flag(arg string) *completionFlag {
+	for i := range n.flags {
+		for _, name := range n.flags[i].names {
+			if name == arg {
+				return &n.flags[i]
+			}
+		}
+	}
+	return nil
+}
+
+// complete works out the candidates for the last of words (which may be
+// empty), given all of the ones before it.  Commands can be chained with
+// `--', so only the words after the last one matter, apart from -T.
+func (r *Runner) complete(root *completionNode, words []string) []completion {
+	cur, words := words[len(words)-1], words[:len(words)-1]
+
+	stack := []*completionNode{root}
+	var pending *completionFlag
+	target := os.Getenv("SAFE_TARGET")
+	positional := 0
+	for _, w := range words {
+		node := stack[len(stack)-1]
+		switch {
+		case pending != nil:
+			if pending.names[0] == "-T" {
+				target = w
+			}
+			pending = nil
+
+		case node.raw:
+			positional++
+
+		case w == "--":
+			stack, positional = stack[:1], 0
+
+		case strings.HasPrefix(w, "-") && w != "-":
+			for _, n := range stack {
+				if f := n.flag(w); f != nil && f.takesValue {
+					pending = f
+				}
+			}
+
+		case positional == 0 && node.sub(w) != nil:
+			stack = append(stack, node.sub(w))
+
+		default:
+			positional++
+		}
+	}
+
+	node := stack[len(stack)-1]
+	command := make([]string, 0, len(stack)-1)
+	for _, n := range stack[1:] {
+		command = append(command, n.names[0])
+	}
+
+	var candidates []completion
+	switch {
+	case pending != nil:
+		if pending.names[0] == "-T" {
+			candidates = completeTargets()
+		}
+
+	case node.raw:
+
+	case strings.HasPrefix(cur, "-"):
+		for _, n := range stack {
+			for _, f := range n.flags {
+				for _, name := range f.names {
+					candidates = append(candidates, completion{Word: name})
+				}
+			}
+		}
+
+	case positional == 0 && len(node.subs) > 0:
+		if len(command) == 1 && command[0] == "target" {
+			candidates = completeTargets()
+		}
+		for _, sub := range node.subs {
+			if strings.HasPrefix(sub.names[0], "__") {
+				continue
+			}
+			name := sub.names[0]
+			for _, alias := range sub.names {
+				if strings.HasPrefix(alias, cur) {
+					name = alias
+					break
+				}
+			}
+			c := completion{Word: name}
+			if help := r.Topics[strings.Join(append(command, sub.names[0]), " ")]; help != nil {
+				c.Description = help.Summary
+			}
+			candidates = append(candidates, c)
+		}
+
+	case len(command) == 1 && command[0] == "help":
+		return r.complete(root, []string{cur})
+
+	default:
+		help := r.Topics[strings.Join(command, " ")]
+		if help != nil && (help.Type == DestructiveCommand || help.Type == NonDestructiveCommand) {
+			candidates = completePaths(target, cur)
+		}
+	}
+
+	matches := []completion{}
+	for _, c := range candidates {
+		if strings.HasPrefix(c.Word, cur) {
+			matches = append(matches, c)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Word < matches[j].Word })
+	return matches
+}
+
+func completeTargets() []completion {
+	cfg := rc.Read()
+	targets := []completion{}
+	for alias, v := range cfg.Vaults {
+		targets = append(targets, completion{Word: alias, Description: v.URL})
+	}
+	return targets
+}
+
+// completionTTL is how long listings are cached for, between tabs.
+const completionTTL = 2 * time.Minute
+
+// completionTimeout is how long to wait on the Vault before giving up on
+// completing a path at all.
+const completionTimeout = 3 * time.Second
+
+type completionCache map[string]struct {
+	At    time.Time `json:"at"`
+	Names []string  `json:"names"`
+}
+
+func completionCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "safe", "completion.json")
+}
+
+// completePaths completes secret paths, and keys (after a `:'), by listing
+// them in the target Vault.  Only the names of things are ever cached, never
+// their values.
+func completePaths(target, cur string) []completion {
+	rc.Apply(target)
+	if os.Getenv("VAULT_ADDR") == "" || os.Getenv("VAULT_TOKEN") == "" {
+		return nil
+	}
+
+	//Inside the shell, paths can be relative to the current directory
+	pwd := session.pwd()
+	var dir, what string
+	switch {
+	case strings.Contains(cur, ":"):
+		dir = cur[:strings.LastIndex(cur, ":")]
+		what = "keys"
+	case strings.Contains(cur, "/"):
+		dir = cur[:strings.LastIndex(cur, "/")+1]
+		what = "list"
+	default:
+		what = "mounts"
+		if pwd != "" {
+			what = "here"
+		}
+	}
+
+	cache := completionCache{}
+	file := completionCacheFile()
+	if b, err := ioutil.ReadFile(file); err == nil {
+		json.Unmarshal(b, &cache)
+	}
+	id := fmt.Sprintf("%s|%s|%s|%s|%s", os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_NAMESPACE"), pwd, what, dir)
+
+	names := cache[id].Names
+	if time.Since(cache[id].At) > completionTTL {
+		names = nil
+		done := make(chan []string, 1)
+		go func() {
+			found, _ := listForCompletion(what, dir)
+			done <- found
+		}()
+		select {
+		case names = <-done:
+		case <-time.After(completionTimeout):
+			return nil
+		}
+		if len(names) == 0 {
+			return nil
+		}
+
+		for k, entry := range cache {
+			if time.Since(entry.At) > completionTTL {
+				delete(cache, k)
+			}
+		}
+		entry := cache[id]
+		entry.At, entry.Names = time.Now(), names
+		cache[id] = entry
+		if b, err := json.Marshal(cache); err == nil && file != "" {
+			os.MkdirAll(filepath.Dir(file), 0700)
+			ioutil.WriteFile(file, b, 0600)
+		}
+	}
+
+	paths := make([]completion, 0, len(names))
+	for _, name := range names {
+		switch what {
+		case "keys":
+			paths = append(paths, completion{Word: dir + ":" + name})
+		default:
+			paths = append(paths, completion{Word: dir + name})
+		}
+	}
+	return paths
+}
+
+func listForCompletion(what, dir string) ([]string, error) {
+	v := connect(true)
+	switch what {
+	case "keys":
+		s, err := v.Read(dir)
+		if err != nil {
+			return nil, err
+		}
+		return s.Keys(), nil
+	case "mounts":
+		return v.Mounts("kv")
+	case "here":
+		return v.List(".")
+	}
+	return v.List(dir)
+}
+
+func completionScript(shell string) (string, error) {
+	switch shell {
+	case "bash":
+		return bashCompletion, nil
+	case "zsh":
+		return zshCompletion, nil
+	case "fish":
+		return fishCompletion, nil
+	}
+	return "", fmt.Errorf("unsupported shell '%s' (should be one of bash, zsh or fish)", shell)
+}
+
+const bashCompletion = `# bash completion for safe
+#
+# Load it with:  source <(safe completion bash)
+
+_safe() {
+	local cur words cword
+	if declare -F _get_comp_words_by_ref >/dev/null; then
+		_get_comp_words_by_ref -n : cur words cword
+	else
+		cur=${COMP_WORDS[COMP_CWORD]}
+		words=("${COMP_WORDS[@]}")
+		cword=$COMP_CWORD
+	fi
+
+	local IFS=$'\n'
+	COMPREPLY=( $(safe __complete "${words[@]:1:cword}" 2>/dev/null | cut -f1) )
+	if declare -F __ltrim_colon_completions >/dev/null; then
+		__ltrim_colon_completions "$cur"
+	fi
+	if [[ ${#COMPREPLY[@]} -eq 1 && ${COMPREPLY[0]} == */ ]]; then
+		compopt -o nospace
+	fi
+}
+complete -o default -F _safe safe
+`
+
+const zshCompletion = `#compdef safe
+#
+# Load it with:  source <(safe completion zsh)
+# or put it in your $fpath, as _safe
+
+_safe() {
+	local -a dirs others
+	local line word desc
+	for line in "${(@f)$(safe __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}"; do
+		[[ -z $line ]] && continue
+		word=${line%%$'\t'*}
+		desc=""
+		[[ $line == *$'\t'* ]] && desc=${line#*$'\t'}
+		word=${word//:/\\:}
+		if [[ $word == */ ]]; then
+			dirs+=("$word${desc:+:$desc}")
+		else
+			others+=("$word${desc:+:$desc}")
+		fi
+	done
+
+	if (( ${#dirs} + ${#others} == 0 )); then
+		_files
+		return
+	fi
+	(( ${#others} )) && _describe -t safe 'safe' others
+	(( ${#dirs} )) && _describe -t safe 'safe' dirs -S ''
+	return 0
+}
+
+if [[ "$funcstack[1]" == "_safe" ]]; then
+	_safe "$@"
+else
+	compdef _safe safe
+fi
+`
+
+const fishCompletion = `# fish completion for safe
+#
+# Load it with:  safe completion fish | source
+
+function __safe_complete
+	set -l words (commandline -opc)
+	set -e words[1]
+	set -l cur (commandline -ct)
+	safe __complete $words "$cur" 2>/dev/null
+end
+
+complete -c safe -f -a '(__safe_complete)'
+`
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	fmt "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/bundle"
+	"github.com/starkandwayne/safe/rc"
+	"github.com/starkandwayne/safe/vault"
+)
+
+// splitTargetPath splits a `TARGET:PATH` argument into its target alias and
+// path.  If the part before the first colon isn't a known target, the whole
+// argument is a path (possibly with a :key), on the current target.
+func splitTargetPath(cfg rc.Config, spec string) (string, string) {
+	if i := strings.Index(spec, ":"); i > 0 && !strings.Contains(spec[:i], "/") {
+		if _, ok, _ := cfg.Find(spec[:i]); ok {
+			return spec[:i], spec[i+1:]
+		}
+	}
+	return "", spec
+}
+
+// readExportFile reads a file written by `safe export` (either format,
+// encrypted or not) and returns its contents as a list of secrets.  Versions
+// are kept, oldest first, as they would be by ConstructSecrets.
+func readExportFile(file string, identities []string) (vault.Secrets, error) {
+	var b []byte
+	var err error
+	if file == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if bundle.IsBundle(b) {
+		if len(identities) == 0 {
+			return nil, fmt.Errorf("%s is encrypted; specify an --identity to decrypt it with", file)
+		}
+		ids, err := bundle.LoadIdentities(identities)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = bundle.Open(b, ids, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	var typeTest interface{}
+	if err := json.Unmarshal(b, &typeTest); err != nil {
+		return nil, fmt.Errorf("Could not interpret export file %s: %s", file, err)
+	}
+
+	secrets := vault.Secrets{}
+	switch typeTest.(type) {
+	case map[string]interface{}:
+		var data map[string]*vault.Secret
+		if err := json.Unmarshal(b, &data); err != nil {
+			return nil, err
+		}
+		for path, s := range data {
+			secrets.Append(vault.SecretEntry{
+				Path:     vault.Canonicalize(path),
+				Versions: []vault.SecretVersion{{Data: s, Number: 1, State: vault.SecretStateAlive}},
+			})
+		}
+
+	case []interface{}:
+		var data []exportFormat
+		if err := json.Unmarshal(b, &data); err != nil || len(data) != 1 || data[0].ExportVersion != 2 {
+			return nil, fmt.Errorf("Unknown export file format in %s", file)
+		}
+		for path, s := range data[0].Data {
+			first := s.FirstVersion
+			if first == 0 {
+				first = 1
+			}
+			entry := vault.SecretEntry{Path: vault.Canonicalize(path)}
+			for i, v := range s.Versions {
+				version := vault.SecretVersion{Data: vault.NewSecret(), Number: first + uint(i), State: vault.SecretStateAlive}
+				if v.Destroyed {
+					version.State = vault.SecretStateDestroyed
+				} else if v.Deleted {
+					version.State = vault.SecretStateDeleted
+				}
+				for k, val := range v.Value {
+					version.Data.Set(k, val, false)
+				}
+				entry.Versions = append(entry.Versions, version)
+			}
+			secrets.Append(entry)
+		}
+
+	default:
+		return nil, fmt.Errorf("Unknown export file format in %s", file)
+	}
+
+	secrets.Sort()
+	return secrets, nil
+}
+
+func printDiff(diffs []vault.SecretDiff, reveal bool) {
+	var added, removed, changed int
+	for _, d := range diffs {
+		path := d.Path
+		if path == "" {
+			path = "."
+		}
+		switch d.State {
+		case vault.DiffAdded:
+			added++
+			fmt.Printf("@G{+ %s}\n", path)
+		case vault.DiffRemoved:
+			removed++
+			fmt.Printf("@R{- %s}\n", path)
+		case vault.DiffChanged:
+			changed++
+			fmt.Printf("@Y{~ %s}\n", path)
+		}
+
+		for _, k := range d.Keys {
+			switch {
+			case k.State == vault.DiffAdded && reveal:
+				fmt.Printf("    @G{+ %s}: @M{%q}\n", k.Key, k.New)
+			case k.State == vault.DiffAdded:
+				fmt.Printf("    @G{+ %s}\n", k.Key)
+			case k.State == vault.DiffRemoved && reveal:
+				fmt.Printf("    @R{- %s}: @M{%q}\n", k.Key, k.Old)
+			case k.State == vault.DiffRemoved:
+				fmt.Printf("    @R{- %s}\n", k.Key)
+			case reveal:
+				fmt.Printf("    @Y{~ %s}: @M{%q} @Y{=>} @M{%q}\n", k.Key, k.Old, k.New)
+			default:
+				fmt.Printf("    @Y{~ %s}: (value changed)\n", k.Key)
+			}
+		}
+	}
+
+	if len(diffs) == 0 {
+		fmt.Fprintf(os.Stderr, "@G{no differences}\n")
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\n%d added, %d removed, %d changed\n", added, removed, changed)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	fmt "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/rc"
+	"github.com/starkandwayne/safe/vault"
+)
+
+var (
+	envNameRegexp   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	envUnsafeRegexp = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// An envMapping names an environment variable (or, for whole secrets, the
+// prefix for a set of them), and the secret that its value comes from.
+type envMapping struct {
+	Name string
+	Path string
+}
+
+// parseExecArgs splits the arguments to `safe exec` into the --map and
+// --prefix mappings, and the command to run.  The command starts after
+// the first `--`, or at the first argument that isn't an option.
+func parseExecArgs(args []string) (maps, prefixes []envMapping, command []string, err error) {
+	for len(args) > 0 {
+		arg := args[0]
+		args = args[1:]
+
+		if arg == "--" {
+			return maps, prefixes, args, nil
+		}
+		if !strings.HasPrefix(arg, "-") {
+			return maps, prefixes, append([]string{arg}, args...), nil
+		}
+
+		var value string
+		if eq := strings.Index(arg, "="); strings.HasPrefix(arg, "--") && eq > 0 {
+			arg, value = arg[:eq], arg[eq+1:]
+		} else if len(args) > 0 {
+			value, args = args[0], args[1:]
+		} else {
+			return nil, nil, nil, fmt.Errorf("missing value for %s option", arg)
+		}
+
+		parts := strings.SplitN(value, "=", 2)
+		switch arg {
+		case "-m", "--map":
+			if len(parts) != 2 || !envNameRegexp.MatchString(parts[0]) || !vault.PathHasKey(parts[1]) {
+				return nil, nil, nil, fmt.Errorf("invalid --map '%s' (should look like VAR=path/to/secret:key)", value)
+			}
+			maps = append(maps, envMapping{Name: parts[0], Path: parts[1]})
+
+		case "-p", "--prefix":
+			if len(parts) != 2 || (parts[0] != "" && !envNameRegexp.MatchString(parts[0])) || vault.PathHasKey(parts[1]) {
+				return nil, nil, nil, fmt.Errorf("invalid --prefix '%s' (should look like PREFIX=path/to/secret)", value)
+			}
+			prefixes = append(prefixes, envMapping{Name: parts[0], Path: parts[1]})
+
+		default:
+			return nil, nil, nil, fmt.Errorf("unrecognized option %s", arg)
+		}
+	}
+	return maps, prefixes, nil, nil
+}
+
+// envName turns a secret's key into an environment variable name, i.e.
+// the `api-key' key under the prefix `APP' becomes APP_API_KEY.
+func envName(prefix, key string) string {
+	name := strings.ToUpper(envUnsafeRegexp.ReplaceAllString(key, "_"))
+	if prefix == "" {
+		return name
+	}
+	return prefix + "_" + name
+}
+
+// secretEnv reads the secrets referenced by the mappings, and returns the
+// environment variables that they become.  Every key of a --prefix secret
+// gets its own variable; --map variables win out over those.
+func secretEnv(v *vault.Vault, maps, prefixes []envMapping) (map[string]string, error) {
+	env := make(map[string]string)
+	for _, p := range prefixes {
+		s, err := v.Read(p.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range s.Keys() {
+			name := envName(p.Name, key)
+			if !envNameRegexp.MatchString(name) {
+				return nil, fmt.Errorf("%s:%s cannot be put in the environment as $%s", p.Path, key, name)
+			}
+			env[name] = s.Get(key)
+		}
+	}
+	for _, m := range maps {
+		_, key, _ := vault.ParsePath(m.Path)
+		s, err := v.Read(m.Path)
+		if err != nil {
+			return nil, err
+		}
+		env[m.Name] = s.Get(key)
+	}
+	return env, nil
+}
+
+// execWithSecrets runs command with the given variables added to its
+// environment, forwarding signals to it, and exits with its exit status.
+// The secrets are only ever held in memory, and handed to the child
+// process directly.
+func execWithSecrets(command []string, env map[string]string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cmd.Env = os.Environ()
+	for _, name := range names {
+		cmd.Env = append(cmd.Env, name+"="+env[name])
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	stop := ForwardSignals(cmd.Process)
+	err := cmd.Wait()
+	stop()
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code := 1
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			code = status.ExitStatus()
+			if status.Signaled() {
+				code = 128 + int(status.Signal())
+			}
+		}
+		rc.Cleanup()
+		exit(code)
+	}
+	return err
+}
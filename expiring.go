@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	fmt "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+type certExpiry struct {
+	Path     string    `json:"path"`
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"not_after"`
+	DaysLeft int       `json:"days_left"`
+	Expired  bool      `json:"expired"`
+	//SignedBy is the path of the CA that signed the certificate (or the
+	// certificate itself, if self-signed); empty if it couldn't be found.
+	SignedBy string `json:"signed_by"`
+}
+
+// scanCertificates walks each of the given paths, and returns every secret
+// that holds an X.509 certificate, soonest to expire first.
+func scanCertificates(v *vault.Vault, paths []string) ([]certExpiry, error) {
+	type found struct {
+		path string
+		cert *vault.X509
+	}
+	var all []found
+	for _, path := range paths {
+		secrets, err := v.ConstructSecrets(path, vault.TreeOpts{FetchKeys: true})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, s := range secrets {
+			if len(s.Versions) == 0 || !s.Versions[len(s.Versions)-1].Data.IsX509() {
+				continue
+			}
+			cert, err := s.Versions[len(s.Versions)-1].Data.X509(false)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "@Y{skipping} @C{%s}@Y{: %s}\n", s.Path, err)
+				continue
+			}
+			all = append(all, found{path: s.Path, cert: cert})
+		}
+	}
+
+	certs := []certExpiry{}
+	for _, f := range all {
+		left := time.Until(f.cert.Certificate.NotAfter)
+		c := certExpiry{
+			Path:     f.path,
+			Subject:  f.cert.Subject(),
+			Issuer:   f.cert.Issuer(),
+			NotAfter: f.cert.Certificate.NotAfter,
+			DaysLeft: int(left.Hours() / 24),
+			Expired:  left <= 0,
+		}
+		if ca, caPath, err := v.FindSigningCA(f.cert, f.path, ""); err == nil {
+			//FindSigningCA guesses at a sibling `ca', make sure that it's the right one
+			if caPath == f.path || f.cert.Certificate.CheckSignatureFrom(ca.Certificate) == nil {
+				c.SignedBy = caPath
+			}
+		}
+		if c.SignedBy == "" {
+			//Otherwise, it may have been signed by one of the other CAs we found
+			for _, ca := range all {
+				if ca.cert.IsCA() && f.cert.Certificate.CheckSignatureFrom(ca.cert.Certificate) == nil {
+					c.SignedBy = ca.path
+					break
+				}
+			}
+		}
+		certs = append(certs, c)
+	}
+
+	sort.SliceStable(certs, func(i, j int) bool { return certs[i].NotAfter.Before(certs[j].NotAfter) })
+	return certs, nil
+}
+
+func printExpiring(certs []certExpiry) {
+	if len(certs) == 0 {
+		fmt.Fprintf(os.Stderr, "@G{no certificates expiring}\n")
+		return
+	}
+
+	t := table{}
+	t.setHeader("path", "subject", "expires", "signed by")
+	for _, c := range certs {
+		expires := fmt.Sprintf("@Y{in %d days}", c.DaysLeft)
+		if c.Expired {
+			expires = fmt.Sprintf("@R{EXPIRED %s}", c.NotAfter.Format("Jan 2 2006"))
+		} else if c.DaysLeft < 1 {
+			expires = fmt.Sprintf("@R{in %s}", time.Until(c.NotAfter).Round(time.Minute))
+		}
+		signedBy := fmt.Sprintf("@R{unknown}")
+		if c.SignedBy == c.Path {
+			signedBy = "self-signed"
+		} else if c.SignedBy != "" {
+			signedBy = fmt.Sprintf("@C{%s}", c.SignedBy)
+		}
+		t.addRow(fmt.Sprintf("@C{%s}", c.Path), c.Subject, expires, signedBy)
+	}
+	t.print()
+}
+
+// writePrometheusExpiry writes the expiry of every scanned certificate (not
+// just the expiring ones) in the Prometheus text exposition format, so that
+// it can be picked up by the node_exporter textfile collector.  The file is
+// replaced atomically, so the collector never sees it half-written.
+func writePrometheusExpiry(file string, certs []certExpiry, within string, expiring int) error {
+	var b strings.Builder
+	b.WriteString("# HELP safe_x509_certificate_expiry_timestamp_seconds Time at which the certificate expires, in seconds since the epoch.\n")
+	b.WriteString("# TYPE safe_x509_certificate_expiry_timestamp_seconds gauge\n")
+	for _, c := range certs {
+		b.WriteString(fmt.Sprintf("safe_x509_certificate_expiry_timestamp_seconds{path=\"%s\",subject=\"%s\",issuer=\"%s\",signed_by=\"%s\"} %d\n",
+			promLabel(c.Path), promLabel(c.Subject), promLabel(c.Issuer), promLabel(c.SignedBy), c.NotAfter.Unix()))
+	}
+	b.WriteString("# HELP safe_x509_certificates_expiring Number of certificates that have expired, or will expire within the window.\n")
+	b.WriteString("# TYPE safe_x509_certificates_expiring gauge\n")
+	b.WriteString(fmt.Sprintf("safe_x509_certificates_expiring{within=\"%s\"} %d\n", promLabel(within), expiring))
+
+	if file == "-" {
+		fmt.Printf("%s", b.String())
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func promLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
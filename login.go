@@ -0,0 +1,213 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/cloudfoundry-community/vaultkv"
+	fmt "github.com/jhunt/go-ansi"
+	"github.com/mattn/go-isatty"
+
+	"github.com/starkandwayne/safe/prompt"
+	"github.com/starkandwayne/safe/rc"
+	"github.com/starkandwayne/safe/vault"
+)
+
+// login logs in to v as auth says, and returns the new token.  Secrets
+// (like passwords) come from secrets, if they are there, or are asked for,
+// if interactive.  Anything else that has to be asked for (like a username)
+// is filled in on auth, so that it can be remembered.
+func login(v *vault.Vault, auth *rc.Auth, secrets map[string]string, interactive bool) (string, error) {
+	ask := func(key, label string, secret bool) (string, error) {
+		if val, ok := secrets[key]; ok {
+			return val, nil
+		}
+		if !interactive {
+			return "", fmt.Errorf("no %s to log in with", key)
+		}
+		if secret {
+			return prompt.Secure(label), nil
+		}
+		return prompt.Normal(label), nil
+	}
+	username := func(label string) (string, error) {
+		if auth.Username == "" {
+			name, err := ask("username", label, false)
+			if err != nil {
+				return "", err
+			}
+			auth.Username = name
+		}
+		return auth.Username, nil
+	}
+
+	mount := auth.Method
+	if auth.Path != "" {
+		mount = auth.Path
+	}
+
+	switch auth.Method {
+	case "token":
+		if auth.Path != "" {
+			return "", fmt.Errorf("Setting a custom path is not supported for token auth")
+		}
+		return ask("token", "Token: ", true)
+
+	case "ldap", "okta", "userpass":
+		label := "Username: "
+		if auth.Method == "ldap" {
+			label = "LDAP username: "
+		} else if auth.Method == "okta" {
+			label = "Okta username: "
+		}
+		name, err := username(label)
+		if err != nil {
+			return "", err
+		}
+		password, err := ask("password", "Password: ", true)
+		if err != nil {
+			return "", err
+		}
+
+		client := v.Client().Client
+		var result *vaultkv.AuthOutput
+		switch auth.Method {
+		case "ldap":
+			result, err = client.AuthLDAPMount(mount, name, password)
+		case "okta":
+			result, err = client.AuthOktaMount(mount, name, password)
+		default:
+			result, err = client.AuthUserpassMount(mount, name, password)
+		}
+		if err != nil {
+			return "", err
+		}
+		return result.ClientToken, nil
+
+	case "github":
+		accessToken, err := ask("token", "Github Personal Access Token: ", true)
+		if err != nil {
+			return "", err
+		}
+		result, err := v.Client().Client.AuthGithubMount(mount, accessToken)
+		if err != nil {
+			return "", err
+		}
+		return result.ClientToken, nil
+
+	case "approle":
+		if auth.RoleID == "" {
+			roleID, err := ask("role_id", "Role ID: ", false)
+			if err != nil {
+				return "", err
+			}
+			auth.RoleID = roleID
+		}
+		secretID, err := ask("secret_id", "Secret ID: ", true)
+		if err != nil {
+			return "", err
+		}
+		result, err := v.Client().Client.AuthApproleMount(mount, auth.RoleID, secretID)
+		if err != nil {
+			return "", err
+		}
+		return result.ClientToken, nil
+
+	case "oidc":
+		if !interactive {
+			return "", fmt.Errorf("no one to log in through the OIDC provider")
+		}
+		return oidcLogin(v, mount, auth.Role, auth.Port, !auth.NoBrowser)
+
+	case "jwt":
+		var jwt string
+		switch auth.JWTFile {
+		case "":
+			var err error
+			if jwt, err = ask("jwt", "JWT: ", true); err != nil {
+				return "", err
+			}
+		case "-":
+			b, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				return "", err
+			}
+			jwt = string(b)
+		default:
+			b, err := ioutil.ReadFile(auth.JWTFile)
+			if err != nil {
+				return "", fmt.Errorf("Could not read JWT from %s: %s", auth.JWTFile, err)
+			}
+			jwt = string(b)
+		}
+		return v.AuthJWT(mount, auth.Role, strings.TrimSpace(jwt))
+
+	case "kubernetes":
+		if auth.Role == "" {
+			return "", fmt.Errorf("A role is required to log in with kubernetes; give one with --role, or set $SAFE_AUTH_ROLE")
+		}
+		file := auth.JWTFile
+		if file == "" {
+			file = kubernetesTokenFile
+		}
+		jwt, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("Could not read service account token from %s: %s", file, err)
+		}
+		return v.AuthKubernetes(mount, auth.Role, strings.TrimSpace(string(jwt)))
+
+	case "cert":
+		if os.Getenv("VAULT_CLIENT_CERT") == "" {
+			return "", fmt.Errorf("No client certificate to log in with; give the target one with --client-cert and --client-key, or set $VAULT_CLIENT_CERT and $VAULT_CLIENT_KEY")
+		}
+		return v.AuthCert(mount, auth.Role)
+	}
+	return "", fmt.Errorf("Unrecognized authentication method '%s'", auth.Method)
+}
+
+// relogin logs in to the target aliased as alias again, as its remembered
+// auth says, and saves the new token.  It only asks for things if there is
+// someone at a terminal to answer.
+func relogin(v *vault.Vault, alias string) (string, error) {
+	if rc.Unattended {
+		return "", fmt.Errorf("not logging in again unattended")
+	}
+	cfg := rc.Read()
+	target, ok := cfg.Vaults[alias]
+	if !ok || target.Auth == nil {
+		return "", fmt.Errorf("no way to log in to '%s' again", alias)
+	}
+
+	fmt.Fprintf(os.Stderr, "@Y{Logging in to} @C{%s} @Y{again, with %s...}\n", alias, target.Auth.Method)
+	secrets, err := target.Auth.Secrets(alias, target.URL, target.Namespace)
+	if err != nil {
+		return "", err
+	}
+	v.SetToken("")
+	token, err := login(v, target.Auth, secrets, isatty.IsTerminal(os.Stdin.Fd()))
+	if err != nil {
+		return "", err
+	}
+	if err = saveToken(&cfg, alias, token); err != nil {
+		return "", err
+	}
+	if os.Getenv("VAULT_ADDR") == target.URL {
+		os.Setenv("VAULT_TOKEN", token)
+	}
+	return token, nil
+}
+
+// saveToken saves token as the token of the target aliased as alias.
+func saveToken(cfg *rc.Config, alias, token string) error {
+	//This handles saving the token to the correct target when using the -T
+	// flag to use a different target
+	currentTarget := cfg.Current
+	cfg.Current = alias
+	err := cfg.SetToken(token)
+	cfg.Current = currentTarget
+	if err != nil {
+		return fmt.Errorf("Could not find target with name `%s'", alias)
+	}
+	return cfg.Write()
+}
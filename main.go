@@ -1,8 +1,8 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
+	"crypto/ed25519"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
@@ -33,6 +33,7 @@ import (
 	env "github.com/jhunt/go-envirotron"
 	"gopkg.in/yaml.v2"
 
+	"github.com/starkandwayne/safe/bundle"
 	"github.com/starkandwayne/safe/prompt"
 	"github.com/starkandwayne/safe/rc"
 	"github.com/starkandwayne/safe/vault"
@@ -68,9 +69,13 @@ func connect(auth bool) *vault.Vault {
 		Namespace:  os.Getenv("VAULT_NAMESPACE"),
 		SkipVerify: shouldSkipVerify(),
 		CACerts:    caCertPool,
+		ClientCert: os.Getenv("VAULT_CLIENT_CERT"),
+		ClientKey:  os.Getenv("VAULT_CLIENT_KEY"),
+		RequireCAS: shouldRequireCAS(),
 	}
 
-	if auth && conf.Token == "" {
+	alias := rememberedAuth()
+	if auth && conf.Token == "" && alias == "" {
 		fmt.Fprintf(os.Stderr, "@R{You are not authenticated to a Vault.}\n")
 		fmt.Fprintf(os.Stderr, "Try @C{safe auth ldap}\n")
 		fmt.Fprintf(os.Stderr, " or @C{safe auth github}\n")
@@ -78,17 +83,101 @@ func connect(auth bool) *vault.Vault {
 		fmt.Fprintf(os.Stderr, " or @C{safe auth token}\n")
 		fmt.Fprintf(os.Stderr, " or @C{safe auth userpass}\n")
 		fmt.Fprintf(os.Stderr, " or @C{safe auth approle}\n")
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, " or @C{safe auth oidc}\n")
+		fmt.Fprintf(os.Stderr, " or @C{safe auth jwt}\n")
+		fmt.Fprintf(os.Stderr, " or @C{safe auth cert}\n")
+		fmt.Fprintf(os.Stderr, " or @C{safe auth kubernetes}\n")
+		exit(1)
 	}
 
-	v, err := vault.NewVault(conf)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "@R{!! %s}\n", err)
-		os.Exit(1)
+	v := session.reuse(conf)
+	if v == nil {
+		var err error
+		v, err = vault.NewVault(conf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "@R{!! %s}\n", err)
+			exit(1)
+		}
+		session.keep(conf, v)
+	}
+	if alias != "" {
+		v.SetReauthenticator(func() (string, error) {
+			//log in with a client of its own, since logging in changes
+			// the token of the client it is done with
+			fresh, err := vault.NewVault(conf)
+			if err != nil {
+				return "", err
+			}
+			token, err := relogin(fresh, alias)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "@R{!! Unable to log in to %s again: %s}\n", alias, err)
+			}
+			return token, err
+		})
+		if auth && conf.Token == "" {
+			token, err := relogin(v, alias)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "@R{!! Unable to log in to %s: %s}\n", alias, err)
+				exit(1)
+			}
+			v.SetToken(token)
+		}
 	}
+	v.Join(transaction)
 	return v
 }
 
+// rememberedAuth returns the alias of the target that was applied, if safe
+// remembers how to log in to it again.
+func rememberedAuth() string {
+	cfg := rc.Read()
+	if t, ok := cfg.Vaults[rc.Applied()]; ok && t.Auth != nil && t.URL == os.Getenv("VAULT_ADDR") {
+		return rc.Applied()
+	}
+	return ""
+}
+
+// kubernetesTokenFile is where Kubernetes projects the service account token
+// into every pod.
+const kubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// shouldRequireCAS returns true if every write should be check-and-set,
+// either because $SAFE_REQUIRE_CAS is set, or the require_cas option is.
+func shouldRequireCAS() bool {
+	if val := os.Getenv("SAFE_REQUIRE_CAS"); val != "" {
+		return val != "false" && val != "0"
+	}
+	return rc.Read().Options.RequireCAS
+}
+
+var vaultEnv = map[string]string{}
+
+func init() {
+	for _, e := range []string{"VAULT_ADDR", "VAULT_TOKEN", "VAULT_SKIP_VERIFY", "VAULT_CACERT", "VAULT_NAMESPACE", "VAULT_CLIENT_CERT", "VAULT_CLIENT_KEY"} {
+		vaultEnv[e] = os.Getenv(e)
+	}
+}
+
+// connectTo connects to the given target, regardless of whichever target
+// was applied before.  This lets a single command talk to more than one Vault.
+func connectTo(target string) *vault.Vault {
+	resetVaultEnv()
+	rc.Apply(target)
+	return connect(true)
+}
+
+// resetVaultEnv puts the Vault environment variables back the way they were
+// when safe started, before any target was applied.
+func resetVaultEnv() {
+	for e, val := range vaultEnv {
+		if val == "" {
+			os.Unsetenv(e)
+		} else {
+			os.Setenv(e, val)
+		}
+	}
+}
+
 // Exits program with error if no Vault targeted
 func getVaultURL() string {
 	ret := os.Getenv("VAULT_ADDR")
@@ -96,7 +185,7 @@ func getVaultURL() string {
 		fmt.Fprintf(os.Stderr, "@R{You are not targeting a Vault.}\n")
 		fmt.Fprintf(os.Stderr, "Try @C{safe target https://your-vault alias}\n")
 		fmt.Fprintf(os.Stderr, " or @C{safe target alias}\n")
-		os.Exit(1)
+		exit(1)
 	}
 	return ret
 }
@@ -108,6 +197,7 @@ type Options struct {
 	Clobber      bool `cli:"--clobber, --no-clobber"`
 	SkipIfExists bool
 	Quiet        bool `cli:"--quiet"`
+	Transaction  bool `cli:"--transaction"`
 
 	// Behavour of -T must chain through -- separated commands.  There is code
 	// that relies on this.  Will default to $SAFE_TARGET if it exists, or
@@ -118,6 +208,11 @@ type Options struct {
 	VersionCommand struct{} `cli:"version"`
 
 	Envvars struct{} `cli:"envvars"`
+
+	Completion struct{} `cli:"completion"`
+	Complete   struct{} `cli:"__complete!"`
+	Shell      struct{} `cli:"shell"`
+
 	Targets struct {
 		JSON bool `cli:"--json"`
 	} `cli:"targets"`
@@ -135,8 +230,14 @@ type Options struct {
 	} `cli:"env"`
 
 	Auth struct {
-		Path string `cli:"-p, --path"`
-		JSON bool   `cli:"--json"`
+		Path     string `cli:"-p, --path" env:"SAFE_AUTH_PATH"`
+		JSON     bool   `cli:"--json"`
+		Role     string `cli:"--role" env:"SAFE_AUTH_ROLE"`
+		JWTFile  string `cli:"--jwt-file" env:"SAFE_AUTH_JWT_FILE"`
+		Port     int    `cli:"--port"`
+		Browser  bool   `cli:"--browser, --no-browser"`
+		Remember bool   `cli:"--remember"`
+		Helper   string `cli:"--helper"`
 	} `cli:"auth, login"`
 
 	Logout struct{} `cli:"logout"`
@@ -175,22 +276,47 @@ type Options struct {
 		Yaml     bool `cli:"--yaml"`
 	} `cli:"get, read, cat"`
 
-	Versions struct{} `cli:"versions,revisions"`
+	Versions struct {
+		JSON bool `cli:"--json"`
+		Yaml bool `cli:"--yaml"`
+	} `cli:"versions,revisions"`
+
+	Meta struct {
+		Get struct {
+			JSON bool `cli:"--json"`
+		} `cli:"get"`
+		Set struct {
+			MaxVersions        string `cli:"--max-versions"`
+			CASRequired        string `cli:"--cas-required"`
+			DeleteVersionAfter string `cli:"--delete-version-after"`
+		} `cli:"set"`
+		Unset struct{} `cli:"unset"`
+	} `cli:"meta"`
 
 	List struct {
-		Single bool `cli:"-1"`
-		Quick  bool `cli:"-q, --quick"`
+		Single   bool     `cli:"-1"`
+		Quick    bool     `cli:"-q, --quick"`
+		JSON     bool     `cli:"--json"`
+		Yaml     bool     `cli:"--yaml"`
+		Meta     []string `cli:"--meta"`
+		ShowMeta bool     `cli:"--show-meta"`
 	} `cli:"ls"`
 
 	Paths struct {
 		ShowKeys bool `cli:"--keys"`
 		Quick    bool `cli:"-q, --quick"`
+		JSON     bool `cli:"--json"`
+		Yaml     bool `cli:"--yaml"`
 	} `cli:"paths"`
 
 	Tree struct {
-		ShowKeys   bool `cli:"--keys"`
-		HideLeaves bool `cli:"-d, --hide-leaves"`
-		Quick      bool `cli:"-q, --quick"`
+		ShowKeys   bool     `cli:"--keys"`
+		HideLeaves bool     `cli:"-d, --hide-leaves"`
+		Quick      bool     `cli:"-q, --quick"`
+		JSON       bool     `cli:"--json"`
+		Yaml       bool     `cli:"--yaml"`
+		Meta       []string `cli:"--meta"`
+		ShowMeta   bool     `cli:"--show-meta"`
 	} `cli:"tree"`
 
 	Target struct {
@@ -199,6 +325,9 @@ type Options struct {
 		Strongbox   bool     `cli:"-s, --strongbox, --no-strongbox"`
 		CACerts     []string `cli:"--ca-cert"`
 		Namespace   string   `cli:"-n, --namespace"`
+		ClientCert  string   `cli:"--client-cert"`
+		ClientKey   string   `cli:"--client-key"`
+		TokenStore  string   `cli:"--token-store"`
 
 		Delete struct{} `cli:"delete, rm"`
 	} `cli:"target"`
@@ -224,14 +353,42 @@ type Options struct {
 		//These do nothing but are kept for backwards-compat
 		OnlyAlive bool `cli:"-o, --only-alive"`
 		Shallow   bool `cli:"-s, --shallow"`
+
+		Recipients []string `cli:"-r, --recipient"`
+		SignWith   string   `cli:"--sign-with"`
 	} `cli:"export"`
 
 	Import struct {
 		IgnoreDestroyed bool `cli:"-I, --ignore-destroyed"`
 		IgnoreDeleted   bool `cli:"-i, --ignore-deleted"`
 		Shallow         bool `cli:"-s, --shallow"`
+
+		Identities         []string `cli:"--identity"`
+		VerifyWith         string   `cli:"--verify-with"`
+		InsecureUnverified bool     `cli:"--insecure-unverified"`
 	} `cli:"import"`
 
+	Diff struct {
+		Reveal     bool     `cli:"--reveal"`
+		Identities []string `cli:"--identity"`
+	} `cli:"diff"`
+
+	Sync struct {
+		DryRun bool `cli:"-n, --dry-run"`
+		Delete bool `cli:"--delete"`
+		Deep   bool `cli:"-d, --deep"`
+	} `cli:"sync"`
+
+	Plan  struct{} `cli:"plan"`
+	Apply struct{} `cli:"apply"`
+
+	Rotate struct {
+		OlderThan string `cli:"-o, --older-than"`
+		Manifest  string `cli:"-f, --manifest"`
+		DryRun    bool   `cli:"-n, --dry-run"`
+		JSON      bool   `cli:"--json"`
+	} `cli:"rotate"`
+
 	Move struct {
 		Recurse bool `cli:"-R, -r, --recurse"`
 		Force   bool `cli:"-f, --force"`
@@ -245,17 +402,58 @@ type Options struct {
 	} `cli:"copy, cp"`
 
 	Gen struct {
-		Policy string `cli:"-p, --policy"`
-		Length int    `cli:"-l, --length"`
+		Policy      string `cli:"-p, --policy"`
+		Length      int    `cli:"-l, --length"`
+		Generator   string `cli:"-g, --generator"`
+		MinLower    int    `cli:"--min-lower"`
+		MinUpper    int    `cli:"--min-upper"`
+		MinDigits   int    `cli:"--min-digits"`
+		MinSymbols  int    `cli:"--min-symbols"`
+		Unique      bool   `cli:"--unique"`
+		Unambiguous bool   `cli:"--unambiguous"`
+		Separator   string `cli:"--separator"`
+		Remember    bool   `cli:"--remember"`
 	} `cli:"gen, auto, generate"`
 
-	SSH     struct{} `cli:"ssh"`
-	RSA     struct{} `cli:"rsa"`
+	SSH struct {
+		KeyType string `cli:"-t, --key-type"`
+	} `cli:"ssh"`
+
+	RSA struct {
+		KeyType string `cli:"-t, --key-type"`
+	} `cli:"rsa"`
+
 	DHParam struct{} `cli:"dhparam, dhparams, dh"`
 	Prompt  struct{} `cli:"prompt"`
 	Vault   struct{} `cli:"vault!"`
+	Exec    struct{} `cli:"exec!"`
 	Fmt     struct{} `cli:"fmt"`
 
+	Find struct {
+		Regex      bool `cli:"-e, --regex"`
+		IgnoreCase bool `cli:"-i, --ignore-case"`
+	} `cli:"find"`
+
+	Grep struct {
+		Values     bool `cli:"--values"`
+		IgnoreCase bool `cli:"-i, --ignore-case"`
+	} `cli:"grep"`
+
+	History struct {
+		Alias   string `cli:"-a, --alias"`
+		User    string `cli:"-u, --user"`
+		Command string `cli:"-c, --command"`
+		Path    string `cli:"-p, --path"`
+		Since   string `cli:"-s, --since"`
+		Limit   int    `cli:"-n, --limit"`
+		JSON    bool   `cli:"--json"`
+	} `cli:"history"`
+
+	Render struct {
+		Output string `cli:"-o, --output"`
+		Mode   string `cli:"-m, --mode"`
+	} `cli:"render"`
+
 	Curl struct {
 		DataOnly bool `cli:"--data-only"`
 	} `cli:"curl"`
@@ -279,15 +477,19 @@ type Options struct {
 			CA           bool     `cli:"-A, --ca"`
 			Subject      string   `cli:"-s, --subj, --subject"`
 			Bits         int      `cli:"-b, --bits"`
+			KeyType      string   `cli:"--key-type"`
 			SignedBy     string   `cli:"-i, --signed-by"`
 			Name         []string `cli:"-n, --name"`
 			TTL          string   `cli:"-t, --ttl"`
 			KeyUsage     []string `cli:"-u, --key-usage"`
 			SigAlgorithm string   `cli:"-l, --sig-algorithm"`
+			PKI          string   `cli:"--pki"`
+			Role         string   `cli:"--role"`
 		} `cli:"issue"`
 
 		Revoke struct {
 			SignedBy string `cli:"-i, --signed-by"`
+			PKI      string `cli:"--pki"`
 		} `cli:"revoke"`
 
 		Renew struct {
@@ -297,12 +499,14 @@ type Options struct {
 			TTL          string   `cli:"-t, --ttl"`
 			KeyUsage     []string `cli:"-u, --key-usage"`
 			SigAlgorithm string   `cli:"-l, --sig-algorithm"`
+			Recursive    bool     `cli:"-R, --recursive"`
 		} `cli:"renew"`
 
 		Reissue struct {
 			Subject      string   `cli:"-s, --subj, --subject"`
 			Name         []string `cli:"-n, --name"`
 			Bits         int      `cli:"-b, --bits"`
+			KeyType      string   `cli:"--key-type"`
 			SignedBy     string   `cli:"-i, --signed-by"`
 			TTL          string   `cli:"-t, --ttl"`
 			KeyUsage     []string `cli:"-u, --key-usage"`
@@ -310,8 +514,16 @@ type Options struct {
 		} `cli:"reissue"`
 
 		Show struct {
+			JSON bool `cli:"--json"`
+			Yaml bool `cli:"--yaml"`
 		} `cli:"show"`
 
+		Expiring struct {
+			Within     string `cli:"-w, --within"`
+			JSON       bool   `cli:"--json"`
+			Prometheus string `cli:"--prometheus"`
+		} `cli:"expiring"`
+
 		CRL struct {
 			Renew bool `cli:"--renew"`
 		} `cli:"crl"`
@@ -320,17 +532,18 @@ type Options struct {
 
 func main() {
 	var opt Options
-	opt.Gen.Policy = "a-zA-Z0-9"
+	opt.Gen.Separator = "-"
 
 	opt.Clobber = true
 
-	opt.X509.Issue.Bits = 4096
+	opt.Auth.Browser = true
 
 	opt.Init.Persist = true
 	opt.Rekey.Persist = true
 
 	opt.Target.Strongbox = true
 
+	rc.Exit = exit
 	go Signals()
 
 	r := NewRunner()
@@ -345,7 +558,7 @@ func main() {
 		} else {
 			fmt.Fprintf(os.Stderr, "safe (development build)\n")
 		}
-		os.Exit(0)
+		exit(0)
 		return nil
 	})
 
@@ -354,7 +567,54 @@ func main() {
 			args = append(args, "commands")
 		}
 		r.Help(os.Stderr, strings.Join(args, " "))
-		os.Exit(0)
+		exit(0)
+		return nil
+	})
+
+	r.Dispatch("completion", &Help{
+		Summary: "Print a shell completion script",
+		Usage:   "safe completion bash|zsh|fish",
+		Type:    AdministrativeCommand,
+		Description: `
+Prints a script that teaches your shell to complete safe commands, their
+sub-commands and flags, and the paths (and path:keys) of secrets in the
+currently targeted Vault.  Paths are listed live, as you hit tab, and cached
+for a couple of minutes so that tab stays fast.
+
+To load completion in the current shell:
+
+  bash:  source <(safe completion bash)
+  zsh:   source <(safe completion zsh)
+  fish:  safe completion fish | source
+
+To load it in every shell, put that in your ~/.bashrc, ~/.zshrc, or
+~/.config/fish/config.fish.
+`,
+	}, func(command string, args ...string) error {
+		if len(args) != 1 {
+			r.ExitWithUsage("completion")
+		}
+		script, err := completionScript(args[0])
+		if err != nil {
+			return err
+		}
+		os.Stdout.WriteString(script)
+		return nil
+	})
+
+	r.Dispatch("__complete", &Help{Type: HiddenCommand}, func(command string, args ...string) error {
+		if len(args) == 0 {
+			args = []string{""}
+		}
+		rc.Unattended = true
+		root := completionTree(reflect.TypeOf(opt), nil, false)
+		for _, c := range r.complete(root, args) {
+			if c.Description != "" {
+				os.Stdout.WriteString(c.Word + "\t" + c.Description + "\n")
+			} else {
+				os.Stdout.WriteString(c.Word + "\n")
+			}
+		}
 		return nil
 	})
 
@@ -362,6 +622,43 @@ func main() {
 		fmt.Printf(`@G{[SCRIPTING]}
   @B{SAFE_TARGET}    The vault alias which requests are sent to.
 
+@G{[AUDITING]}
+  @B{SAFE_AUDIT_LOG} Where to keep the journal of destructive commands, for
+                 'safe history'.  Defaults to ~/.safe_audit.log.
+
+@G{[AUTHENTICATING]}
+  @B{SAFE_AUTH_PATH} Where the auth backend is mounted, for 'safe auth'.
+  @B{SAFE_AUTH_ROLE} The role to log in as, for 'safe auth'.
+  @B{SAFE_AUTH_JWT_FILE}
+                 The file holding the JWT (or Kubernetes service account
+                 token) for 'safe auth jwt' and 'safe auth kubernetes'.
+
+@G{[STORING TOKENS]}
+  @B{SAFE_TOKEN_FILE}
+                 Where the encrypted token store is kept.  Defaults to
+                 ~/.safe_tokens.
+  @B{SAFE_TOKEN_PASSPHRASE}
+                 The passphrase of the encrypted token store, so that
+                 you are not asked for it.
+  @B{SAFE_TOKEN_KEY_FILE}
+                 A file (of random bytes, like an age identity) to
+                 derive the key of the encrypted token store from,
+                 instead of using a passphrase.
+  @B{SAFE_TOKEN_KDF}
+                 Either 'passphrase' or 'keyfile', to re-encrypt the
+                 encrypted token store that way the next time it is
+                 written, instead of the way it was encrypted before.
+
+@G{[ENCRYPTED EXPORTS]}
+  @B{SAFE_PGP_PASSPHRASE}
+                 The passphrase of the OpenPGP secret keys given to
+                 'safe import --identity' and 'safe diff --identity'.
+
+@G{[WRITING]}
+  @B{SAFE_REQUIRE_CAS}
+                 If set (and not 'false' or '0'), every write must be
+                 check-and-set, overriding the require_cas option.
+
 @G{[PROXYING]}
   @B{HTTP_PROXY}     The proxy to use for HTTP requests.
   @B{HTTPS_PROXY}    The proxy to use for HTTPS requests.
@@ -499,8 +796,24 @@ for this target.
 PEM-encoded certificate. The given certificate will be trusted as the signing
 certificate to the certificate served by the Vault server. This flag can be
 provided multiple times to provide multiple CA certificates.
+
+--client-cert and --client-key are the files holding the certificate (and its
+private key) to present to Vaults, or load balancers in front of them, that
+require mutual TLS, and to log in with, using 'safe auth cert'.  They are
+remembered as paths, so the files have to stay where they are.
+
+--token-store sets where the target's token is kept, instead of in plain text,
+in ~/.saferc (which is what 'saferc' does, and the default).  'encrypted' keeps
+it in ~/.safe_tokens (or $SAFE_TOKEN_FILE), encrypted with a passphrase (from
+$SAFE_TOKEN_PASSPHRASE, or asked for), or with a key derived from the contents
+of $SAFE_TOKEN_KEY_FILE.  'helper:COMMAND' hands it to a credential helper,
+like git's: COMMAND is run with get, store or erase as its argument, and the
+target (alias=, url=, namespace= and, to store, token= lines) on its standard
+input.  For get, it prints token=... to its standard output.  The token the
+target already has is moved across.  This can be given with just the ALIAS,
+to change the store of an existing target.
 `,
-		Usage: "safe [-k] [--[no]-strongbox] [-n] [--ca-cert] target [URL] [ALIAS] | safe target -i",
+		Usage: "safe [-k] [--[no]-strongbox] [-n] [--ca-cert] [--client-cert --client-key] target [--token-store STORE] [URL] [ALIAS] | safe target -i",
 		Type:  AdministrativeCommand,
 	}, func(command string, args ...string) error {
 		var cfg rc.Config
@@ -527,6 +840,12 @@ provided multiple times to provide multiple CA certificates.
 			if cfg.Namespace() != "" {
 				fmt.Fprintf(os.Stderr, "Using namespace @C{%s}\n", cfg.Namespace())
 			}
+			if cert, _ := cfg.ClientCert(); cert != "" {
+				fmt.Fprintf(os.Stderr, "Using client certificate @C{%s}\n", cert)
+			}
+			if store := cfg.TokenStore(); store != "" {
+				fmt.Fprintf(os.Stderr, "Keeping its token in the @C{%s} token store\n", store)
+			}
 			if cfg.HasStrongbox() {
 				urlAsURL, err := url.Parse(u)
 				fmt.Fprintf(os.Stderr, "Uses Strongbox")
@@ -549,7 +868,7 @@ provided multiple times to provide multiple CA certificates.
 					fmt.Fprintf(os.Stderr, "     @C{safe target ops https://address.of.your.vault}\n")
 					fmt.Fprintf(os.Stderr, "     @C{safe auth (github|token|ldap|okta|userpass)}\n")
 					fmt.Fprintf(os.Stderr, "\n")
-					os.Exit(1)
+					exit(1)
 				}
 				r.Execute("targets")
 
@@ -610,6 +929,11 @@ provided multiple times to provide multiple CA certificates.
 			if err != nil {
 				return err
 			}
+			if opt.Target.TokenStore != "" {
+				if err = cfg.SetTokenStore(cfg.Current, opt.Target.TokenStore); err != nil {
+					return err
+				}
+			}
 			if !opt.Quiet {
 				printTarget()
 			}
@@ -651,16 +975,39 @@ provided multiple times to provide multiple CA certificates.
 				caCerts = append(caCerts, string(toWrite))
 			}
 
+			clientCert, clientKey := opt.Target.ClientCert, opt.Target.ClientKey
+			if clientCert != "" || clientKey != "" {
+				if clientCert == "" || clientKey == "" {
+					return fmt.Errorf("--client-cert and --client-key have to be given together")
+				}
+				if clientCert, err = filepath.Abs(clientCert); err != nil {
+					return err
+				}
+				if clientKey, err = filepath.Abs(clientKey); err != nil {
+					return err
+				}
+				if _, err = tls.LoadX509KeyPair(clientCert, clientKey); err != nil {
+					return fmt.Errorf("Error reading client certificate: %s", err)
+				}
+			}
+
 			err = cfg.SetTarget(alias, rc.Vault{
 				URL:         url,
 				SkipVerify:  skipverify,
 				NoStrongbox: !opt.Target.Strongbox,
 				Namespace:   opt.Target.Namespace,
 				CACerts:     caCerts,
+				ClientCert:  clientCert,
+				ClientKey:   clientKey,
 			})
 			if err != nil {
 				return err
 			}
+			if opt.Target.TokenStore != "" {
+				if err = cfg.SetTokenStore(alias, opt.Target.TokenStore); err != nil {
+					return err
+				}
+			}
 			if !opt.Quiet {
 				printTarget()
 			}
@@ -681,11 +1028,9 @@ provided multiple times to provide multiple CA certificates.
 			r.ExitWithUsage("target delete")
 		}
 
-		delete(cfg.Vaults, args[0])
-		if cfg.Current == args[0] {
-			cfg.Current = ""
+		if err := cfg.Forget(args[0]); err != nil {
+			return err
 		}
-
 		return cfg.Write()
 	})
 
@@ -868,7 +1213,7 @@ listener "tcp" {
 				fmt.Fprintf(os.Stderr, "@R{      You may have some environmental cleanup to do.}\n")
 				fmt.Fprintf(os.Stderr, "@R{      Apologies.}\n")
 			}
-			os.Exit(1)
+			exit(1)
 		}
 
 		cfg := rc.Apply("")
@@ -1350,6 +1695,202 @@ Vault will remain sealed).
 		return nil
 	})
 
+	r.Dispatch("exec", &Help{
+		Summary: "Run a command with secrets in its environment",
+		Usage:   "safe exec [--map VAR=path:key ...] [--prefix PREFIX=path ...] [--] command [args ...]",
+		Type:    NonDestructiveCommand,
+		Description: `
+Runs a command with values from the Vault set as environment variables,
+so that wrapper scripts don't need to 'safe get' each one.
+
+The following options are recognized:
+
+  -m, --map VAR=path:key     Set $VAR to the value of path:key.
+                             Can be given more than once.
+
+  -p, --prefix PREFIX=path   Set a variable for every key of the secret at
+                             path, named PREFIX_KEY (upper-cased, with any
+                             characters that can't be in a variable name
+                             replaced by '_').  With an empty PREFIX
+                             (i.e. '=path'), the variables are just KEY.
+                             Can be given more than once.
+
+Variables from --map take precedence over those from --prefix, and both
+over the ones safe was run with.  The command starts after '--', or at the
+first argument that isn't an option, so 'safe exec' cannot be chained with
+other safe commands; global options like -T must come before 'exec'.
+
+The secrets are passed straight to the command, and never written to disk.
+Signals sent to safe are passed on to the command, and safe exits with the
+command's exit status.
+
+Example:
+
+  safe exec --map DB_PASS=secret/app/db:password --prefix AWS=secret/aws -- ./deploy.sh
+`,
+	}, func(command string, args ...string) error {
+		maps, prefixes, cmd, err := parseExecArgs(args)
+		if err != nil {
+			return err
+		}
+		if len(cmd) == 0 {
+			r.ExitWithUsage("exec")
+		}
+
+		rc.Apply(opt.UseTarget)
+		v := connect(true)
+
+		env, err := secretEnv(v, maps, prefixes)
+		if err != nil {
+			return err
+		}
+		return execWithSecrets(cmd, env)
+	})
+
+	r.Dispatch("history", &Help{
+		Summary: "Show who ran which destructive commands against which targets",
+		Usage:   "safe history [-a ALIAS] [-u USER] [-c COMMAND] [-p PATH] [-s SINCE] [-n N] [--json]",
+		Type:    NonDestructiveCommand,
+		Description: `
+Every destructive command that safe runs (set, delete, gen, x509 issue,
+import and the like) is recorded in a local audit journal, along with when
+it was run, by which user, against which target, and whether it worked.
+Only the paths and keys that were touched are recorded, never the values.
+
+The journal is kept in ~/.safe_audit.log, unless $SAFE_AUDIT_LOG says
+otherwise.  Point that at a shared file to see what everyone on a jumpbox
+has been up to.
+
+The following options are recognized:
+
+  -a, --alias ALIAS      Only show commands run against this target (alias
+                         or URL).
+
+  -u, --user USER        Only show commands run by this (OS) user.
+
+  -c, --command CMD      Only show runs of this command, i.e. 'set', or
+                         'x509' for all of the x509 sub-commands.
+
+  -p, --path PATH        Only show commands that touched PATH, or anything
+                         underneath it.
+
+  -s, --since DURATION   Only show commands from the last DURATION, i.e.
+                         12h or 7d.
+
+  -n, --limit N          Only show the last N matching commands.
+
+  --json                 Print the matching history as JSON.
+`,
+	}, func(command string, args ...string) error {
+		if len(args) != 0 {
+			r.ExitWithUsage("history")
+		}
+
+		filter := auditFilter{
+			Target:  opt.History.Alias,
+			User:    opt.History.User,
+			Command: opt.History.Command,
+			Path:    opt.History.Path,
+		}
+		if opt.History.Since != "" {
+			since, err := duration(opt.History.Since)
+			if err != nil {
+				return err
+			}
+			filter.Since = time.Now().Add(-since)
+		}
+
+		entries, err := readAudit(filter)
+		if err != nil {
+			return err
+		}
+		if opt.History.Limit > 0 && len(entries) > opt.History.Limit {
+			entries = entries[len(entries)-opt.History.Limit:]
+		}
+
+		if opt.History.JSON {
+			return printStructured(entries, false)
+		}
+		printAudit(entries)
+		return nil
+	})
+
+	r.Dispatch("render", &Help{
+		Summary: "Render a template, filling in values from the Vault",
+		Usage:   "safe render [-o FILE] [-m MODE] TEMPLATE",
+		Type:    NonDestructiveCommand,
+		Description: `
+Renders TEMPLATE, a Go text/template (or '-' to read one from standard
+input), and prints the result, or writes it to a file with -o.
+
+Templates can use these functions to look things up in the Vault:
+
+  secret "path:key"     The value of a single key.
+  secrets "path"        All of the keys of a secret, as a map:
+                          {{ range $k, $v := secrets "secret/app" }}...{{ end }}
+                          {{ (secrets "secret/app").password }}
+  cert "path"           An X.509 certificate.  It has the same fields as
+                        'safe x509 show --json' (.Subject, .NotAfter, .DNSNames
+                        and so on, but capitalized), as well as .Certificate,
+                        .Key and .Combined, the PEM-encoded certificate, key
+                        and both together.
+
+Rendering fails, without writing anything, if any secret or key that the
+template refers to does not exist.
+
+The following options are recognized:
+
+  -o, --output FILE   Write the rendered template to FILE, instead of
+                      standard output.  The file is replaced atomically.
+
+  -m, --mode MODE     The (octal) permissions for the output file.
+                      Defaults to 0600.  Since the output is full of
+                      secrets, it cannot be readable by everyone.
+`,
+	}, func(command string, args ...string) error {
+		if len(args) != 1 {
+			r.ExitWithUsage("render")
+		}
+
+		mode := os.FileMode(0600)
+		if opt.Render.Mode != "" {
+			m, err := strconv.ParseUint(opt.Render.Mode, 8, 32)
+			if err != nil || m&^0777 != 0 {
+				return fmt.Errorf("invalid file mode '%s'", opt.Render.Mode)
+			}
+			if m&0007 != 0 {
+				return fmt.Errorf("refusing to write rendered secrets with mode %04o, which would let anyone read or change them", m)
+			}
+			mode = os.FileMode(m)
+		}
+
+		var (
+			src []byte
+			err error
+		)
+		if args[0] == "-" {
+			src, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			src, err = ioutil.ReadFile(args[0])
+		}
+		if err != nil {
+			return err
+		}
+
+		rc.Apply(opt.UseTarget)
+		v := connect(true)
+
+		out, err := renderTemplate(v, args[0], src)
+		if err != nil {
+			return err
+		}
+		if opt.Render.Output == "" {
+			_, err = os.Stdout.Write(out)
+			return err
+		}
+		return writeSecretFile(opt.Render.Output, out, mode)
+	})
+
 	r.Dispatch("env", &Help{
 		Summary: "Print the environment variables for the current target",
 		Usage:   "safe env",
@@ -1371,13 +1912,15 @@ written to STDOUT instead of STDERR to make it easier to consume.
 		if opt.Env.ForBash && opt.Env.ForFish && opt.Env.ForJSON {
 			r.Help(os.Stderr, "env")
 			fmt.Fprintf(os.Stderr, "@R{Only specify one of --json, --bash OR --fish.}\n")
-			os.Exit(1)
+			exit(1)
 		}
 		vars := map[string]string{
 			"VAULT_ADDR":        os.Getenv("VAULT_ADDR"),
 			"VAULT_TOKEN":       os.Getenv("VAULT_TOKEN"),
 			"VAULT_SKIP_VERIFY": os.Getenv("VAULT_SKIP_VERIFY"),
 			"VAULT_NAMESPACE":   os.Getenv("VAULT_NAMESPACE"),
+			"VAULT_CLIENT_CERT": os.Getenv("VAULT_CLIENT_CERT"),
+			"VAULT_CLIENT_KEY":  os.Getenv("VAULT_CLIENT_KEY"),
 		}
 
 		switch {
@@ -1403,11 +1946,15 @@ written to STDOUT instead of STDERR to make it easier to consume.
 				Token string `json:"VAULT_TOKEN,omitempty"`
 				Skip  string `json:"VAULT_SKIP_VERIFY,omitempty"`
 				NS    string `json:"VAULT_NAMESPACE,omitempty"`
+				Cert  string `json:"VAULT_CLIENT_CERT,omitempty"`
+				Key   string `json:"VAULT_CLIENT_KEY,omitempty"`
 			}{
 				Addr:  vars["VAULT_ADDR"],
 				Token: vars["VAULT_TOKEN"],
 				Skip:  vars["VAULT_SKIP_VERIFY"],
 				NS:    vars["VAULT_NAMESPACE"],
+				Cert:  vars["VAULT_CLIENT_CERT"],
+				Key:   vars["VAULT_CLIENT_KEY"],
 			}
 			b, err := json.Marshal(jsonEnv)
 			if err != nil {
@@ -1428,7 +1975,7 @@ written to STDOUT instead of STDERR to make it easier to consume.
 
 	r.Dispatch("auth", &Help{
 		Summary: "Authenticate to the current target",
-		Usage:   "safe auth [--path <value>] (token|github|ldap|okta|userpass|approle)",
+		Usage:   "safe auth [--path <value>] [--remember [--helper <command>]] (token|github|ldap|okta|userpass|approle|oidc|jwt|cert|kubernetes)",
 		Description: `
 Set the authentication token sent when talking to the Vault.
 
@@ -1440,6 +1987,12 @@ ldap      Provide LDAP user credentials.
 okta      Provide Okta user credentials.
 userpass  Provide a username and password registered with the UserPass backend.
 approle   Provide a client ID and client secret registered with the AppRole backend.
+oidc      Log in through your OIDC provider, in a browser.
+jwt       Provide a JSON Web Token (say, from your CI system) to the JWT backend.
+cert      Present the target's client certificate (see 'safe help target') to
+          the TLS Certificates backend.
+kubernetes
+          Log in from inside a Kubernetes pod, with its service account token.
 status    Get information about current authentication status
 
 Flags:
@@ -1448,12 +2001,45 @@ Flags:
               Defaults to the name of auth type (e.g. "userpass"), which is
               the default when creating auth backends with the Vault CLI.
   -j, --json  For auth status, returns the information as a JSON object.
+  --role      For oidc, jwt, cert and kubernetes, the role to log in as.
+              Kubernetes requires one; otherwise it defaults to the default
+              role of the auth backend or, for cert, to whichever role the
+              certificate matches.
+  --jwt-file  For jwt, the file to read the token from, instead of
+              prompting for it.  Use '-' to read it from standard input.
+              For kubernetes, the service account token file, which is
+              /var/run/secrets/kubernetes.io/serviceaccount/token by default.
+  --port      For oidc, the port on localhost to listen on for the
+              identity provider to send the browser back to, once you have
+              logged in.  Defaults to 8250, so the role has to allow
+              http://localhost:8250/oidc/callback as a redirect URI.
+  --no-browser
+              For oidc, print the URL to log in at, without trying to open
+              a browser.
+  --remember  Remember how you logged in (the method, and anything else
+              that isn't secret, like the --path, the username or the role
+              ID) in ~/.saferc, so that safe can log in the same way again
+              when the token expires, and retry whatever was refused.
+              Secrets are asked for again (as long as there is a terminal
+              to ask at) unless there is a --helper.  'safe logout' forgets.
+  --helper    A credential helper to get secrets from, instead of asking
+              for them.  It is run (through the shell) with 'get' as its
+              argument, and alias=, url=, namespace=, method=, path=,
+              username= and role_id= lines on its standard input, and
+              prints password=, secret_id=, token= or jwt= lines.
+
+--path, --role and --jwt-file can also be set with $SAFE_AUTH_PATH,
+$SAFE_AUTH_ROLE and $SAFE_AUTH_JWT_FILE.
+
+Without a target (when $VAULT_ADDR is all there is, as in a container),
+the token is written to ~/.vault-token, which is where safe (and the Vault
+CLI) looks for it when there is no target.
 `,
 		Type: AdministrativeCommand,
 	}, func(command string, args ...string) error {
 		cfg := rc.Apply(opt.UseTarget)
 		v := connect(false)
-		v.Client().Client.SetAuthToken("")
+		v.SetToken("")
 
 		method := "token"
 		if len(args) > 0 {
@@ -1462,75 +2048,18 @@ Flags:
 		}
 
 		var token string
-		var err error
 		url := os.Getenv("VAULT_ADDR")
 		target := cfg.Current
 		if opt.UseTarget != "" {
 			target = opt.UseTarget
 		}
-		fmt.Fprintf(os.Stderr, "Authenticating against @C{%s} at @C{%s}\n", target, url)
-
-		authMount := method
-		if opt.Auth.Path != "" {
-			authMount = opt.Auth.Path
+		if target != "" {
+			fmt.Fprintf(os.Stderr, "Authenticating against @C{%s} at @C{%s}\n", target, url)
+		} else {
+			fmt.Fprintf(os.Stderr, "Authenticating against @C{%s}\n", url)
 		}
 
 		switch method {
-		case "token":
-			if opt.Auth.Path != "" {
-				return fmt.Errorf("Setting a custom path is not supported for token auth")
-			}
-			token = prompt.Secure("Token: ")
-
-		case "ldap":
-			username := prompt.Normal("LDAP username: ")
-			password := prompt.Secure("Password: ")
-
-			result, err := v.Client().Client.AuthLDAPMount(authMount, username, password)
-			if err != nil {
-				return err
-			}
-			token = result.ClientToken
-
-		case "okta":
-			username := prompt.Normal("Okta username: ")
-			password := prompt.Secure("Password: ")
-
-			result, err := v.Client().Client.AuthOktaMount(authMount, username, password)
-			if err != nil {
-				return err
-			}
-			token = result.ClientToken
-
-		case "github":
-			accessToken := prompt.Secure("Github Personal Access Token: ")
-
-			result, err := v.Client().Client.AuthGithubMount(authMount, accessToken)
-			if err != nil {
-				return err
-			}
-			token = result.ClientToken
-
-		case "userpass":
-			username := prompt.Normal("Username: ")
-			password := prompt.Secure("Password: ")
-
-			result, err := v.Client().Client.AuthUserpassMount(authMount, username, password)
-			if err != nil {
-				return err
-			}
-			token = result.ClientToken
-
-		case "approle":
-			roleID := prompt.Normal("Role ID: ")
-			secretID := prompt.Secure("Secret ID: ")
-
-			result, err := v.Client().Client.AuthApproleMount(authMount, roleID, secretID)
-			if err != nil {
-				return err
-			}
-			token = result.ClientToken
-
 		case "status":
 			v := connect(false)
 			tokenInfo, err := v.Client().Client.TokenInfoSelf()
@@ -1562,19 +2091,47 @@ Flags:
 			return nil
 
 		default:
-			return fmt.Errorf("Unrecognized authentication method '%s'", method)
+			auth := &rc.Auth{
+				Method:    method,
+				Path:      opt.Auth.Path,
+				Role:      opt.Auth.Role,
+				JWTFile:   opt.Auth.JWTFile,
+				Port:      opt.Auth.Port,
+				NoBrowser: !opt.Auth.Browser,
+				Helper:    opt.Auth.Helper,
+			}
+			secrets, err := auth.Secrets(target, url, os.Getenv("VAULT_NAMESPACE"))
+			if err != nil {
+				return err
+			}
+			token, err = login(v, auth, secrets, true)
+			if err != nil {
+				return err
+			}
+
+			if opt.Auth.Remember {
+				if target == "" {
+					return fmt.Errorf("--remember needs a target to remember how to log in to")
+				}
+				if auth.JWTFile == "-" {
+					auth.JWTFile = ""
+				}
+				if err = cfg.Remember(target, auth); err != nil {
+					return err
+				}
+			}
 		}
 
-		//This handles saving the token to the correct target when using the -T
-		// flag to use a different target
-		currentTarget := cfg.Current
-		err = cfg.SetCurrent(target, false)
-		if err != nil {
-			return fmt.Errorf("Could not find target with name `%s'")
+		if target == "" {
+			file, err := rc.WriteVaultToken(token)
+			if err != nil {
+				return fmt.Errorf("Could not save token: %s", err)
+			}
+			fmt.Fprintf(os.Stderr, "Token written to @C{%s}\n", file)
+			return nil
 		}
-		cfg.SetToken(token)
-		cfg.SetCurrent(currentTarget, false)
-		return cfg.Write()
+
+		return saveToken(&cfg, target, token)
 	})
 
 	r.Dispatch("logout", &Help{
@@ -1584,6 +2141,7 @@ Flags:
 	}, func(command string, args ...string) error {
 		cfg := rc.Apply(opt.UseTarget)
 		cfg.SetToken("")
+		cfg.Remember(cfg.Current, nil)
 		err := cfg.Write()
 		if err != nil {
 			return err
@@ -1642,44 +2200,48 @@ Flags:
 		}
 		v := connect(true)
 		path, args := args[0], args[1:]
-		s, err := v.Read(path)
-		if err != nil && !vault.IsNotFound(err) {
-			return err
+
+		type pair struct {
+			key, value string
+			missing    bool
 		}
-		exists := (err == nil)
-		clobberKeys := []string{}
+		pairs := []*pair{}
 		for _, arg := range args {
 			k, v, missing, err := parseKeyVal(arg, opt.Quiet)
 			if err != nil {
 				return err
 			}
-			if opt.SkipIfExists && exists && s.Has(k) {
-				clobberKeys = append(clobberKeys, k)
-				continue
+			pairs = append(pairs, &pair{key: k, value: v, missing: missing})
+		}
+
+		return updateSecret(v, path, func(s *vault.Secret, exists bool) error {
+			clobberKeys := []string{}
+			for _, p := range pairs {
+				if opt.SkipIfExists && exists && s.Has(p.key) {
+					clobberKeys = append(clobberKeys, p.key)
+					continue
+				}
+				// realize that we're going to fail, and don't prompt the user for any info
+				if len(clobberKeys) > 0 {
+					continue
+				}
+				//Only ask once, even if we have to try the write again
+				if p.missing {
+					p.value, p.missing = pr(p.key, prompt, insecure), false
+				}
+				if err := s.Set(p.key, p.value, opt.SkipIfExists); err != nil {
+					return err
+				}
 			}
-			// realize that we're going to fail, and don't prompt the user for any info
 			if len(clobberKeys) > 0 {
-				continue
-			}
-			if missing {
-				v = pr(k, prompt, insecure)
-			}
-			if err != nil {
-				return err
-			}
-			err = s.Set(k, v, opt.SkipIfExists)
-			if err != nil {
-				return err
-			}
-		}
-		if len(clobberKeys) > 0 {
-			if !opt.Quiet {
-				fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to update} @C{%s}@R{, as the following keys would be clobbered:} @C{%s}\n",
-					path, strings.Join(clobberKeys, ", "))
+				if !opt.Quiet {
+					fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to update} @C{%s}@R{, as the following keys would be clobbered:} @C{%s}\n",
+						path, strings.Join(clobberKeys, ", "))
+				}
+				return errUnchanged
 			}
 			return nil
-		}
-		return v.Write(path, s)
+		})
 	}
 
 	r.Dispatch("ask", &Help{
@@ -1777,11 +2339,11 @@ certificate validation failure, etc. occur, they will be printed as well.
 		_, err := v.Read(args[0])
 		if err != nil {
 			if vault.IsNotFound(err) {
-				os.Exit(1)
+				exit(1)
 			}
 			return err
 		}
-		os.Exit(0)
+		exit(0)
 		return nil
 	})
 
@@ -1935,8 +2497,12 @@ paths/keys.
 
 	r.Dispatch("versions", &Help{
 		Summary: "Print information about the versions of one or more paths",
-		Usage:   "safe versions PATH [PATHS...]",
+		Usage:   "safe versions [--json|--yaml] PATH [PATHS...]",
 		Type:    NonDestructiveCommand,
+		Description: `
+Specifying --json or --yaml will print the versions of each path, along with
+their state, creation time, and the KV version of the mount, in that format.
+`,
 	}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
 		v := connect(true)
@@ -1945,6 +2511,8 @@ paths/keys.
 			return fmt.Errorf("No paths given")
 		}
 
+		structured := opt.Versions.JSON || opt.Versions.Yaml
+		var all []versionsOutput
 		for i := range args {
 			_, _, version := vault.ParsePath(args[i])
 			if version > 0 {
@@ -1958,6 +2526,29 @@ paths/keys.
 				return err
 			}
 
+			if structured {
+				mountVersion, err := v.MountVersion(args[i])
+				if err != nil {
+					return err
+				}
+				out := versionsOutput{Path: args[i], MountVersion: mountVersion, Versions: []versionOutput{}}
+				for j := range versions {
+					state := vault.SecretStateAlive
+					if versions[j].Destroyed {
+						state = vault.SecretStateDestroyed
+					} else if versions[j].Deleted {
+						state = vault.SecretStateDeleted
+					}
+					out.Versions = append(out.Versions, newVersionOutput(vault.SecretVersion{
+						Number:    versions[j].Version,
+						State:     state,
+						CreatedAt: versions[j].CreatedAt,
+					}))
+				}
+				all = append(all, out)
+				continue
+			}
+
 			if len(args) > 1 {
 				fmt.Printf("@B{%s}:\n", args[i])
 			}
@@ -1997,22 +2588,227 @@ paths/keys.
 			}
 		}
 
+		if structured {
+			return printStructured(all, opt.Versions.Yaml)
+		}
 		return nil
 	})
 
+	r.Dispatch("meta", &Help{
+		Summary: "Manage the metadata of secrets in KV v2 backends",
+		Usage:   "safe meta <command> [OPTIONS] PATH",
+		Type:    HiddenCommand,
+		Description: `
+KV v2 backends keep metadata for each secret, separate from its versions:
+how many versions to keep, whether writes must use check-and-set, how long
+until old versions are deleted, and any custom tags you care to give it.
+
+safe knows about the following tags, and will check their values:
+
+  @M{owner}              Who is responsible for the secret.
+  @M{rotation-interval}  How often the secret should be rotated, i.e. 90d.
+  @M{description}        What the secret is for.
+  @M{rotate-keys}        Which keys 'safe rotate' regenerates as passwords.
+  @M{rotate-policy}      The characters allowed in those passwords, i.e. a-z0-9.
+  @M{rotate-generator:KEY}
+                     How 'safe gen --remember' generated the password in
+                     KEY, so that 'safe rotate' can generate another one
+                     the same way.
+
+Any other tags can be set as well.  'safe ls' and 'safe tree' can show them
+with --show-meta, and filter on them with --meta KEY[=VALUE].
+
+Here are the supported commands:
+
+  @G{meta get} [--json] PATH
+
+    Print the metadata of a secret.
+
+  @G{meta set} [OPTIONS] PATH [tag=value ...]
+
+    Set custom tags, and (optionally) the other metadata of a secret.
+
+  @G{meta unset} PATH tag [tag ...]
+
+    Remove custom tags from a secret.
+`,
+	}, func(command string, args ...string) error {
+		r.Help(os.Stdout, "meta")
+		return nil
+	})
+
+	r.Dispatch("meta get", &Help{
+		Summary: "Print the metadata of a secret",
+		Usage:   "safe meta get [--json] PATH",
+		Type:    NonDestructiveCommand,
+		Description: `
+Prints the metadata that a KV v2 backend keeps for the secret at PATH,
+including its custom metadata tags.  Specifying --json will print it as a
+JSON object instead.
+`,
+	}, func(command string, args ...string) error {
+		rc.Apply(opt.UseTarget)
+		if len(args) != 1 {
+			r.ExitWithUsage("meta get")
+		}
+
+		v := connect(true)
+		m, err := v.Metadata(args[0])
+		if err != nil {
+			return err
+		}
+
+		if opt.Meta.Get.JSON {
+			return printStructured(metaOutput{
+				Path:               args[0],
+				MaxVersions:        m.MaxVersions,
+				CASRequired:        m.CASRequired,
+				DeleteVersionAfter: m.DeleteVersionAfter,
+				CustomMetadata:     m.CustomMetadata,
+			}, false)
+		}
+		printMetadata(args[0], m)
+		return nil
+	})
+
+	r.Dispatch("meta set", &Help{
+		Summary: "Set the metadata of a secret",
+		Usage:   "safe meta set [OPTIONS] PATH [tag=value ...]",
+		Type:    DestructiveCommand,
+		Description: `
+Sets custom metadata tags on the secret at PATH, which must already exist in
+a KV v2 backend.  Tags that aren't given are left alone.
+
+The following options are recognized:
+
+  --max-versions N       How many versions of the secret to keep.  0 uses
+                         the backend's setting.
+
+  --cas-required BOOL    Whether writes to the secret must use check-and-set,
+                         'true' or 'false'.
+
+  --delete-version-after DURATION
+                         How long until versions of the secret are deleted,
+                         i.e. 768h or 30d.  0 keeps them forever.
+`,
+	}, func(command string, args ...string) error {
+		rc.Apply(opt.UseTarget)
+		if len(args) < 1 {
+			r.ExitWithUsage("meta set")
+		}
+		path, args := args[0], args[1:]
+		o := opt.Meta.Set
+		if len(args) == 0 && o.MaxVersions == "" && o.CASRequired == "" && o.DeleteVersionAfter == "" {
+			return fmt.Errorf("Nothing to set for %s", path)
+		}
+
+		tags := make(map[string]string)
+		for _, arg := range args {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return fmt.Errorf("invalid tag '%s' (should look like tag=value)", arg)
+			}
+			if err := checkMetaTag(parts[0], parts[1]); err != nil {
+				return err
+			}
+			tags[parts[0]] = parts[1]
+		}
+
+		v := connect(true)
+		m, err := v.Metadata(path)
+		if err != nil {
+			return err
+		}
+
+		for tag, value := range tags {
+			m.CustomMetadata[tag] = value
+		}
+		if o.MaxVersions != "" {
+			n, err := strconv.ParseUint(o.MaxVersions, 10, 0)
+			if err != nil {
+				return fmt.Errorf("invalid --max-versions '%s' (should be a number)", o.MaxVersions)
+			}
+			m.MaxVersions = uint(n)
+		}
+		if o.CASRequired != "" {
+			m.CASRequired, err = strconv.ParseBool(o.CASRequired)
+			if err != nil {
+				return fmt.Errorf("invalid --cas-required '%s' (should be true or false)", o.CASRequired)
+			}
+		}
+		if o.DeleteVersionAfter != "" {
+			m.DeleteVersionAfter, err = metaDeleteAfter(o.DeleteVersionAfter)
+			if err != nil {
+				return err
+			}
+		}
+
+		return v.SetMetadata(path, *m)
+	})
+
+	r.Dispatch("meta unset", &Help{
+		Summary: "Remove custom metadata tags from a secret",
+		Usage:   "safe meta unset PATH tag [tag ...]",
+		Type:    DestructiveCommand,
+		Description: `
+Removes the given custom metadata tags from the secret at PATH.  Tags that
+it doesn't have are ignored.
+`,
+	}, func(command string, args ...string) error {
+		rc.Apply(opt.UseTarget)
+		if len(args) < 2 {
+			r.ExitWithUsage("meta unset")
+		}
+
+		v := connect(true)
+		m, err := v.Metadata(args[0])
+		if err != nil {
+			return err
+		}
+		for _, tag := range args[1:] {
+			delete(m.CustomMetadata, tag)
+		}
+		return v.SetMetadata(args[0], *m)
+	})
+
 	r.Dispatch("ls", &Help{
 		Summary: "Print the keys and sub-directories at one or more paths",
-		Usage:   "safe ls [-1|-q] [PATH ...]",
+		Usage:   "safe ls [-1|-q] [--json|--yaml] [--meta KEY[=VALUE] ...] [--show-meta] [PATH ...]",
 		Type:    NonDestructiveCommand,
 		Description: `
 	Specifying the -1 flag will print one result per line.
 	Specifying the -q flag will show secrets which have been marked as deleted.
+	Specifying --json or --yaml will print the listing of each path in that format.
+	Specifying --meta KEY or --meta KEY=VALUE will only list the secrets that
+	  have that custom metadata tag (see 'safe meta'), or that value for it.
+	  It can be given more than once; secrets must match all of them.
+	Specifying --show-meta will print the custom metadata tags of each secret.
 `,
 	}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
+		filters, err := parseMetaFilters(opt.List.Meta)
+		if err != nil {
+			return err
+		}
+		withMeta := len(filters) > 0 || opt.List.ShowMeta
+
 		v := connect(true)
-		display := func(paths []string) {
-			if opt.List.Single {
+		display := func(paths []string, metas map[string]*vault.SecretMetadata) {
+			if opt.List.ShowMeta {
+				for _, s := range paths {
+					if strings.HasSuffix(s, "/") {
+						fmt.Printf("@B{%s}\n", s)
+						continue
+					}
+					fmt.Printf("@G{%s}", s)
+					if m := metas[s]; m != nil {
+						for _, tag := range m.Tags() {
+							fmt.Printf("  @M{%s}=%s", tag, m.CustomMetadata[tag])
+						}
+					}
+					fmt.Printf("\n")
+				}
+			} else if opt.List.Single {
 				for _, s := range paths {
 					if strings.HasSuffix(s, "/") {
 						fmt.Printf("@B{%s}\n", s)
@@ -2034,8 +2830,13 @@ paths/keys.
 
 		if len(args) == 0 {
 			args = []string{"/"}
+			if pwd := v.Pwd(); pwd != "" {
+				args = []string{pwd}
+			}
 		}
 
+		structured := opt.List.JSON || opt.List.Yaml
+		var all []lsOutput
 		for _, path := range args {
 			var paths []string
 			if path == "" || path == "/" {
@@ -2086,20 +2887,52 @@ paths/keys.
 
 			sort.Strings(filteredPaths)
 
+			metas := map[string]*vault.SecretMetadata{}
+			if withMeta {
+				//Filters only apply to secrets, so they hide all directories
+				kept := []string{}
+				for _, name := range filteredPaths {
+					if strings.HasSuffix(name, "/") {
+						if len(filters) == 0 {
+							kept = append(kept, name)
+						}
+						continue
+					}
+					m, err := secretMetadata(v, path+"/"+vault.EscapePathSegment(name))
+					if err != nil && !vault.IsNotFound(err) {
+						return err
+					}
+					if matchesMeta(m, filters) {
+						metas[name] = m
+						kept = append(kept, name)
+					}
+				}
+				filteredPaths = kept
+			}
+
+			if structured {
+				all = append(all, newLsOutput(path, filteredPaths, metas))
+				continue
+			}
+
 			if len(args) != 1 {
 				fmt.Printf("@C{%s}:\n", path)
 			}
-			display(filteredPaths)
+			display(filteredPaths, metas)
 			if len(args) != 1 {
 				fmt.Printf("\n")
 			}
 		}
+
+		if structured {
+			return printStructured(all, opt.List.Yaml)
+		}
 		return nil
 	})
 
 	r.Dispatch("tree", &Help{
 		Summary: "Print a tree listing of one or more paths",
-		Usage:   "safe tree [-d|-q|--keys] [PATH ...]",
+		Usage:   "safe tree [-d|-q|--keys] [--json|--yaml] [--meta KEY[=VALUE] ...] [--show-meta] [PATH ...]",
 		Type:    NonDestructiveCommand,
 		Description: `
 Walks the hierarchy of secrets stored underneath a given path, listing all
@@ -2110,27 +2943,59 @@ will not inspect each key in a v1 v2 mount backend to see if it has been marked
 as deleted. This may cause keys which would 404 in an attempt to read them to
 appear in the tree, but is often considerably quicker for larger vaults. This
 flag does nothing for kv v1 mounts.
+
+If '--json' or '--yaml' is given, the tree is printed as nested objects in
+that format instead, along with the latest version and mount KV version of
+each secret.
+
+If '--meta KEY' or '--meta KEY=VALUE' is given, only the secrets with that
+custom metadata tag (see 'safe meta'), or that value for it, are shown, along
+with the folders that lead to them.  It can be given more than once; secrets
+must match all of them.  If '--show-meta' is given, the custom metadata tags
+of each secret are printed alongside it.
 `,
 	}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
 		if opt.Tree.HideLeaves && opt.Tree.ShowKeys {
 			return fmt.Errorf("Cannot specify both -d and --keys at the same time")
 		}
+		filters, err := parseMetaFilters(opt.Tree.Meta)
+		if err != nil {
+			return err
+		}
+		v := connect(true)
 		if len(args) == 0 {
 			args = append(args, "secret")
+			if pwd := v.Pwd(); pwd != "" {
+				args = []string{pwd}
+			}
 		}
 		r1, _ := regexp.Compile("^ ")
 		r2, _ := regexp.Compile("^└")
-		v := connect(true)
+		structured := opt.Tree.JSON || opt.Tree.Yaml
+		var all []*treeOutput
 		for i, path := range args {
 			secrets, err := v.ConstructSecrets(path, vault.TreeOpts{
 				FetchKeys:           opt.Tree.ShowKeys,
 				AllowDeletedSecrets: opt.Tree.Quick,
+				FetchMetadata:       len(filters) > 0 || opt.Tree.ShowMeta,
 			})
 
 			if err != nil {
 				return err
 			}
+			if len(filters) > 0 {
+				secrets = filterSecretsByMeta(secrets, filters)
+			}
+			if !opt.Tree.ShowMeta {
+				for i := range secrets {
+					secrets[i].Metadata = nil
+				}
+			}
+			if structured {
+				all = append(all, newTreeOutput(path, secrets, !opt.Tree.HideLeaves, opt.Tree.ShowKeys))
+				continue
+			}
 			lines := strings.Split(secrets.Draw(path, fmt.CanColorize(os.Stdout), !opt.Tree.HideLeaves), "\n")
 			if i > 0 {
 				lines = lines[1:] // Drop root '.' from subsequent paths
@@ -2145,12 +3010,16 @@ flag does nothing for kv v1 mounts.
 				fmt.Printf("%s\n", line)
 			}
 		}
+
+		if structured {
+			return printStructured(all, opt.Tree.Yaml)
+		}
 		return nil
 	})
 
 	r.Dispatch("paths", &Help{
 		Summary: "Print all of the known paths, one per line",
-		Usage:   "safe paths [-q|--keys] PATH [PATH ...]",
+		Usage:   "safe paths [-q|--keys] [--json|--yaml] PATH [PATH ...]",
 		Type:    NonDestructiveCommand,
 		Description: `
 Walks the hierarchy of secrets stored underneath a given path, listing all
@@ -2159,25 +3028,137 @@ safe will not inspect each key in a v1 v2 mount backend to see if it has been
 marked as deleted. This may cause keys which would 404 in an attempt to read
 them to appear in the tree, but is often considerably quicker for larger
 vaults. This flag does nothing for kv v1 mounts.
+
+If '--json' or '--yaml' is given, each secret is printed as an object in that
+format instead, along with its latest version (unless '-q' was given) and the
+KV version of its mount.
 `}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
 		if len(args) < 1 {
 			args = append(args, "secret")
 		}
 		v := connect(true)
+		structured := opt.Paths.JSON || opt.Paths.Yaml
+		all := []secretOutput{}
 		for _, path := range args {
 			secrets, err := v.ConstructSecrets(path, vault.TreeOpts{
 				FetchKeys:           opt.Paths.ShowKeys,
 				AllowDeletedSecrets: opt.Paths.Quick,
-				SkipVersionInfo:     !opt.Paths.ShowKeys,
+				//Version info comes for free unless -q was given
+				SkipVersionInfo: !opt.Paths.ShowKeys && (!structured || opt.Paths.Quick),
 			})
 			if err != nil {
 				return err
 			}
 
+			if structured {
+				for _, s := range secrets {
+					all = append(all, newSecretOutput(s, opt.Paths.ShowKeys))
+				}
+				continue
+			}
+
 			fmt.Printf(strings.Join(secrets.Paths(), "\n"))
 			fmt.Printf("\n")
 		}
+
+		if structured {
+			return printStructured(all, opt.Paths.Yaml)
+		}
+		return nil
+	})
+
+	r.Dispatch("find", &Help{
+		Summary: "Find secrets and keys by name",
+		Usage:   "safe find [-e] [-i] PATTERN [PATH ...]",
+		Type:    NonDestructiveCommand,
+		Description: `
+Walks the secrets stored underneath each PATH (or 'secret', if none are
+given), and prints the path:key of every key whose name, secret name, full
+path or path:key matches PATTERN.
+
+PATTERN is a shell-style glob, where '*' and '?' can also match slashes:
+
+  safe find '*password*' secret/
+  safe find 'secret/*/db:*' secret/
+
+The following options are recognized:
+
+  -e, --regex         Treat PATTERN as a regular expression instead,
+                      which can match anywhere.
+
+  -i, --ignore-case   Match without regard to case.
+`,
+	}, func(command string, args ...string) error {
+		if len(args) < 1 {
+			r.ExitWithUsage("find")
+		}
+		re, err := searchRegexp(args[0], !opt.Find.Regex, opt.Find.IgnoreCase)
+		if err != nil {
+			return err
+		}
+		paths := args[1:]
+		if len(paths) == 0 {
+			paths = append(paths, "secret")
+		}
+
+		rc.Apply(opt.UseTarget)
+		hits, err := searchSecrets(connect(true), paths, findMatcher(re))
+		if err != nil {
+			return err
+		}
+		for _, hit := range hits {
+			fmt.Printf("%s:%s\n", hit.Path, hit.Key)
+		}
+		return nil
+	})
+
+	r.Dispatch("grep", &Help{
+		Summary: "Find secrets by their values",
+		Usage:   "safe grep [--values] [-i] REGEX [PATH ...]",
+		Type:    NonDestructiveCommand,
+		Description: `
+Walks the secrets stored underneath each PATH (or 'secret', if none are
+given), and prints the path:key of every value that REGEX matches.  As with
+grep(1), multi-line values (like certificates) are matched line by line.
+
+The values themselves are not shown, unless --values is given.
+
+The following options are recognized:
+
+  --values            Also print the lines of each value that matched.
+
+  -i, --ignore-case   Match without regard to case.
+`,
+	}, func(command string, args ...string) error {
+		if len(args) < 1 {
+			r.ExitWithUsage("grep")
+		}
+		re, err := searchRegexp(args[0], false, opt.Grep.IgnoreCase)
+		if err != nil {
+			return err
+		}
+		paths := args[1:]
+		if len(paths) == 0 {
+			paths = append(paths, "secret")
+		}
+
+		rc.Apply(opt.UseTarget)
+		hits, err := searchSecrets(connect(true), paths, func(path, key, value string) bool {
+			return len(matchingLines(re, value)) > 0
+		})
+		if err != nil {
+			return err
+		}
+		for _, hit := range hits {
+			if !opt.Grep.Values {
+				fmt.Printf("%s:%s\n", hit.Path, hit.Key)
+				continue
+			}
+			for _, line := range matchingLines(re, hit.Value) {
+				fmt.Printf("@C{%s:%s}: %s\n", hit.Path, hit.Key, line)
+			}
+		}
 		return nil
 	})
 
@@ -2378,7 +3359,7 @@ redeleting them.
 
 	r.Dispatch("export", &Help{
 		Summary: "Export one or more subtrees for migration / backup purposes",
-		Usage:   "safe export [-ad] PATH [PATH ...]",
+		Usage:   "safe export [-ad] [-r RECIPIENT ...] [--sign-with KEY] PATH [PATH ...]",
 		Type:    NonDestructiveCommand,
 		Description: `
 Normally, the export will get only the latest version of each secret, and encode it in a format that is backwards-
@@ -2387,11 +3368,34 @@ compatible with pre-1.0.0 versions of safe (and newer versions).
 incompatible with versions of safe prior to v1.0.0
 -d (--deleted) will cause safe to undelete, read, and then redelete deleted secrets in order to encode them in the
 backup. Without this, deleted versions will be ignored.
+
+-r (--recipient) encrypts the export to a recipient, so that it never touches disk in cleartext. Recipients are
+either X25519 public keys (age1..., as made by age-keygen), given literally or as a file with one per line, or
+OpenPGP public keys (RSA or NIST P-curve), given as a file made by 'gpg --armor --export'.  Specify -r more than
+once to encrypt to several recipients.
+--sign-with signs an encrypted export with an ed25519 SSH private key (ssh-keygen -t ed25519), so that
+'safe import --verify-with' can check where the export came from.
 `}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
 		if len(args) < 1 {
 			args = append(args, "secret")
 		}
+
+		if opt.Export.SignWith != "" && len(opt.Export.Recipients) == 0 {
+			return fmt.Errorf("--sign-with requires at least one --recipient")
+		}
+		recipients, err := bundle.LoadRecipients(opt.Export.Recipients)
+		if err != nil {
+			return err
+		}
+		var signer ed25519.PrivateKey
+		if opt.Export.SignWith != "" {
+			signer, err = bundle.LoadSigningKey(opt.Export.SignWith)
+			if err != nil {
+				return err
+			}
+		}
+
 		v := connect(true)
 
 		var toExport interface{}
@@ -2496,7 +3500,6 @@ backup. Without this, deleted versions will be ignored.
 			return nil
 		}
 
-		var err error
 		if mustV2Export {
 			err = v2Export()
 		} else {
@@ -2510,6 +3513,12 @@ backup. Without this, deleted versions will be ignored.
 		if err != nil {
 			return err
 		}
+		if len(recipients) > 0 {
+			b, err = bundle.Seal(b, recipients, signer)
+			if err != nil {
+				return err
+			}
+		}
 		fmt.Printf("%s\n", string(b))
 
 		return nil
@@ -2517,21 +3526,65 @@ backup. Without this, deleted versions will be ignored.
 
 	r.Dispatch("import", &Help{
 		Summary: "Import name/value pairs into the current Vault",
-		Usage:   "safe import <backup/file.json",
+		Usage:   "safe import [--identity FILE ...] [--verify-with PUBKEY | --insecure-unverified] <backup/file.json",
 		Type:    DestructiveCommand,
 		Description: `
 -I (--ignore-destroyed) will keep destroyed versions from being replicated in the import by
 rting garbage data and then destroying it (which is originally done to preserve version numbering).
 -i (--ignore-deleted) will ignore deleted versions from being written during the import.
 -s (--shallow) will write only the latest version for each secret.
+
+--identity names a file of X25519 identities (AGE-SECRET-KEY-1...), or an OpenPGP secret key made by
+'gpg --armor --export-secret-keys', used to decrypt an encrypted export.  It can be given more than once.
+OpenPGP secret keys that are protected by a passphrase are unlocked with $SAFE_PGP_PASSPHRASE.
+--verify-with requires the export to be signed by the given ed25519 SSH public key (either the key
+itself, or a path to an id_ed25519.pub-style file).  Encrypted exports that are not signed, or
+whose signing key isn't pinned with --verify-with, are refused: anyone who knows a recipient can
+make one.  --insecure-unverified imports them anyway, with a warning naming the signing key.
 `}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
 		b, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
 			return err
 		}
-		if err != nil {
-			return err
+
+		if bundle.IsBundle(b) {
+			if len(opt.Import.Identities) == 0 {
+				return fmt.Errorf("Export is encrypted; specify an --identity to decrypt it with")
+			}
+			identities, err := bundle.LoadIdentities(opt.Import.Identities)
+			if err != nil {
+				return err
+			}
+			var verify ed25519.PublicKey
+			if opt.Import.VerifyWith != "" {
+				verify, err = bundle.LoadVerifyKey(opt.Import.VerifyWith)
+				if err != nil {
+					return err
+				}
+			} else {
+				signer, err := bundle.SignedBy(b)
+				if err != nil {
+					return err
+				}
+				switch {
+				case signer == "" && !opt.Import.InsecureUnverified:
+					return fmt.Errorf("Export is not signed; refusing to import unverified data without --insecure-unverified")
+				case !opt.Import.InsecureUnverified:
+					return fmt.Errorf("Export is signed by %s, but no --verify-with key was given to check it against; refusing to import unverified data without --insecure-unverified", signer)
+				case signer == "":
+					fmt.Fprintf(os.Stderr, "@Y{WARNING:} importing an @R{unsigned} export; nobody vouches for what is in it\n")
+				default:
+					fmt.Fprintf(os.Stderr, "@Y{WARNING:} importing an export signed by @C{%s}, without checking that it is a key you trust\n", signer)
+				}
+			}
+			b, err = bundle.Open(b, identities, verify)
+			if err != nil {
+				return err
+			}
+
+		} else if opt.Import.VerifyWith != "" {
+			return fmt.Errorf("Export is not a signed bundle; refusing to import unverified data")
 		}
 
 		if opt.SkipIfExists {
@@ -2550,6 +3603,7 @@ rting garbage data and then destroying it (which is originally done to preserve
 				return err
 			}
 			for path, s := range data {
+				auditTouched("", path)
 				err = v.Write(path, s)
 				if err != nil {
 					return err
@@ -2595,6 +3649,7 @@ rting garbage data and then destroying it (which is originally done to preserve
 			//Put the secrets in the places, writing the versions in the correct order and deleting/destroying secrets that
 			// need to be deleted/destroyed.
 			for path, secret := range data.Data {
+				auditTouched("", path)
 				s := vault.SecretEntry{
 					Path: path,
 				}
@@ -2668,6 +3723,87 @@ rting garbage data and then destroying it (which is originally done to preserve
 		return fn(b)
 	})
 
+	r.Dispatch("diff", &Help{
+		Summary: "Show the differences between two subtrees",
+		Usage:   "safe diff [--reveal] [TARGET:]PATH|@FILE [TARGET:]PATH|@FILE",
+		Type:    NonDestructiveCommand,
+		Description: `
+Compares the latest version of every secret under the first path against the
+secret at the same relative path under the second, and lists the paths and
+keys that were added (+), removed (-) or changed (~).
+
+Either side can be prefixed with a target alias (as in prod:secret/app) to
+compare across Vaults; otherwise, the current target (or -T) is used.  A side
+of the form @FILE (or @- for standard input) reads an export file made by
+'safe export', in either format.  When comparing an export against a path,
+only the part of the export under that path is considered.
+
+Values are never shown unless --reveal is given.
+
+--identity names a file of X25519 identities (AGE-SECRET-KEY-1...), or an
+OpenPGP secret key, for comparing against an encrypted export.
+`}, func(command string, args ...string) error {
+		if len(args) != 2 {
+			r.ExitWithUsage("diff")
+		}
+
+		cfg := rc.Apply(opt.UseTarget)
+		type side struct {
+			target string
+			path   string
+			file   string
+		}
+		sides := make([]side, 2)
+		for i, arg := range args {
+			if strings.HasPrefix(arg, "@") {
+				sides[i].file = strings.TrimPrefix(arg, "@")
+				if sides[i].file == "" {
+					return fmt.Errorf("No file specified: expecting @<filename>")
+				}
+				continue
+			}
+
+			sides[i].target, sides[i].path = splitTargetPath(cfg, arg)
+			if sides[i].target == "" {
+				sides[i].target = opt.UseTarget
+			}
+			if vault.PathHasKey(sides[i].path) || vault.PathHasVersion(sides[i].path) {
+				return fmt.Errorf("Cannot diff a path with a key or version (%s)", arg)
+			}
+			sides[i].path = vault.Canonicalize(sides[i].path)
+		}
+
+		//Exports are compared from the same root as the other side, so that
+		// `safe diff @backup.json secret/prod` does what you'd expect
+		if sides[0].file != "" {
+			sides[0].path = sides[1].path
+		}
+		if sides[1].file != "" {
+			sides[1].path = sides[0].path
+		}
+
+		secrets := make([]vault.Secrets, 2)
+		for i, s := range sides {
+			var err error
+			if s.file != "" {
+				secrets[i], err = readExportFile(s.file, opt.Diff.Identities)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			v := connectTo(s.target)
+			secrets[i], err = v.ConstructSecrets(s.path, vault.TreeOpts{FetchKeys: true})
+			if err != nil && !vault.IsNotFound(err) {
+				return err
+			}
+		}
+
+		printDiff(vault.Diff(secrets[0], sides[0].path, secrets[1], sides[1].path), opt.Diff.Reveal)
+		return nil
+	})
+
 	r.Dispatch("move", &Help{
 		Summary: "Move a secret from one path to another",
 		Usage:   "safe move [-rfd] OLD-PATH NEW-PATH",
@@ -2781,18 +3917,116 @@ and overwrite all versions of the secret at the destination.
 		return nil
 	})
 
+	r.Dispatch("sync", &Help{
+		Summary: "Replicate a subtree from one target to another",
+		Usage:   "safe sync [-nd] [--delete] [SRC-TARGET:]PATH [DST-TARGET:]PATH",
+		Type:    DestructiveCommand,
+		Description: `
+Copies every secret under the source path into the destination path, which
+can live on a different target (as named in ~/.saferc).  For example, to
+promote secrets from staging into production:
+
+  safe sync staging:secret/app prod:secret/app
+
+Paths without a target prefix use the current target (or -T).  Secrets that
+are already identical on both sides are left alone.
+
+The following options are recognized:
+
+  -n, --dry-run   Show what would be created, updated and pruned, without
+                  writing anything to the destination.
+
+  --delete        Also delete secrets under the destination path that do
+                  not exist under the source path.  All of their versions
+                  are deleted (but not destroyed).
+
+  -d, --deep      Replicate the full KV v2 version history of each secret,
+                  rather than just the latest version.  Any existing
+                  history at the destination is replaced.  The destination
+                  mount must support versioning.  Deleted versions on the
+                  source are replicated as destroyed versions, since their
+                  contents can't be read without undeleting them.
+
+With --no-clobber, secrets that already exist at the destination are never
+overwritten.
+`,
+	}, func(command string, args ...string) error {
+		if len(args) != 2 {
+			r.ExitWithUsage("sync")
+		}
+
+		cfg := rc.Apply(opt.UseTarget)
+		srcTarget, srcPath := splitTargetPath(cfg, args[0])
+		dstTarget, dstPath := splitTargetPath(cfg, args[1])
+		if srcTarget == "" {
+			srcTarget = opt.UseTarget
+		}
+		if dstTarget == "" {
+			dstTarget = opt.UseTarget
+		}
+		for _, path := range []string{srcPath, dstPath} {
+			if vault.PathHasKey(path) || vault.PathHasVersion(path) {
+				return fmt.Errorf("Cannot sync a path with a key or version (%s)", path)
+			}
+		}
+
+		//The secrets that change are those on the destination target
+		auditTouched(dstTarget)
+		src := connectTo(srcTarget)
+		dst := connectTo(dstTarget)
+		return syncTree(src, srcPath, dst, dstPath, syncOpts{
+			DryRun:       opt.Sync.DryRun,
+			Delete:       opt.Sync.Delete,
+			Deep:         opt.Sync.Deep,
+			SkipIfExists: opt.SkipIfExists,
+			Quiet:        opt.Quiet,
+		})
+	})
+
 	r.Dispatch("gen", &Help{
 		Summary: "Generate a random password",
-		Usage:   "safe gen [-l <length>] [-p] PATH:KEY [PATH:KEY ...]",
+		Usage:   "safe gen [-l <length>] [-p] [-g <generator>] [--remember] PATH:KEY [PATH:KEY ...]",
 		Type:    DestructiveCommand,
 		Description: `
-LENGTH defaults to 64 characters.
+LENGTH defaults to 64 characters (or, for passphrases, 6 words).
 
 The following options are recognized:
 
-  -l, --length  Specify the length of the random string to generate
-	-p, --policy  Specify a regex character grouping for limiting characters used
-	              to generate the password (e.g --policy a-z0-9)
+  -l, --length       Specify the length of the random string to generate.
+                     For passphrases, this is the number of words.
+
+  -g, --generator    How to generate the password.  One of:
+
+                       random         Random characters, drawn from --policy.
+                                      This is the default.
+                       passphrase     Words drawn from the EFF's large
+                                      (diceware) wordlist, joined by
+                                      --separator.
+                       pronounceable  Alternating lowercase consonants
+                                      and vowels, for reading out loud.
+
+  -p, --policy       Specify a regex character grouping for limiting characters
+                     used to generate the password (e.g --policy a-z0-9).
+                     Defaults to a-zA-Z0-9.
+
+  --min-lower N      Random passwords will have at least N lowercase letters,
+  --min-upper N      N uppercase letters, N digits and / or N symbols.
+  --min-digits N
+  --min-symbols N
+
+  --unique           Never use the same character twice in a random password.
+
+  --unambiguous      Leave out characters that are easily mistaken for
+                     one another (0, O, 1, l, I and |).
+
+  --separator SEP    The string to put between the words of a passphrase.
+                     Defaults to '-'.
+
+  --remember         Record how the password was generated in the secret's
+                     rotate-generator:KEY metadata tag (KV v2 backends only),
+                     so that 'safe rotate' generates the next one the same
+                     way.  This needs permission to write metadata, and is
+                     not undone if the command fails part-way through.
 `,
 	}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
@@ -2801,13 +4035,29 @@ The following options are recognized:
 			r.ExitWithUsage("gen")
 		}
 
-		length := 64
+		length := opt.Gen.Length
+		if length == 0 {
+			if u, err := strconv.ParseUint(args[0], 10, 16); err == nil {
+				length = int(u)
+				args = args[1:]
+			}
+		}
 
-		if opt.Gen.Length != 0 {
-			length = opt.Gen.Length
-		} else if u, err := strconv.ParseUint(args[0], 10, 16); err == nil {
-			length = int(u)
-			args = args[1:]
+		genOpts := vault.PasswordOptions{
+			Generator:   opt.Gen.Generator,
+			Length:      length,
+			Policy:      opt.Gen.Policy,
+			MinLower:    opt.Gen.MinLower,
+			MinUpper:    opt.Gen.MinUpper,
+			MinDigits:   opt.Gen.MinDigits,
+			MinSymbols:  opt.Gen.MinSymbols,
+			Unique:      opt.Gen.Unique,
+			Unambiguous: opt.Gen.Unambiguous,
+			Separator:   opt.Gen.Separator,
+		}
+		gen, err := vault.NewPasswordGenerator(genOpts)
+		if err != nil {
+			return err
 		}
 
 		v := connect(true)
@@ -2829,24 +4079,25 @@ The following options are recognized:
 				}
 				args = args[2:]
 			}
-			s, err := v.Read(path)
-			if err != nil && !vault.IsNotFound(err) {
-				return err
-			}
-			exists := (err == nil)
-			if opt.SkipIfExists && exists && s.Has(key) {
-				if !opt.Quiet {
-					fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to update} @C{%s:%s} @R{as it is already present in Vault}\n", path, key)
+			generated := false
+			err := updateSecret(v, path, func(s *vault.Secret, exists bool) error {
+				if opt.SkipIfExists && exists && s.Has(key) {
+					if !opt.Quiet {
+						fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to update} @C{%s:%s} @R{as it is already present in Vault}\n", path, key)
+					}
+					return errUnchanged
 				}
-				continue
-			}
-			err = s.Password(key, length, opt.Gen.Policy, opt.SkipIfExists)
+				generated = true
+				return s.Password(key, gen, opt.SkipIfExists)
+			})
 			if err != nil {
 				return err
 			}
-
-			if err = v.Write(path, s); err != nil {
-				return err
+			//So that 'safe rotate' can generate another one just like it
+			if generated && opt.Gen.Remember {
+				if err := rememberGenerator(v, path, key, genOpts); err != nil {
+					return fmt.Errorf("Unable to record how %s:%s was generated in its metadata: %s", path, key, err)
+				}
 			}
 		}
 		return nil
@@ -2915,7 +4166,13 @@ Currently available options are:
 
 @G{manage_vault_token}    If set to true, then when logging in or switching targets,
                       the '.vault-token' file in your $HOME directory that the Vault CLI uses will be 
-                      updated.
+                      updated.  Targets with a token store (see 'safe help target') are
+                      left out, so that their tokens are never written in plain text.
+
+@G{require_cas}           If set to true, every write is made with check-and-set, even writes of
+                      secrets that weren't read first, so that nothing written by anyone else
+                      is ever overwritten blindly.  Writes to KV v1 backends, which can't
+                      check-and-set, are refused.  $SAFE_REQUIRE_CAS overrides this.
 `,
 	}, func(command string, args ...string) error {
 		cfg := rc.Apply(opt.UseTarget)
@@ -2925,6 +4182,7 @@ Currently available options are:
 			val *bool
 		}{
 			{"manage_vault_token", &cfg.Options.ManageVaultToken},
+			{"require_cas", &cfg.Options.RequireCAS},
 		}
 
 		if len(args) == 0 {
@@ -2983,18 +4241,23 @@ Currently available options are:
 	})
 
 	r.Dispatch("ssh", &Help{
-		Summary: "Generate one or more new SSH RSA keypair(s)",
-		Usage:   "safe ssh [NBITS] PATH [PATH ...]",
+		Summary: "Generate one or more new SSH keypair(s)",
+		Usage:   "safe ssh [-t rsa|ecdsa|ed25519] [NBITS] PATH [PATH ...]",
 		Type:    DestructiveCommand,
 		Description: `
-For each PATH given, a new SSH RSA public/private keypair will be generated,
-with a key strength of NBITS (which defaults to 2048).  The private keys will
-be stored under the 'private' name, as a PEM-encoded RSA private key, and the
-public key, formatted for use in an SSH authorized_keys file, under 'public'.
+For each PATH given, a new SSH public/private keypair will be generated, with a
+key strength of NBITS.  The private keys will be stored under the 'private'
+name, PEM-encoded, and the public key, formatted for use in an SSH
+authorized_keys file, under 'public'.
+
+The -t (--key-type) option picks the type of key: 'rsa' (the default), 'ecdsa'
+or 'ed25519'.  For RSA keys, NBITS defaults to 2048.  For ECDSA keys, NBITS is
+the size of the curve; one of 256 (the default), 384 or 521.  Ed25519 keys are
+always 256 bits, and are stored in the OpenSSH private key format.
 `,
 	}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
-		bits := 2048
+		bits := 0
 		if len(args) > 0 {
 			if u, err := strconv.ParseUint(args[0], 10, 16); err == nil {
 				bits = int(u)
@@ -3008,21 +4271,16 @@ public key, formatted for use in an SSH authorized_keys file, under 'public'.
 
 		v := connect(true)
 		for _, path := range args {
-			s, err := v.Read(path)
-			if err != nil && !vault.IsNotFound(err) {
-				return err
-			}
-			exists := (err == nil)
-			if opt.SkipIfExists && exists && (s.Has("private") || s.Has("public") || s.Has("fingerprint")) {
-				if !opt.Quiet {
-					fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to generate an SSH key at} @C{%s} @R{as it is already present in Vault}\n", path)
+			err := updateSecret(v, path, func(s *vault.Secret, exists bool) error {
+				if opt.SkipIfExists && exists && (s.Has("private") || s.Has("public") || s.Has("fingerprint")) {
+					if !opt.Quiet {
+						fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to generate an SSH key at} @C{%s} @R{as it is already present in Vault}\n", path)
+					}
+					return errUnchanged
 				}
-				continue
-			}
-			if err = s.SSHKey(bits, opt.SkipIfExists); err != nil {
-				return err
-			}
-			if err = v.Write(path, s); err != nil {
+				return s.SSHKey(opt.SSH.KeyType, bits, opt.SkipIfExists)
+			})
+			if err != nil {
 				return err
 			}
 		}
@@ -3031,17 +4289,21 @@ public key, formatted for use in an SSH authorized_keys file, under 'public'.
 
 	r.Dispatch("rsa", &Help{
 		Summary: "Generate a new RSA keypair",
-		Usage:   "safe rsa [NBITS] PATH [PATH ...]",
+		Usage:   "safe rsa [-t rsa|ecdsa|ed25519] [NBITS] PATH [PATH ...]",
 		Type:    DestructiveCommand,
 		Description: `
 For each PATH given, a new RSA public/private keypair will be generated with a,
 key strength of NBITS (which defaults to 2048).  The private keys will be stored
 under the 'private' name, and the public key under the 'public' name.  Both will
 be PEM-encoded.
+
+To generate some other type of keypair instead, use -t (--key-type) 'ecdsa' or
+'ed25519'.  For ECDSA keys, NBITS is the size of the curve; one of 256 (the
+default), 384 or 521.  Ed25519 keys are always 256 bits.
 `,
 	}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
-		bits := 2048
+		bits := 0
 		if len(args) > 0 {
 			if u, err := strconv.ParseUint(args[0], 10, 16); err == nil {
 				bits = int(u)
@@ -3055,21 +4317,16 @@ be PEM-encoded.
 
 		v := connect(true)
 		for _, path := range args {
-			s, err := v.Read(path)
-			if err != nil && !vault.IsNotFound(err) {
-				return err
-			}
-			exists := (err == nil)
-			if opt.SkipIfExists && exists && (s.Has("private") || s.Has("public")) {
-				if !opt.Quiet {
-					fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to generate an RSA key at} @C{%s} @R{as it is already present in Vault}\n", path)
+			err := updateSecret(v, path, func(s *vault.Secret, exists bool) error {
+				if opt.SkipIfExists && exists && (s.Has("private") || s.Has("public")) {
+					if !opt.Quiet {
+						fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to generate an RSA key at} @C{%s} @R{as it is already present in Vault}\n", path)
+					}
+					return errUnchanged
 				}
-				continue
-			}
-			if err = s.RSAKey(bits, opt.SkipIfExists); err != nil {
-				return err
-			}
-			if err = v.Write(path, s); err != nil {
+				return s.RSAKey(opt.RSA.KeyType, bits, opt.SkipIfExists)
+			})
+			if err != nil {
 				return err
 			}
 		}
@@ -3117,6 +4374,237 @@ NBITS defaults to 2048.
 		return v.Write(path, s)
 	})
 
+	r.Dispatch("plan", &Help{
+		Summary: "Show what 'safe apply' would do with a secrets manifest",
+		Usage:   "safe plan MANIFEST",
+		Type:    NonDestructiveCommand,
+		Description: `
+Reads a secrets manifest (see 'safe help apply'), compares it against the
+Vault, and lists each secret that would be created or rotated.  Nothing is
+written to the Vault.
+
+With --no-clobber, secrets that already exist are never rotated; they are
+listed as 'keep' instead.
+`,
+	}, func(command string, args ...string) error {
+		if len(args) != 1 {
+			r.ExitWithUsage("plan")
+		}
+		m, err := readManifest(args[0])
+		if err != nil {
+			return err
+		}
+
+		rc.Apply(opt.UseTarget)
+		v := connect(true)
+		steps, err := m.plan(v, opt.SkipIfExists)
+		if err != nil {
+			return err
+		}
+		if changes := printPlan(steps); changes == 0 {
+			fmt.Fprintf(os.Stderr, "@G{Nothing to do; the Vault matches the manifest.}\n")
+		} else {
+			fmt.Fprintf(os.Stderr, "\n@Y{%d} change(s) would be made by @C{safe apply %s}\n", changes, args[0])
+		}
+		return nil
+	})
+
+	r.Dispatch("apply", &Help{
+		Summary: "Converge the Vault with a secrets manifest",
+		Usage:   "safe apply MANIFEST",
+		Type:    DestructiveCommand,
+		Description: `
+Creates (or rotates) every secret declared in MANIFEST, a YAML file that
+looks like this:
+
+  secrets:
+    - path: secret/app/db:password
+      type: password
+      length: 32              # default 64
+      policy: a-z0-9          # default a-zA-Z0-9
+      min_digits: 2           # also min_lower, min_upper and min_symbols
+      unique: true            # no character more than once
+      unambiguous: true       # leave out 0, O, 1, l, I and |
+
+    - path: secret/app/admin:passphrase
+      type: password
+      generator: passphrase   # or random (the default), or pronounceable
+      length: 8               # in words; default 6
+      separator: " "          # default -
+
+    - path: secret/app/db:id
+      type: uuid
+
+    - path: secret/app/ssh
+      type: ssh               # or rsa, or dhparam
+      bits: 4096              # default 2048 (256 for ecdsa)
+      key_type: rsa           # or ecdsa, or ed25519 (not for dhparam)
+
+    - path: secret/app/ca
+      type: x509
+      ca: true
+      subject: /cn=App CA     # default CN=<first name>
+      ttl: 10y                # default 10y for CAs, 2y otherwise
+
+    - path: secret/app/tls
+      type: x509
+      signed_by: secret/app/ca
+      names: [app.example.com, 10.0.0.1]
+      bits: 2048              # default 4096 (256 for ecdsa)
+      key_type: rsa           # or ecdsa, or ed25519
+      key_usage: [server_auth]
+      sig_algorithm: sha256-rsa
+      renew_within: 30d       # rotate when this close to expiry
+
+Secrets are created when missing, and rotated when they no longer match the
+manifest: passwords of the wrong length, character set or composition, keys of the wrong
+strength, and certificates that have the wrong subject, names or CA, have
+expired, or were not signed by their signed_by CA.  Everything else is left
+alone, so running apply twice in a row is harmless.
+
+Entries are processed in order; CAs must come before the certificates
+that they sign.  A certificate is always rotated when its CA is.
+
+With --no-clobber, existing secrets are never rotated; only missing ones
+are created.  Use 'safe plan' to see what apply would do.
+`,
+	}, func(command string, args ...string) error {
+		if len(args) != 1 {
+			r.ExitWithUsage("apply")
+		}
+		m, err := readManifest(args[0])
+		if err != nil {
+			return err
+		}
+
+		rc.Apply(opt.UseTarget)
+		v := connect(true)
+		steps, err := m.plan(v, opt.SkipIfExists)
+		if err != nil {
+			return err
+		}
+
+		changes := 0
+		for _, step := range steps {
+			switch step.Action {
+			case planCreate:
+				fmt.Printf("@C{creating} %s\n", step.Entry.Path)
+			case planRotate:
+				fmt.Printf("@Y{rotating} %s - %s\n", step.Entry.Path, step.Reason)
+			case planKeep:
+				if !opt.Quiet {
+					fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to rotate} @C{%s} @R{as it is already present in Vault}\n", step.Entry.Path)
+				}
+				continue
+			default:
+				continue
+			}
+
+			if err := step.apply(v); err != nil {
+				return fmt.Errorf("%s: %s", step.Entry.Path, err)
+			}
+			changes++
+		}
+
+		if changes == 0 {
+			fmt.Fprintf(os.Stderr, "@G{Nothing to do; the Vault matches the manifest.}\n")
+		}
+		return nil
+	})
+
+	r.Dispatch("rotate", &Help{
+		Summary: "Regenerate secrets that are past their age",
+		Usage:   "safe rotate [-n] [--older-than 90d] [--manifest FILE] [--json] PATH [PATH ...]",
+		Type:    DestructiveCommand,
+		Description: `
+Walks the hierarchy of secrets underneath each of the given paths, and
+regenerates those whose latest version was written longer ago than their
+rotation-interval metadata tag (see 'safe meta') or, for secrets without
+one, --older-than.  Only KV v2 backends record when secrets were written.
+
+What is regenerated, and how, is worked out from the secret itself:
+
+  X.509 certificates   are renewed by their CA (the sibling 'ca' secret, or
+                       themselves if self-signed), with the same lifetime.
+
+  SSH and RSA keys     are regenerated with the same key type and strength.
+
+  Passwords            named (comma-separated) in the secret's rotate-keys
+                       metadata tag are regenerated the same way that
+                       'safe gen' generated them, going by the
+                       rotate-generator:KEY tag of 'safe gen --remember'.
+                       Passwords without one keep their length and classes
+                       of characters, unless the rotate-policy tag gives a
+                       different policy.
+
+Secrets in the manifest given by --manifest (the same format as 'safe apply')
+are regenerated exactly as the manifest says, instead.  Anything else that is
+past its age is skipped, and shows up in the report.
+
+The following options are recognized:
+
+  -o, --older-than  How old secrets without a rotation-interval can be,
+                    i.e. 90d, 6m or 1y.
+
+  -f, --manifest    A manifest of how to regenerate particular secrets.
+
+  -n, --dry-run     Print what would be rotated, without changing anything.
+
+  --json            Print the report as JSON.
+
+The process will exit 1 (one) if any secret could not be rotated.
+`,
+	}, func(command string, args ...string) error {
+		rc.Apply(opt.UseTarget)
+		if len(args) == 0 {
+			r.ExitWithUsage("rotate")
+		}
+		if opt.Rotate.OlderThan != "" {
+			if _, err := duration(opt.Rotate.OlderThan); err != nil {
+				return err
+			}
+		}
+		var m *manifest
+		if opt.Rotate.Manifest != "" {
+			var err error
+			if m, err = readManifest(opt.Rotate.Manifest); err != nil {
+				return err
+			}
+		}
+
+		v := connect(true)
+		rotations, checked, err := findRotations(v, args, opt.Rotate.OlderThan, m)
+		if err != nil {
+			return err
+		}
+
+		failed := 0
+		for _, rot := range rotations {
+			if rot.Status != rotationDue || opt.Rotate.DryRun {
+				continue
+			}
+			if err := rot.rotate(v); err != nil {
+				rot.Status, rot.Reason = rotationFailed, err.Error()
+				failed++
+				continue
+			}
+			rot.Status = rotationRotated
+		}
+
+		if opt.Rotate.JSON {
+			if err := printStructured(rotations, false); err != nil {
+				return err
+			}
+		} else {
+			printRotations(rotations, checked)
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d secrets could not be rotated", failed, len(rotations))
+		}
+		return nil
+	})
+
 	r.Dispatch("prompt", &Help{
 		Summary: "Print a prompt (useful for scripting safe command sets)",
 		Usage:   "safe echo Your Message Here:",
@@ -3315,24 +4803,24 @@ Supported formats:
 		newKey := args[3]
 
 		v := connect(true)
-		s, err := v.Read(path)
-		if err != nil {
-			return err
-		}
-		if opt.SkipIfExists && s.Has(newKey) {
-			if !opt.Quiet {
-				fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to reformat} @C{%s:%s} @R{to} @C{%s} @R{as it is already present in Vault}\n", path, oldKey, newKey)
+		return updateSecret(v, path, func(s *vault.Secret, exists bool) error {
+			if !exists {
+				return vault.NewSecretNotFoundError(path)
 			}
-			return nil
-		}
-		if err = s.Format(oldKey, newKey, fmtType, opt.SkipIfExists); err != nil {
-			if vault.IsNotFound(err) {
-				return fmt.Errorf("%s:%s does not exist, cannot create %s encoded copy at %s:%s", path, oldKey, fmtType, path, newKey)
+			if opt.SkipIfExists && s.Has(newKey) {
+				if !opt.Quiet {
+					fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to reformat} @C{%s:%s} @R{to} @C{%s} @R{as it is already present in Vault}\n", path, oldKey, newKey)
+				}
+				return errUnchanged
 			}
-			return fmt.Errorf("Error encoding %s:%s as %s: %s", path, oldKey, fmtType, err)
-		}
-
-		return v.Write(path, s)
+			if err := s.Format(oldKey, newKey, fmtType, opt.SkipIfExists); err != nil {
+				if vault.IsNotFound(err) {
+					return fmt.Errorf("%s:%s does not exist, cannot create %s encoded copy at %s:%s", path, oldKey, fmtType, path, newKey)
+				}
+				return fmt.Errorf("Error encoding %s:%s as %s: %s", path, oldKey, fmtType, err)
+			}
+			return nil
+		})
 	})
 
 	r.Dispatch("curl", &Help{
@@ -3439,13 +4927,19 @@ Here are the supported commands:
     including its subject name, issuer (CA), expiration and lifetime,
     and what domains, email addresses, and IP addresses it represents.
 
+  @G{x509 expiring} [OPTIONS] path [path ...]
+
+    Find all of the certificates underneath the given paths that have
+    expired, or will soon, and what signed them.
+
   @G{x509 reissue} [OPTIONS] path/to/certificate
 
     Regenerate the certificate and key at the given path.
 
   @G{x509 renew} [OPTIONS] path/to/certificate
 
-    Renew the certificate at the given path
+    Renew the certificate at the given path, or (with --recursive)
+    every certificate under it issued by a given CA.
 `,
 	}, func(command string, args ...string) error {
 		r.Help(os.Stdout, "x509")
@@ -3634,9 +5128,14 @@ The following options are recognized:
                       Can (and probably should) be specified
                       more than once.
 
-  -b, --bits N        RSA key strength, in bits.  The only valid
-                      arguments are 1024 (highly discouraged),
-                      2048 and 4096.  Defaults to 4096.
+  --key-type TYPE     The type of key to generate: 'rsa' (the
+                      default), 'ecdsa' or 'ed25519'.
+
+  -b, --bits N        Key strength, in bits.  For RSA keys, the only
+                      valid arguments are 1024 (highly discouraged),
+                      2048 and 4096, and it defaults to 4096.  For
+                      ECDSA keys, this is the curve: 256 (P-256, the
+                      default), 384 (P-384) or 521 (P-521).
 
   -t, --ttl           How long the new certificate will be valid
                       for.  Specified in units h (hours), m (months)
@@ -3662,6 +5161,19 @@ The following options are recognized:
                       sha512-rsapss, dsa-sha1, dsa-sha256, ecdsa-sha1,
                       ecdsa-sha256, ecdsa-sha384, and ecdsa-sha512. Defaults
                       to sha512-rsa.
+
+  --pki MOUNT         Have the PKI secrets engine mounted at MOUNT issue
+                      the certificate, instead of signing it locally.
+                      The certificate and key are still stored at the
+                      given path.  Requires --role.
+
+  --role ROLE         The PKI role to issue the certificate under.  The
+                      role decides the key type and strength, the key
+                      usages, the maximum TTL, and which names are
+                      allowed, so --ca, --signed-by, --key-type, --bits,
+                      --key-usage and --sig-algorithm cannot be used
+                      with --pki.  Only the common name (CN) can be given
+                      in the --subject.
 `,
 	}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
@@ -3688,6 +5200,18 @@ The following options are recognized:
 			}
 		}
 
+		if opt.X509.Issue.PKI != "" || opt.X509.Issue.Role != "" {
+			if opt.X509.Issue.PKI == "" || opt.X509.Issue.Role == "" {
+				return fmt.Errorf("--pki and --role must be given together")
+			}
+			if opt.X509.Issue.CA || opt.X509.Issue.SignedBy != "" || opt.X509.Issue.KeyType != "" || opt.X509.Issue.Bits != 0 ||
+				len(opt.X509.Issue.KeyUsage) > 0 || opt.X509.Issue.SigAlgorithm != "" {
+				return fmt.Errorf("--ca, --signed-by, --key-type, --bits, --key-usage and --sig-algorithm cannot be used with --pki; the role %s decides them", opt.X509.Issue.Role)
+			}
+			return issueFromPKI(v, args[0], opt.X509.Issue.PKI, opt.X509.Issue.Role, opt.X509.Issue.Subject,
+				uniq(opt.X509.Issue.Name), opt.X509.Issue.TTL, opt.SkipIfExists)
+		}
+
 		if opt.X509.Issue.SignedBy != "" {
 			secret, err := v.Read(opt.X509.Issue.SignedBy)
 			if err != nil {
@@ -3707,9 +5231,17 @@ The following options are recognized:
 			}
 		}
 
+		keyType, err := vault.NormalizeKeyType(opt.X509.Issue.KeyType)
+		if err != nil {
+			return err
+		}
+		if keyType == vault.KeyTypeRSA && opt.X509.Issue.Bits == 0 {
+			opt.X509.Issue.Bits = 4096
+		}
+
 		cert, err := vault.NewCertificate(opt.X509.Issue.Subject,
 			uniq(opt.X509.Issue.Name), opt.X509.Issue.KeyUsage,
-			opt.X509.Issue.SigAlgorithm, opt.X509.Issue.Bits)
+			opt.X509.Issue.SigAlgorithm, keyType, opt.X509.Issue.Bits)
 		if err != nil {
 			return err
 		}
@@ -3778,10 +5310,15 @@ The following options are recognized:
 											it will act as an exhaustive list in the same way that
                       it would for a new issue command.
 
-  -b, --bits  N       RSA key strength, in bits.  The only valid
-                      arguments are 1024 (highly discouraged),
-                      2048 and 4096.  Defaults to the last value used
-                      to (re)issue the certificate.
+  --key-type TYPE     The type of key to generate: 'rsa', 'ecdsa' or
+                      'ed25519'.  Defaults to the type of the current key.
+
+  -b, --bits  N       Key strength, in bits.  For RSA keys, the only
+                      valid arguments are 1024 (highly discouraged),
+                      2048 and 4096.  For ECDSA keys, this is the curve:
+                      256, 384 or 521.  Defaults to the last value used
+                      to (re)issue the certificate, if the key type
+                      hasn't changed.
 
   -i, --signed-by     Path in the Vault where the CA certificate
                       (and signing key) can be found.  If this is not
@@ -3894,21 +5431,37 @@ The following options are recognized:
 			}
 		}
 
-		// Get signing key bit length
-		if opt.X509.Reissue.Bits == 0 {
-			opt.X509.Reissue.Bits = cert.PrivateKey.N.BitLen()
+		// Get signing key type and bit length
+		oldType, oldBits := vault.KeyStrength(cert.PrivateKey)
+		keyType := oldType
+		if opt.X509.Reissue.KeyType != "" {
+			keyType, err = vault.NormalizeKeyType(opt.X509.Reissue.KeyType)
+			if err != nil {
+				return err
+			}
+		}
+		if opt.X509.Reissue.Bits == 0 && keyType == oldType {
+			opt.X509.Reissue.Bits = oldBits
 		}
-		if opt.X509.Reissue.Bits != 1024 && opt.X509.Reissue.Bits != 2048 && opt.X509.Reissue.Bits != 4096 {
+		if keyType == vault.KeyTypeRSA && opt.X509.Reissue.Bits == 0 {
+			opt.X509.Reissue.Bits = 4096
+		}
+		if keyType == vault.KeyTypeRSA && opt.X509.Reissue.Bits != 1024 && opt.X509.Reissue.Bits != 2048 && opt.X509.Reissue.Bits != 4096 {
 			return fmt.Errorf("Bits must be one of 1024, 2048 or 4096")
 		}
 
 		// Generate new key with same bit length.
-		fmt.Printf("\nGenerating new %d-bit key...\n", opt.X509.Reissue.Bits)
-		newKey, err := rsa.GenerateKey(rand.Reader, opt.X509.Reissue.Bits)
+		newKey, err := vault.GenerateKey(keyType, opt.X509.Reissue.Bits)
 		if err != nil {
 			return err
 		}
+		_, bits := vault.KeyStrength(newKey)
+		fmt.Printf("\nGenerated new %d-bit %s key...\n", bits, keyType)
 		cert.PrivateKey = newKey
+		if keyType != oldType && opt.X509.Reissue.SigAlgorithm == "" && caPath == args[0] {
+			//Self-signed, so the old signature algorithm won't work with the new key
+			cert.Certificate.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+		}
 		err = ca.Sign(cert, ttl)
 		if err != nil {
 			return err
@@ -3937,6 +5490,14 @@ The following options are recognized:
 		Description: `
 Renew an X.509 Certificate with existing key
 
+With -R (--recursive) and --signed-by, every certificate underneath the
+given path that was issued by that CA is renewed instead, each keeping
+its existing subject, SANs and key usages.  This is handy for re-signing
+all of the leaves of an intermediate CA after it has been rotated.  A
+certificate is considered issued by the CA if the CA's key signed it, or
+if it names the CA as its issuer.  Only --ttl and --sig-algorithm can be
+combined with --recursive.
+
 The following options are recognized:
   -s, --subject       The subject name for this certificate.
                       i.e. /cn=www.example.com/c=us/st=ny...
@@ -4000,6 +5561,16 @@ The following options are recognized:
 			r.ExitWithUsage("x509 renew")
 		}
 
+		if opt.X509.Renew.Recursive {
+			if opt.X509.Renew.SignedBy == "" {
+				return fmt.Errorf("--recursive requires --signed-by, to say which CA's certificates to renew")
+			}
+			if opt.X509.Renew.Subject != "" || len(opt.X509.Renew.Name) > 0 || len(opt.X509.Renew.KeyUsage) > 0 {
+				return fmt.Errorf("--subject, --name and --key-usage cannot be used with --recursive")
+			}
+			return renewSignedBy(connect(true), args[0], opt.X509.Renew.SignedBy, opt.X509.Renew.TTL, opt.X509.Renew.SigAlgorithm)
+		}
+
 		v := connect(true)
 
 		/* find the Certificate that we want to renew */
@@ -4098,15 +5669,26 @@ The following options are recognized:
 
   -i, --signed-by   Path in the Vault where the CA certificate that
                     signed the certificate to revoke resides.
+
+  --pki MOUNT       Revoke a certificate that was issued by the PKI
+                    secrets engine mounted at MOUNT (i.e. via
+                    'x509 issue --pki').  Instead of a path, you can
+                    also give the serial number of the certificate.
+
+Exactly one of --signed-by or --pki must be given.
 `,
 	}, func(command string, args ...string) error {
-		if opt.X509.Revoke.SignedBy == "" || len(args) != 1 {
+		if (opt.X509.Revoke.SignedBy == "") == (opt.X509.Revoke.PKI == "") || len(args) != 1 {
 			r.ExitWithUsage("x509 revoke")
 		}
 
 		rc.Apply(opt.UseTarget)
 		v := connect(true)
 
+		if opt.X509.Revoke.PKI != "" {
+			return v.RevokeCertificate(opt.X509.Revoke.PKI, args[0])
+		}
+
 		/* find the CA */
 		s, err := v.Read(opt.X509.Revoke.SignedBy)
 		if err != nil {
@@ -4145,7 +5727,7 @@ The following options are recognized:
 
 	r.Dispatch("x509 show", &Help{
 		Summary: "Show the details of an X.509 Certificate",
-		Usage:   "safe x509 show path [path ...]",
+		Usage:   "safe x509 show [--json|--yaml] path [path ...]",
 		Type:    NonDestructiveCommand,
 		Description: `
 When dealing with lots of different X.509 Certificates, it is important
@@ -4157,6 +5739,8 @@ prints out information about a certificate, including:
   - What names / IPs is it valid for?
   - When does it expire?
 
+If --json or --yaml is given, the same details (and a few more, like the key
+algorithm and size) are printed in that format, for use by other programs.
 `,
 	}, func(command string, args ...string) error {
 		if len(args) == 0 {
@@ -4166,14 +5750,25 @@ prints out information about a certificate, including:
 		rc.Apply(opt.UseTarget)
 		v := connect(true)
 
+		structured := opt.X509.Show.JSON || opt.X509.Show.Yaml
+		var all []interface{}
 		for _, path := range args {
-			s, err := v.Read(args[0])
+			s, err := v.Read(path)
 			if err != nil {
 				return err
 			}
 
-			fmt.Printf("%s:\n", path)
 			cert, err := s.X509(false)
+			if structured {
+				if err != nil {
+					all = append(all, certError{Path: path, Error: err.Error()})
+				} else {
+					all = append(all, newCertOutput(path, cert))
+				}
+				continue
+			}
+
+			fmt.Printf("%s:\n", path)
 			if err != nil {
 				fmt.Printf("  !! %s\n\n", err)
 				continue
@@ -4309,6 +5904,7 @@ prints out information about a certificate, including:
 				x509.SHA256WithRSAPSS:          "SHA256 With RSAPSS",
 				x509.SHA384WithRSAPSS:          "SHA384 With RSAPSS",
 				x509.SHA512WithRSAPSS:          "SHA512 With RSAPSS",
+				x509.PureEd25519:               "Ed25519",
 			}
 			sigAlgo := sigView[cert.Certificate.SignatureAlgorithm]
 			fmt.Printf("@G{%s}\n", sigAlgo)
@@ -4341,6 +5937,85 @@ prints out information about a certificate, including:
 			fmt.Printf("\n")
 		}
 
+		if structured {
+			return printStructured(all, opt.X509.Show.Yaml)
+		}
+		return nil
+	})
+
+	r.Dispatch("x509 expiring", &Help{
+		Summary: "Find X.509 Certificates that have expired or will expire soon",
+		Usage:   "safe x509 expiring [--within 30d] [--json] [--prometheus FILE] path [path ...]",
+		Type:    NonDestructiveCommand,
+		Description: `
+Walks the hierarchy of secrets underneath each of the given paths, looking for
+X.509 Certificates that have already expired, or will expire within the window
+given by --within (30 days, by default).  Each one is listed along with its
+subject, issuer, expiry and the path of the CA that signed it.
+
+The following options are recognized:
+
+  -w, --within      How far into the future to look, i.e. 90d, 6m or 1y.
+
+  --json            Print the expiring certificates as a JSON list.
+
+  --prometheus      Write the expiry of every certificate found (expiring or
+                    not) to FILE, in the Prometheus text format, for use with
+                    the node_exporter textfile collector.  Use '-' to print
+                    it to standard output instead (but not with --json).
+
+The process will exit 1 (one) if any certificates are expiring, making this
+suitable for use in monitoring scripts.
+`,
+	}, func(command string, args ...string) error {
+		rc.Apply(opt.UseTarget)
+		if len(args) == 0 {
+			r.ExitWithUsage("x509 expiring")
+		}
+		if opt.X509.Expiring.JSON && opt.X509.Expiring.Prometheus == "-" {
+			return fmt.Errorf("--json and --prometheus - cannot both print to standard output")
+		}
+
+		within := opt.X509.Expiring.Within
+		if within == "" {
+			within = "30d"
+		}
+		window, err := duration(within)
+		if err != nil {
+			return err
+		}
+
+		v := connect(true)
+		certs, err := scanCertificates(v, args)
+		if err != nil {
+			return err
+		}
+
+		expiring := []certExpiry{}
+		for _, c := range certs {
+			if c.NotAfter.Before(time.Now().Add(window)) {
+				expiring = append(expiring, c)
+			}
+		}
+
+		if opt.X509.Expiring.Prometheus != "" {
+			if err := writePrometheusExpiry(opt.X509.Expiring.Prometheus, certs, within, len(expiring)); err != nil {
+				return err
+			}
+		}
+		if opt.X509.Expiring.JSON {
+			b, err := json.MarshalIndent(expiring, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", string(b))
+		} else if opt.X509.Expiring.Prometheus != "-" {
+			printExpiring(expiring)
+		}
+
+		if len(expiring) > 0 {
+			return fmt.Errorf("%d of %d certificates expire within %s", len(expiring), len(certs), within)
+		}
 		return nil
 	})
 
@@ -4392,68 +6067,148 @@ Currently, only the --renew option is supported, and it is required:
 		return nil
 	})
 
-	env.Override(&opt)
-	p, err := cli.NewParser(&opt, os.Args[1:])
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "@R{!! %s}\n", err)
-		os.Exit(1)
-	}
+	// run runs each of the commands that p finds in turn, stopping at the
+	// first one that fails.
+	run := func(p *cli.Parser) {
+		for p.Next() {
+			opt.SkipIfExists = !opt.Clobber
 
-	if opt.Version {
-		r.Execute("version")
-		return
-	}
-	if opt.Help { //-h was given as a global arg
-		r.Execute("help")
-		return
-	}
+			if opt.Version {
+				r.Execute("version")
+				return
+			}
+
+			if p.Command == "" { //No recognized command was found
+				r.Execute("help")
+				return
+			}
+
+			if opt.Help { // -h or --help was given after a command
+				r.Execute("help", p.Command)
+				continue
+			}
 
-	for p.Next() {
-		opt.SkipIfExists = !opt.Clobber
+			os.Unsetenv("VAULT_SKIP_VERIFY")
+			os.Unsetenv("SAFE_SKIP_VERIFY")
+			if opt.Insecure {
+				os.Setenv("VAULT_SKIP_VERIFY", "1")
+				os.Setenv("SAFE_SKIP_VERIFY", "1")
+			}
 
-		if opt.Version {
-			r.Execute("version")
-			return
+			defer rc.Cleanup()
+			if r.IsDestructive(p.Command) {
+				startAudit(opt.UseTarget, p.Command, p.Args)
+			}
+			err := r.Execute(p.Command, p.Args...)
+			finishAudit(err)
+			if err != nil {
+				if strings.HasPrefix(err.Error(), "USAGE") {
+					fmt.Fprintf(os.Stderr, "@Y{%s}\n", err)
+				} else {
+					fmt.Fprintf(os.Stderr, "@R{!! %s}\n", err)
+				}
+				exit(1)
+			}
 		}
 
-		if p.Command == "" { //No recognized command was found
+		//If there were no args given, the above loop that would try to give help
+		// doesn't execute at all, so we catch it here.
+		if p.Command == "" {
 			r.Execute("help")
-			return
 		}
 
-		if opt.Help { // -h or --help was given after a command
-			r.Execute("help", p.Command)
-			continue
+		if err := p.Error(); err != nil {
+			fmt.Fprintf(os.Stderr, "@R{!! %s}\n", err)
+			exit(1)
 		}
+	}
 
-		os.Unsetenv("VAULT_SKIP_VERIFY")
-		os.Unsetenv("SAFE_SKIP_VERIFY")
-		if opt.Insecure {
-			os.Setenv("VAULT_SKIP_VERIFY", "1")
-			os.Setenv("SAFE_SKIP_VERIFY", "1")
+	r.Dispatch("shell", &Help{
+		Summary: "Run safe commands interactively",
+		Usage:   "safe shell",
+		Type:    AdministrativeCommand,
+		Description: `
+Starts an interactive session, where safe commands can be typed in without
+the leading 'safe', one after the other, over a single connection to the
+Vault (and through a single proxy, or SSH tunnel, if there is one).
+
+As well as all of the usual commands, the shell understands:
+
+  cd [PATH]     Change the current directory.  Without a PATH, go back to
+                the top, where every path is absolute.
+  pwd           Print the current directory.
+  exit, quit    Leave the shell.  So does Ctrl-D.
+
+Inside a directory, paths are relative to it, unless they start with '/' or
+with the name of a mount, so (after 'cd secret/prod') 'get cf/admin' reads
+'secret/prod/cf/admin'.  Prefix a path with './' to make it relative even
+if it starts with the name of a mount, or use '../' to go up.  Each target
+has its own current directory.
+
+Up and down go back through the commands typed so far, and tab completes
+commands, flags and paths (relative ones too).  Ctrl-C clears the line.
+
+Options given to 'safe shell' itself, like --target, apply to every command
+run inside it.  A command that fails ends on its own, and leaves the shell
+running.  Each line can still chain commands with '--', and (with
+--transaction) roll them back if one of them fails.
+`,
+	}, func(command string, args ...string) error {
+		if len(args) != 0 {
+			r.ExitWithUsage("shell")
+		}
+		if session != nil {
+			return fmt.Errorf("already in a safe shell")
 		}
 
-		defer rc.Cleanup()
-		err = r.Execute(p.Command, p.Args...)
-		if err != nil {
-			if strings.HasPrefix(err.Error(), "USAGE") {
-				fmt.Fprintf(os.Stderr, "@Y{%s}\n", err)
-			} else {
+		defaults, outer := opt, transaction
+		defer func() {
+			opt, transaction = defaults, outer
+		}()
+		root := completionTree(reflect.TypeOf(opt), nil, false)
+		return runShell(r, root, opt.UseTarget, func(words []string) {
+			opt = defaults
+			p, err := cli.NewParser(&opt, words)
+			if err != nil {
 				fmt.Fprintf(os.Stderr, "@R{!! %s}\n", err)
+				return
 			}
-			os.Exit(1)
-		}
+
+			transaction = nil
+			if opt.Transaction {
+				transaction = vault.NewTransaction()
+			}
+			defer func() {
+				if transaction != nil {
+					transaction.Commit()
+				}
+			}()
+			run(p)
+		})
+	})
+
+	env.Override(&opt)
+	p, err := cli.NewParser(&opt, os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "@R{!! %s}\n", err)
+		exit(1)
 	}
 
-	//If there were no args given, the above loop that would try to give help
-	// doesn't execute at all, so we catch it here.
-	if p.Command == "" {
+	if opt.Version {
+		r.Execute("version")
+		return
+	}
+	if opt.Help { //-h was given as a global arg
 		r.Execute("help")
+		return
+	}
+	if opt.Transaction {
+		transaction = vault.NewTransaction()
 	}
 
-	if err = p.Error(); err != nil {
-		fmt.Fprintf(os.Stderr, "@R{!! %s}\n", err)
-		os.Exit(1)
+	run(p)
+	if transaction != nil {
+		transaction.Commit()
 	}
 }
 
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	fmt "github.com/jhunt/go-ansi"
+	uuid "github.com/pborman/uuid"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// A manifest declares the secrets that ought to exist in the Vault, and how
+// they should be generated.  Entries are converged in the order given, so
+// certificate authorities must come before the certificates they sign.
+type manifest struct {
+	Secrets []manifestEntry `yaml:"secrets"`
+}
+
+type manifestEntry struct {
+	Path string `yaml:"path"`
+	Type string `yaml:"type"`
+
+	// password
+	Length      int     `yaml:"length,omitempty"`
+	Policy      string  `yaml:"policy,omitempty"`
+	Generator   string  `yaml:"generator,omitempty"`
+	MinLower    int     `yaml:"min_lower,omitempty"`
+	MinUpper    int     `yaml:"min_upper,omitempty"`
+	MinDigits   int     `yaml:"min_digits,omitempty"`
+	MinSymbols  int     `yaml:"min_symbols,omitempty"`
+	Unique      bool    `yaml:"unique,omitempty"`
+	Unambiguous bool    `yaml:"unambiguous,omitempty"`
+	Separator   *string `yaml:"separator,omitempty"`
+
+	// ssh, rsa, dhparam and x509
+	Bits int `yaml:"bits,omitempty"`
+
+	// ssh, rsa and x509
+	KeyType string `yaml:"key_type,omitempty"`
+
+	// x509
+	CA           bool     `yaml:"ca,omitempty"`
+	Subject      string   `yaml:"subject,omitempty"`
+	Names        []string `yaml:"names,omitempty"`
+	SignedBy     string   `yaml:"signed_by,omitempty"`
+	TTL          string   `yaml:"ttl,omitempty"`
+	KeyUsage     []string `yaml:"key_usage,omitempty"`
+	SigAlgorithm string   `yaml:"sig_algorithm,omitempty"`
+	RenewWithin  string   `yaml:"renew_within,omitempty"`
+
+	secret   string
+	key      string
+	password vault.PasswordGenerator
+}
+
+const (
+	planOK uint = iota
+	planCreate
+	planRotate
+	planKeep
+)
+
+type planStep struct {
+	Entry  *manifestEntry
+	Action uint
+	Reason string
+}
+
+func readManifest(file string) (*manifest, error) {
+	var b []byte
+	var err error
+	if file == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m manifest
+	if err := yaml.UnmarshalStrict(b, &m); err != nil {
+		return nil, fmt.Errorf("Could not parse manifest %s: %s", file, err)
+	}
+	if len(m.Secrets) == 0 {
+		return nil, fmt.Errorf("Manifest %s declares no secrets", file)
+	}
+
+	for i := range m.Secrets {
+		if err := m.Secrets[i].validate(); err != nil {
+			return nil, fmt.Errorf("%s: secret #%d (%s): %s", file, i+1, m.Secrets[i].Path, err)
+		}
+	}
+	return &m, nil
+}
+
+func (e *manifestEntry) validate() error {
+	if e.Path == "" {
+		return fmt.Errorf("no path given")
+	}
+	if vault.PathHasVersion(e.Path) {
+		return fmt.Errorf("paths cannot specify a version")
+	}
+	e.secret, e.key, _ = vault.ParsePath(e.Path)
+
+	switch e.Type {
+	case "password":
+		if e.key == "" {
+			return fmt.Errorf("password secrets need a path:key")
+		}
+		separator := "-"
+		if e.Separator != nil {
+			separator = *e.Separator
+		}
+		var err error
+		e.password, err = vault.NewPasswordGenerator(vault.PasswordOptions{
+			Generator:   e.Generator,
+			Length:      e.Length,
+			Policy:      e.Policy,
+			MinLower:    e.MinLower,
+			MinUpper:    e.MinUpper,
+			MinDigits:   e.MinDigits,
+			MinSymbols:  e.MinSymbols,
+			Unique:      e.Unique,
+			Unambiguous: e.Unambiguous,
+			Separator:   separator,
+		})
+		if err != nil {
+			return err
+		}
+
+	case "uuid":
+		if e.key == "" {
+			e.key = "uuid"
+		}
+
+	case "ssh", "rsa", "dhparam":
+		if e.key != "" {
+			return fmt.Errorf("%s secrets cannot specify a key", e.Type)
+		}
+		if e.Type == "dhparam" && e.KeyType != "" {
+			return fmt.Errorf("dhparam secrets cannot specify a key_type")
+		}
+		var err error
+		if e.KeyType, err = vault.NormalizeKeyType(e.KeyType); err != nil {
+			return err
+		}
+		if e.Bits == 0 {
+			e.Bits = vault.DefaultKeyBits(e.KeyType)
+		}
+
+	case "x509":
+		if e.key != "" {
+			return fmt.Errorf("x509 secrets cannot specify a key")
+		}
+		var err error
+		if e.KeyType, err = vault.NormalizeKeyType(e.KeyType); err != nil {
+			return err
+		}
+		if e.Bits == 0 {
+			e.Bits = vault.DefaultKeyBits(e.KeyType)
+			if e.KeyType == vault.KeyTypeRSA {
+				e.Bits = 4096
+			}
+		}
+		if len(e.Names) == 0 && e.Subject == "" {
+			return fmt.Errorf("x509 secrets need at least one name, or a subject")
+		}
+		if e.Subject == "" {
+			e.Subject = fmt.Sprintf("CN=%s", e.Names[0])
+		}
+		if _, err := vault.ParseSubject(e.Subject); err != nil {
+			return err
+		}
+		if e.TTL == "" {
+			e.TTL = "2y"
+			if e.CA {
+				e.TTL = "10y"
+			}
+		}
+		if _, err := duration(e.TTL); err != nil {
+			return err
+		}
+		if e.RenewWithin != "" {
+			if _, err := duration(e.RenewWithin); err != nil {
+				return err
+			}
+		}
+		if len(e.KeyUsage) == 0 {
+			e.KeyUsage = []string{"server_auth", "client_auth"}
+			if e.CA {
+				e.KeyUsage = append(e.KeyUsage, "key_cert_sign", "crl_sign")
+			}
+		}
+		if e.SigAlgorithm != "" {
+			if _, err := vault.TranslateSignatureAlgorithm(e.SigAlgorithm); err != nil {
+				return err
+			}
+		}
+
+	case "":
+		return fmt.Errorf("no type given")
+	default:
+		return fmt.Errorf("unrecognized type '%s' (must be one of password, uuid, ssh, rsa, dhparam or x509)", e.Type)
+	}
+	return nil
+}
+
+// plan works out what needs to happen to each secret in the manifest.
+// Nothing is written to the Vault.
+func (m *manifest) plan(v *vault.Vault, skipIfExists bool) ([]planStep, error) {
+	replaced := make(map[string]bool)
+	var steps []planStep
+	for i := range m.Secrets {
+		e := &m.Secrets[i]
+		s, err := v.Read(e.secret)
+		if err != nil && !vault.IsNotFound(err) {
+			return nil, err
+		}
+		if err != nil {
+			s = nil
+		}
+
+		step := planStep{Entry: e}
+		step.Action, step.Reason = e.check(v, s, replaced)
+		if step.Action == planRotate && skipIfExists {
+			step.Action = planKeep
+		}
+		if step.Action == planCreate || step.Action == planRotate {
+			replaced[e.secret] = true
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func (e *manifestEntry) check(v *vault.Vault, s *vault.Secret, replaced map[string]bool) (uint, string) {
+	has := func(keys ...string) (bool, bool) {
+		var some, all = false, true
+		for _, k := range keys {
+			if s != nil && s.Has(k) {
+				some = true
+			} else {
+				all = false
+			}
+		}
+		return some, all
+	}
+
+	switch e.Type {
+	case "password":
+		if s == nil || !s.Has(e.key) {
+			return planCreate, ""
+		}
+		if err := e.password.Check(s.Get(e.key)); err != nil {
+			return planRotate, err.Error()
+		}
+
+	case "uuid":
+		if s == nil || !s.Has(e.key) {
+			return planCreate, ""
+		}
+
+	case "ssh", "rsa":
+		keys := []string{"private", "public"}
+		if e.Type == "ssh" {
+			keys = append(keys, "fingerprint")
+		}
+		some, all := has(keys...)
+		if !some {
+			return planCreate, ""
+		}
+		if !all {
+			return planRotate, "keypair is incomplete"
+		}
+		keyType, bits, err := privateKeyStrength(s.Get("private"))
+		if err != nil {
+			return planRotate, err.Error()
+		}
+		if keyType != e.KeyType {
+			return planRotate, fmt.Sprintf("key is %s, not %s", keyType, e.KeyType)
+		}
+		if bits != e.Bits {
+			return planRotate, fmt.Sprintf("key is %d bits, not %d", bits, e.Bits)
+		}
+
+	case "dhparam":
+		if s == nil || !s.Has("dhparam-pem") {
+			return planCreate, ""
+		}
+		bits, err := dhparamBits(s.Get("dhparam-pem"))
+		if err != nil {
+			return planRotate, err.Error()
+		}
+		if bits != e.Bits {
+			return planRotate, fmt.Sprintf("parameters are %d bits, not %d", bits, e.Bits)
+		}
+
+	case "x509":
+		if some, _ := has("certificate", "key"); !some {
+			return planCreate, ""
+		}
+		cert, err := s.X509(true)
+		if err != nil {
+			return planRotate, err.Error()
+		}
+		return e.checkCertificate(v, cert, replaced)
+	}
+
+	return planOK, ""
+}
+
+func (e *manifestEntry) checkCertificate(v *vault.Vault, cert *vault.X509, replaced map[string]bool) (uint, string) {
+	if err := cert.Validate(); err != nil {
+		return planRotate, err.Error()
+	}
+	if t := cert.KeyType(); t != e.KeyType {
+		return planRotate, fmt.Sprintf("key is %s, not %s", t, e.KeyType)
+	}
+	if err := cert.CheckStrength(e.Bits); err != nil {
+		return planRotate, fmt.Sprintf("%s, not %d bits", err, e.Bits)
+	}
+	if cert.IsCA() != e.CA {
+		if e.CA {
+			return planRotate, "certificate is not a CA"
+		}
+		return planRotate, "certificate is a CA"
+	}
+
+	subject, _ := vault.ParseSubject(e.Subject)
+	if cert.Certificate.Subject.String() != subject.String() {
+		return planRotate, fmt.Sprintf("subject is '%s'", cert.Subject())
+	}
+	if !sameSANs(cert, e.Names) {
+		return planRotate, "subject alternative names differ"
+	}
+
+	if e.SignedBy != "" {
+		if replaced[e.SignedBy] {
+			return planRotate, fmt.Sprintf("signing CA %s is being replaced", e.SignedBy)
+		}
+		s, err := v.Read(e.SignedBy)
+		if err == nil {
+			var ca *vault.X509
+			if ca, err = s.X509(false); err == nil {
+				err = cert.Certificate.CheckSignatureFrom(ca.Certificate)
+			}
+		}
+		if err != nil {
+			return planRotate, fmt.Sprintf("not signed by %s", e.SignedBy)
+		}
+	}
+
+	if cert.Expired() {
+		return planRotate, fmt.Sprintf("expired %s", cert.ExpiryString())
+	}
+	if e.RenewWithin != "" {
+		within, _ := duration(e.RenewWithin)
+		if time.Now().Add(within).After(cert.Certificate.NotAfter) {
+			return planRotate, fmt.Sprintf("expires %s", cert.ExpiryString())
+		}
+	}
+	return planOK, ""
+}
+
+func sameSANs(cert *vault.X509, names []string) bool {
+	ips, dns, emails := vault.CategorizeSANs(uniq(names))
+
+	var want, have []string
+	for _, ip := range ips {
+		want = append(want, ip.String())
+	}
+	for _, ip := range cert.Certificate.IPAddresses {
+		have = append(have, ip.String())
+	}
+	want = append(append(want, dns...), emails...)
+	have = append(append(have, cert.Certificate.DNSNames...), cert.Certificate.EmailAddresses...)
+
+	sort.Strings(want)
+	sort.Strings(have)
+	return strings.Join(want, "\n") == strings.Join(have, "\n")
+}
+
+func privateKeyStrength(s string) (string, int, error) {
+	if block, _ := pem.Decode([]byte(s)); block == nil {
+		return "", 0, fmt.Errorf("private key is not PEM-encoded")
+	}
+	//This understands every format that `safe ssh` and `safe rsa` write
+	key, err := ssh.ParseRawPrivateKey([]byte(s))
+	if err != nil {
+		return "", 0, fmt.Errorf("private key is malformed")
+	}
+	keyType, bits := vault.KeyStrength(key)
+	return keyType, bits, nil
+}
+
+func dhparamBits(s string) (int, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return 0, fmt.Errorf("parameters are not PEM-encoded")
+	}
+	var params struct {
+		P *big.Int
+		G *big.Int
+	}
+	if _, err := asn1.Unmarshal(block.Bytes, &params); err != nil {
+		return 0, fmt.Errorf("parameters are malformed")
+	}
+	return params.P.BitLen(), nil
+}
+
+// apply carries out a single step of the plan.
+func (step planStep) apply(v *vault.Vault) error {
+	e := step.Entry
+	if step.Action != planCreate && step.Action != planRotate {
+		return nil
+	}
+
+	if e.Type == "x509" {
+		return e.issue(v)
+	}
+
+	s, err := v.Read(e.secret)
+	if err != nil && !vault.IsNotFound(err) {
+		return err
+	}
+
+	switch e.Type {
+	case "password":
+		err = s.Password(e.key, e.password, false)
+	case "uuid":
+		err = s.Set(e.key, uuid.NewRandom().String(), false)
+	case "ssh":
+		err = s.SSHKey(e.KeyType, e.Bits, false)
+	case "rsa":
+		err = s.RSAKey(e.KeyType, e.Bits, false)
+	case "dhparam":
+		err = s.DHParam(e.Bits, false)
+	}
+	if err != nil {
+		return err
+	}
+	return v.Write(e.secret, s)
+}
+
+func (e *manifestEntry) issue(v *vault.Vault) error {
+	var ca *vault.X509
+	if e.SignedBy != "" {
+		s, err := v.Read(e.SignedBy)
+		if err != nil {
+			return fmt.Errorf("signing CA %s: %s", e.SignedBy, err)
+		}
+		if ca, err = s.X509(true); err != nil {
+			return fmt.Errorf("signing CA %s: %s", e.SignedBy, err)
+		}
+	}
+
+	cert, err := vault.NewCertificate(e.Subject, uniq(e.Names), append([]string{}, e.KeyUsage...), e.SigAlgorithm, e.KeyType, e.Bits)
+	if err != nil {
+		return err
+	}
+	if e.CA {
+		cert.MakeCA()
+	}
+
+	ttl, _ := duration(e.TTL)
+	if ca == nil {
+		err = cert.Sign(cert, ttl)
+	} else {
+		if err = ca.Sign(cert, ttl); err == nil {
+			err = ca.SaveTo(v, e.SignedBy, false)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return cert.SaveTo(v, e.secret, false)
+}
+
+func (step planStep) describe() string {
+	var what string
+	e := step.Entry
+	switch e.Type {
+	case "password":
+		what = e.password.String()
+	case "uuid":
+		what = "uuid"
+	case "ssh", "rsa":
+		what = fmt.Sprintf("%d-bit %s", e.Bits, e.Type)
+		if e.KeyType != vault.KeyTypeRSA {
+			what = fmt.Sprintf("%d-bit %s %s", e.Bits, e.KeyType, e.Type)
+		}
+	case "dhparam":
+		what = fmt.Sprintf("%d-bit %s", e.Bits, e.Type)
+	case "x509":
+		what = "x509 certificate"
+		if e.CA {
+			what = "x509 CA"
+		}
+		if e.SignedBy != "" {
+			what += fmt.Sprintf(", signed by %s", e.SignedBy)
+		}
+	}
+	if step.Reason != "" {
+		return fmt.Sprintf("%s (%s)", what, step.Reason)
+	}
+	return what
+}
+
+func printPlan(steps []planStep) (changes int) {
+	t := table{}
+	for _, step := range steps {
+		var action string
+		switch step.Action {
+		case planOK:
+			action = "@G{ok}"
+		case planCreate:
+			action = "@C{create}"
+			changes++
+		case planRotate:
+			action = "@Y{rotate}"
+			changes++
+		case planKeep:
+			action = "@R{keep}"
+		}
+		t.addRow(fmt.Sprintf(action), step.Entry.Path, step.describe())
+	}
+	t.print()
+	return changes
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	fmt "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// A metaFilter matches secrets on one of their custom metadata tags; either
+// that they have the tag at all (KEY), or that it has a given value
+// (KEY=VALUE).
+type metaFilter struct {
+	Tag      string
+	Value    string
+	HasValue bool
+}
+
+func parseMetaFilters(specs []string) ([]metaFilter, error) {
+	filters := []metaFilter{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("invalid --meta '%s' (should look like KEY or KEY=VALUE)", spec)
+		}
+		f := metaFilter{Tag: parts[0]}
+		if len(parts) == 2 {
+			f.Value, f.HasValue = parts[1], true
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// matchesMeta returns true if the metadata satisfies every one of the
+// filters.  Secrets without metadata (i.e. in KV v1 backends) only match
+// when there are no filters.
+func matchesMeta(m *vault.SecretMetadata, filters []metaFilter) bool {
+	for _, f := range filters {
+		if m == nil {
+			return false
+		}
+		value, ok := m.CustomMetadata[f.Tag]
+		if !ok || (f.HasValue && value != f.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterSecretsByMeta keeps only those secrets whose metadata matches.
+func filterSecretsByMeta(secrets vault.Secrets, filters []metaFilter) vault.Secrets {
+	kept := vault.Secrets{}
+	for _, s := range secrets {
+		if matchesMeta(s.Metadata, filters) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// checkMetaTag validates the value of the tags that safe itself knows how to
+// interpret.
+func checkMetaTag(tag, value string) error {
+	switch tag {
+	case "rotation-interval":
+		if _, err := duration(value); err != nil {
+			return fmt.Errorf("invalid rotation-interval '%s' (should look like 90d, 6m or 1y)", value)
+		}
+	case "owner", "description", "rotate-keys":
+		if value == "" {
+			return fmt.Errorf("%s cannot be empty", tag)
+		}
+	case "rotate-policy":
+		if _, err := vault.NewPasswordGenerator(vault.PasswordOptions{Policy: value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metaDeleteAfter converts a --delete-version-after value into something
+// Vault understands.  Either Go durations (i.e. 768h) or the day / month /
+// year durations used elsewhere in safe are allowed; 0 turns it off.
+func metaDeleteAfter(s string) (string, error) {
+	if s == "0" {
+		return "0s", nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return fmt.Sprintf("%ds", int64(d.Seconds())), nil
+	}
+	if d, err := duration(s); err == nil {
+		return fmt.Sprintf("%ds", int64(d.Seconds())), nil
+	}
+	return "", fmt.Errorf("invalid --delete-version-after '%s' (should look like 768h, 30d or 0)", s)
+}
+
+// metaOutput is what `safe meta get --json` prints.
+type metaOutput struct {
+	Path               string            `json:"path"`
+	MaxVersions        uint              `json:"max_versions"`
+	CASRequired        bool              `json:"cas_required"`
+	DeleteVersionAfter string            `json:"delete_version_after"`
+	CustomMetadata     map[string]string `json:"custom_metadata"`
+}
+
+func printMetadata(path string, m *vault.SecretMetadata) {
+	maxVersions := strconv.FormatUint(uint64(m.MaxVersions), 10)
+	if m.MaxVersions == 0 {
+		maxVersions = "(backend default)"
+	}
+	deleteAfter := m.DeleteVersionAfter
+	if deleteAfter == "" || deleteAfter == "0s" {
+		deleteAfter = "never"
+	}
+
+	fmt.Printf("@C{%s}\n", path)
+	t := table{}
+	t.addRow("  max versions", maxVersions)
+	t.addRow("  cas required", strconv.FormatBool(m.CASRequired))
+	t.addRow("  delete versions after", deleteAfter)
+	for _, tag := range m.Tags() {
+		t.addRow(fmt.Sprintf("  @M{%s}", tag), m.CustomMetadata[tag])
+	}
+	t.print()
+	if len(m.CustomMetadata) == 0 {
+		fmt.Fprintf(os.Stderr, "@Y{(no custom metadata)}\n")
+	}
+}
+
+// secretMetadata is like v.Metadata, except that secrets in KV v1 backends
+// simply have no metadata.
+func secretMetadata(v *vault.Vault, path string) (*vault.SecretMetadata, error) {
+	version, err := v.MountVersion(path)
+	if err != nil || version != 2 {
+		return nil, err
+	}
+	return v.Metadata(path)
+}
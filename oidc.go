@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	fmt "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// oidcPort is where the callback listener goes by default; it's the port
+// that the Vault CLI uses, so roles already allow it as a redirect.
+const oidcPort = 8250
+
+// oidcTimeout is how long to wait for the login to be finished in the
+// browser.
+const oidcTimeout = 5 * time.Minute
+
+// oidcLogin runs the OIDC authorization code flow: it listens on localhost
+// for the identity provider to send the browser back, sends the browser
+// (or asks the user to go) to the provider to log in, and then has the
+// Vault exchange what comes back for a token.
+func oidcLogin(v *vault.Vault, mount, role string, port int, browser bool) (string, error) {
+	if port == 0 {
+		port = oidcPort
+	}
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(b)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return "", fmt.Errorf("unable to listen for the OIDC callback: %s", err)
+	}
+	redirect := fmt.Sprintf("http://localhost:%d/oidc/callback", port)
+
+	authURL, err := v.OIDCAuthURL(mount, role, redirect, nonce)
+	if err != nil {
+		listener.Close()
+		return "", err
+	}
+
+	type result struct {
+		token string
+		err   error
+	}
+	done := make(chan result, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oidc/callback", func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		var res result
+		if msg := q.Get("error"); msg != "" {
+			if desc := q.Get("error_description"); desc != "" {
+				msg = msg + ": " + desc
+			}
+			res.err = fmt.Errorf("the identity provider refused the login (%s)", msg)
+		} else {
+			res.token, res.err = v.OIDCCallback(mount, nonce, q)
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if res.err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, oidcPage, "Login failed", "Go back to safe to see what went wrong.")
+		} else {
+			fmt.Fprintf(w, oidcPage, "Logged in", "You can close this window and go back to safe.")
+		}
+		select {
+		case done <- res:
+		default:
+		}
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+
+	fmt.Fprintf(os.Stderr, "Complete the login with your OIDC provider, at:\n\n    @C{%s}\n\n", authURL)
+	if browser {
+		if err := openBrowser(authURL); err != nil {
+			fmt.Fprintf(os.Stderr, "@Y{Unable to open a browser (%s); open that URL by hand.}\n", err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Waiting for the OIDC callback on @C{%s}...\n", redirect)
+
+	select {
+	case res := <-done:
+		return res.token, res.err
+	case <-time.After(oidcTimeout):
+		return "", fmt.Errorf("gave up waiting for the OIDC login to be finished after %s", oidcTimeout)
+	}
+}
+
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+const oidcPage = `<!DOCTYPE html>
+<html>
+  <head><title>safe</title></head>
+  <body style="font-family: sans-serif; text-align: center; margin-top: 4em">
+    <h1>%s</h1>
+    <p>%s</p>
+  </body>
+</html>
+`
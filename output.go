@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"strings"
+	"time"
+
+	fmt "github.com/jhunt/go-ansi"
+	"gopkg.in/yaml.v2"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// printStructured prints v for consumption by other programs; as indented
+// JSON by default, or as YAML if asYAML is set.
+func printStructured(v interface{}, asYAML bool) error {
+	if asYAML {
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s", string(b))
+		return nil
+	}
+
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", string(b))
+	return nil
+}
+
+type lsOutput struct {
+	Path    string    `json:"path"    yaml:"path"`
+	Entries []lsEntry `json:"entries" yaml:"entries"`
+}
+
+type lsEntry struct {
+	Name     string            `json:"name"               yaml:"name"`
+	Type     string            `json:"type"               yaml:"type"`
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+}
+
+// newLsOutput describes the names listed at path.  The custom metadata of
+// any secrets found in metas is included.
+func newLsOutput(path string, names []string, metas map[string]*vault.SecretMetadata) lsOutput {
+	out := lsOutput{Path: path, Entries: []lsEntry{}}
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			out.Entries = append(out.Entries, lsEntry{Name: strings.TrimSuffix(name, "/"), Type: "dir"})
+		} else {
+			entry := lsEntry{Name: name, Type: "secret"}
+			if m := metas[name]; m != nil {
+				entry.Metadata = m.CustomMetadata
+			}
+			out.Entries = append(out.Entries, entry)
+		}
+	}
+	return out
+}
+
+type versionsOutput struct {
+	Path         string          `json:"path"          yaml:"path"`
+	MountVersion uint            `json:"mount_version" yaml:"mount_version"`
+	Versions     []versionOutput `json:"versions"      yaml:"versions"`
+}
+
+type versionOutput struct {
+	Version   uint       `json:"version"              yaml:"version"`
+	State     string     `json:"state"                yaml:"state"`
+	CreatedAt *time.Time `json:"created_at,omitempty" yaml:"created_at,omitempty"`
+}
+
+func stateName(state uint) string {
+	switch state {
+	case vault.SecretStateDeleted:
+		return "deleted"
+	case vault.SecretStateDestroyed:
+		return "destroyed"
+	default:
+		return "alive"
+	}
+}
+
+func newVersionOutput(v vault.SecretVersion) versionOutput {
+	out := versionOutput{Version: v.Number, State: stateName(v.State)}
+	if !v.CreatedAt.IsZero() {
+		t := v.CreatedAt
+		out.CreatedAt = &t
+	}
+	return out
+}
+
+// secretOutput describes a single secret found by a tree walk.  Version is
+// the latest version, when version information was fetched.
+type secretOutput struct {
+	Path         string            `json:"path"               yaml:"path"`
+	MountVersion uint              `json:"mount_version"      yaml:"mount_version"`
+	Version      *versionOutput    `json:"version,omitempty"  yaml:"version,omitempty"`
+	Keys         []string          `json:"keys,omitempty"     yaml:"keys,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+}
+
+func newSecretOutput(s vault.SecretEntry, keys bool) secretOutput {
+	out := secretOutput{Path: s.Path, MountVersion: s.MountVersion}
+	if s.Metadata != nil && len(s.Metadata.CustomMetadata) > 0 {
+		out.Metadata = s.Metadata.CustomMetadata
+	}
+	if len(s.Versions) > 0 {
+		latest := s.Versions[len(s.Versions)-1]
+		v := newVersionOutput(latest)
+		out.Version = &v
+		if keys && latest.Data != nil {
+			out.Keys = latest.Data.Keys()
+		}
+	}
+	return out
+}
+
+type treeOutput struct {
+	Name     string        `json:"name"               yaml:"name"`
+	Type     string        `json:"type"               yaml:"type"`
+	Secret   *secretOutput `json:"secret,omitempty"   yaml:"secret,omitempty"`
+	Children []*treeOutput `json:"children,omitempty" yaml:"children,omitempty"`
+}
+
+// newTreeOutput nests the (sorted) secrets found under root the way `safe
+// tree` draws them.  Unless leaves is set, only the directories are kept.
+func newTreeOutput(root string, secrets vault.Secrets, leaves, keys bool) *treeOutput {
+	root = strings.Trim(vault.Canonicalize(root), "/")
+	top := &treeOutput{Name: root + "/", Type: "dir"}
+	if root == "" {
+		top.Name = "/"
+	}
+
+	for _, s := range secrets {
+		rel := relativePath(root, s.Path)
+		if rel == "" {
+			if leaves {
+				secret := newSecretOutput(s, keys)
+				top.Name, top.Type, top.Secret = root, "secret", &secret
+			}
+			continue
+		}
+
+		parts := strings.Split(rel, "/")
+		node := top
+		for _, part := range parts[:len(parts)-1] {
+			node = node.dir(part)
+		}
+		if leaves {
+			secret := newSecretOutput(s, keys)
+			node.Children = append(node.Children, &treeOutput{Name: parts[len(parts)-1], Type: "secret", Secret: &secret})
+		}
+	}
+	return top
+}
+
+func (t *treeOutput) dir(name string) *treeOutput {
+	for _, c := range t.Children {
+		if c.Type == "dir" && c.Name == name+"/" {
+			return c
+		}
+	}
+	c := &treeOutput{Name: name + "/", Type: "dir"}
+	t.Children = append(t.Children, c)
+	return c
+}
+
+// certError stands in for a certOutput when the path doesn't hold a
+// certificate.
+type certError struct {
+	Path  string `json:"path"  yaml:"path"`
+	Error string `json:"error" yaml:"error"`
+}
+
+type certOutput struct {
+	Path               string    `json:"path"                  yaml:"path"`
+	Subject            string    `json:"subject"               yaml:"subject"`
+	Issuer             string    `json:"issuer"                yaml:"issuer"`
+	Intermediaries     []string  `json:"intermediaries"        yaml:"intermediaries"`
+	SelfSigned         bool      `json:"self_signed"           yaml:"self_signed"`
+	CA                 bool      `json:"ca"                    yaml:"ca"`
+	Serial             string    `json:"serial"                yaml:"serial"`
+	NotBefore          time.Time `json:"not_before"            yaml:"not_before"`
+	NotAfter           time.Time `json:"not_after"             yaml:"not_after"`
+	Expired            bool      `json:"expired"               yaml:"expired"`
+	KeyUsage           []string  `json:"key_usage"             yaml:"key_usage"`
+	SignatureAlgorithm string    `json:"signature_algorithm"   yaml:"signature_algorithm"`
+	KeyAlgorithm       string    `json:"key_algorithm"         yaml:"key_algorithm"`
+	KeyBits            int       `json:"key_bits"              yaml:"key_bits"`
+	DNSNames           []string  `json:"dns_names"             yaml:"dns_names"`
+	IPAddresses        []string  `json:"ip_addresses"          yaml:"ip_addresses"`
+	EmailAddresses     []string  `json:"email_addresses"       yaml:"email_addresses"`
+}
+
+func newCertOutput(path string, cert *vault.X509) certOutput {
+	c := cert.Certificate
+	out := certOutput{
+		Path:               path,
+		Subject:            cert.Subject(),
+		Issuer:             cert.Issuer(),
+		Intermediaries:     []string{},
+		SelfSigned:         cert.Subject() == cert.Issuer(),
+		CA:                 cert.IsCA(),
+		Serial:             cert.FormatSerial(),
+		NotBefore:          c.NotBefore,
+		NotAfter:           c.NotAfter,
+		Expired:            cert.Expired(),
+		KeyUsage:           cert.KeyUsageNames(),
+		SignatureAlgorithm: c.SignatureAlgorithm.String(),
+		DNSNames:           append([]string{}, c.DNSNames...),
+		IPAddresses:        []string{},
+		EmailAddresses:     append([]string{}, c.EmailAddresses...),
+	}
+	for i := range cert.Intermediaries {
+		out.Intermediaries = append(out.Intermediaries, cert.IntermediarySubject(i))
+	}
+	for _, ip := range c.IPAddresses {
+		out.IPAddresses = append(out.IPAddresses, ip.String())
+	}
+
+	switch key := c.PublicKey.(type) {
+	case *rsa.PublicKey:
+		out.KeyAlgorithm, out.KeyBits = "rsa", key.N.BitLen()
+	case *ecdsa.PublicKey:
+		out.KeyAlgorithm, out.KeyBits = "ecdsa", key.Params().BitSize
+	case ed25519.PublicKey:
+		out.KeyAlgorithm, out.KeyBits = "ed25519", 256
+	default:
+		out.KeyAlgorithm = "unknown"
+	}
+	return out
+}
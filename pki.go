@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	fmt "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// issueFromPKI has the PKI secrets engine mounted at backend issue a new
+// certificate under the given role, and stores it at path just like the
+// certificates that safe signs itself.  The role decides the key, the key
+// usages and everything in the subject but the common name.
+func issueFromPKI(v *vault.Vault, path, backend, role, subject string, names []string, ttl string, skipIfExists bool) error {
+	name, err := vault.ParseSubject(subject)
+	if err != nil {
+		return err
+	}
+	if name.CommonName == "" {
+		return fmt.Errorf("no common name (CN) found in '%s'", subject)
+	}
+	if len(name.Country)+len(name.Province)+len(name.Locality)+len(name.Organization)+len(name.OrganizationalUnit) > 0 {
+		return fmt.Errorf("only the common name (CN) can be set for certificates issued by the PKI backend; the rest of the subject comes from role '%s'", role)
+	}
+
+	params := vault.CertOptions{CN: name.CommonName}
+
+	ips, domains, emails := vault.CategorizeSANs(names)
+	params.AltNames = strings.Join(append(domains, emails...), ",")
+	ipSans := make([]string, len(ips))
+	for i, ip := range ips {
+		ipSans[i] = ip.String()
+	}
+	params.IPSans = strings.Join(ipSans, ",")
+
+	if ttl != "" {
+		d, err := duration(ttl)
+		if err != nil {
+			return err
+		}
+		params.TTL = fmt.Sprintf("%ds", d/time.Second)
+	}
+
+	return v.CreateSignedCertificate(backend, role, path, params, skipIfExists)
+}
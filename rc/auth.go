@@ -0,0 +1,48 @@
+package rc
+
+import (
+	fmt "github.com/jhunt/go-ansi"
+)
+
+// Auth is how to log in to a target again, once its token has expired.
+// Only what isn't secret is kept in ~/.saferc; passwords and the like come
+// from Helper, a credential helper (run with get as its argument, given the
+// target, method=, path=, username= and role_id= lines, it prints password=,
+// secret_id=, token= or jwt= lines), or else they are asked for.
+type Auth struct {
+	Method    string `yaml:"method"`
+	Path      string `yaml:"path,omitempty"`
+	Role      string `yaml:"role,omitempty"`
+	Username  string `yaml:"username,omitempty"`
+	RoleID    string `yaml:"role_id,omitempty"`
+	JWTFile   string `yaml:"jwt_file,omitempty"`
+	Port      int    `yaml:"port,omitempty"`
+	NoBrowser bool   `yaml:"no_browser,omitempty"`
+	Helper    string `yaml:"helper,omitempty"`
+}
+
+// Secrets gets the secrets that logging in needs from the credential
+// helper, if there is one.
+func (a *Auth) Secrets(alias, url, namespace string) (map[string]string, error) {
+	if a.Helper == "" {
+		return map[string]string{}, nil
+	}
+	return runHelper(a.Helper, "get", alias, url, namespace,
+		"method="+a.Method, "path="+a.Path, "username="+a.Username, "role_id="+a.RoleID)
+}
+
+// Remember has safe log in to the target aliased as alias with auth, once
+// its token expires.  A nil auth forgets how.
+func (c *Config) Remember(alias string, auth *Auth) error {
+	v, ok := c.Vaults[alias]
+	if !ok {
+		return fmt.Errorf("Unknown target '%s'", alias)
+	}
+	v.Auth = auth
+	return nil
+}
+
+// Applied returns the alias of the target that was applied last, if any.
+func Applied() string {
+	return applied
+}
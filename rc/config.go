@@ -3,7 +3,6 @@ package rc
 import (
 	"io/ioutil"
 	"os"
-	"os/signal"
 	"runtime"
 	"strings"
 	"sync"
@@ -15,6 +14,14 @@ import (
 var toCleanup []string
 var cleanupLock sync.Mutex
 
+// Exit is how the rc package gives up, once it has said what went wrong.
+// It is os.Exit, unless the program using the package has its own way of
+// winding down (like rolling back, or going back to a shell prompt).
+var Exit = os.Exit
+
+// applied is the alias of the target that was applied last.
+var applied string
+
 type Config struct {
 	Version int               `yaml:"version"`
 	Current string            `yaml:"current"`
@@ -24,6 +31,7 @@ type Config struct {
 
 type Options struct {
 	ManageVaultToken bool `yaml:"manage_vault_token"`
+	RequireCAS       bool `yaml:"require_cas"`
 }
 
 type Vault struct {
@@ -33,6 +41,12 @@ type Vault struct {
 	SkipVerify  bool     `yaml:"skip_verify,omitempty"`
 	NoStrongbox bool     `yaml:"no_strongbox,omitempty"`
 	Namespace   string   `yaml:"namespace,omitempty"`
+	ClientCert  string   `yaml:"client_cert,omitempty"`
+	ClientKey   string   `yaml:"client_key,omitempty"`
+	TokenStore  string   `yaml:"token_store,omitempty"`
+	Auth        *Auth    `yaml:"auth,omitempty"`
+
+	loaded bool /* Token has been fetched from (or set for) TokenStore */
 }
 
 type oldConfig struct {
@@ -99,7 +113,7 @@ func Read() Config {
 		var legacy oldConfig
 		if err = yaml.Unmarshal(b, &legacy); err != nil {
 			fmt.Fprintf(os.Stderr, "@R{!!! %s}\n", err)
-			os.Exit(1)
+			Exit(1)
 		}
 		c = legacy.convert()
 	}
@@ -112,13 +126,35 @@ func Apply(use string) Config {
 
 	if err := c.Apply(use); err != nil {
 		fmt.Fprintf(os.Stderr, "@R{!!! %s}\n", err)
-		os.Exit(1)
+		Exit(1)
 	}
 	return c
 }
 
 func (c *Config) Write() error {
-	b, err := yaml.Marshal(c)
+	out := *c
+	out.Vaults = make(map[string]*Vault)
+	for alias, v := range c.Vaults {
+		store, err := v.store()
+		if err != nil {
+			return err
+		}
+		saved := *v
+		if store != nil {
+			if v.loaded {
+				if err := store.Store(alias, v, v.Token); err != nil {
+					return fmt.Errorf("unable to save the token for '%s' in its %s token store: %s", alias, v.TokenStore, err)
+				}
+			}
+			saved.Token = ""
+		}
+		out.Vaults[alias] = &saved
+	}
+	if c.Vaults == nil {
+		out.Vaults = nil
+	}
+
+	b, err := yaml.Marshal(out)
 	if err != nil {
 		return err
 	}
@@ -137,6 +173,7 @@ func (c *Config) Write() error {
 		return nil
 	}
 
+	store, _ := v.store()
 	sv := struct {
 		Vault      string `yaml:"vault"` /* this is different than Vault.URL */
 		Token      string `yaml:"token"`
@@ -145,22 +182,41 @@ func (c *Config) Write() error {
 		Namespace  string `yaml:"namespace,omitempty"`
 	}{
 		Vault:      v.URL,
-		Token:      v.Token,
 		SkipVerify: v.SkipVerify,
 		CACerts:    strings.Join(v.CACerts, "\n"),
 		Namespace:  v.Namespace,
 	}
+	if store == nil {
+		sv.Token = v.Token
+	}
 	b, err = yaml.Marshal(sv)
 	if err != nil {
 		return err
 	}
 	if c.Options.ManageVaultToken {
-		ioutil.WriteFile(fmt.Sprintf("%s/.vault-token", userHomeDir()), []byte(v.Token), 0600)
+		if store == nil {
+			WriteVaultToken(v.Token)
+		} else if v.loaded && !warnedVaultToken {
+			//That would put it right back in plain text
+			warnedVaultToken = true
+			fmt.Fprintf(os.Stderr, "@Y{Not writing the token for} @C{%s} @Y{to ~/.vault-token, since it is kept in its %s token store}\n", c.aliasOf(v), v.TokenStore)
+		}
 	}
 
 	return ioutil.WriteFile(svtoken(), b, 0600)
 }
 
+// warnedVaultToken is set once it has been pointed out that a token was
+// not written to ~/.vault-token, so that it's only pointed out once.
+var warnedVaultToken bool
+
+// WriteVaultToken saves token in ~/.vault-token, where the Vault CLI (and
+// safe, when there is no target) looks for it, and returns that path.
+func WriteVaultToken(token string) (string, error) {
+	file := fmt.Sprintf("%s/.vault-token", userHomeDir())
+	return file, ioutil.WriteFile(file, []byte(token), 0600)
+}
+
 //Returns the path of the file that the certificates were written into
 func writeTempCACerts(certs []string) (string, error) {
 	cleanupLock.Lock()
@@ -180,27 +236,23 @@ func writeTempCACerts(certs []string) (string, error) {
 
 	toCleanup = append(toCleanup, caFile.Name())
 
-	go func() {
-		sigChan := make(chan os.Signal)
-		signal.Notify(sigChan, os.Interrupt)
-		<-sigChan
-		Cleanup()
-		os.Exit(1)
-	}()
-
 	return caFile.Name(), nil
 }
 
 func (c *Config) Apply(use string) error {
 	v, err := c.Vault(use)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "@R{!!! %s}\n", err)
-		os.Exit(1)
+		return err
 	}
 
+	applied = c.aliasOf(v)
 	if v != nil {
+		token, err := v.token(applied)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "@Y{%s}\n", err)
+		}
 		os.Setenv("VAULT_ADDR", v.URL)
-		os.Setenv("VAULT_TOKEN", v.Token)
+		os.Setenv("VAULT_TOKEN", token)
 		if v.SkipVerify {
 			os.Setenv("VAULT_SKIP_VERIFY", "1")
 		}
@@ -214,6 +266,10 @@ func (c *Config) Apply(use string) error {
 		if v.Namespace != "" {
 			os.Setenv("VAULT_NAMESPACE", v.Namespace)
 		}
+		if v.ClientCert != "" {
+			os.Setenv("VAULT_CLIENT_CERT", v.ClientCert)
+			os.Setenv("VAULT_CLIENT_KEY", v.ClientKey)
+		}
 	} else {
 		if os.Getenv("VAULT_TOKEN") == "" {
 			tokenFile := fmt.Sprintf("%s/.vault-token", os.Getenv("HOME"))
@@ -248,15 +304,74 @@ func (c *Config) SetTarget(alias string, config Vault) error {
 
 	c.Current = alias
 	if existingAlias, found := c.Vaults[alias]; found {
+		config.TokenStore = existingAlias.TokenStore
 		if config.URL == existingAlias.URL {
-			config.Token = existingAlias.Token
+			token, err := existingAlias.token(alias)
+			if err != nil {
+				return err
+			}
+			config.Token = token
 		}
+		/* a new URL means that the old token (wherever it is) has to go */
+		config.loaded = true
 	}
 
 	c.Vaults[alias] = &config
 	return nil
 }
 
+// SetTokenStore switches the target aliased as alias over to keeping its
+// token in store (see TokenStore), moving the token it has across.
+func (c *Config) SetTokenStore(alias, store string) error {
+	v, ok := c.Vaults[alias]
+	if !ok {
+		return fmt.Errorf("Unknown target '%s'", alias)
+	}
+	if err := ValidTokenStore(store); err != nil {
+		return err
+	}
+	if store == "saferc" {
+		store = ""
+	}
+	if store == v.TokenStore {
+		return nil
+	}
+
+	token, err := v.token(alias)
+	if err != nil {
+		return err
+	}
+	old, _ := v.store()
+
+	v.TokenStore, v.Token, v.loaded = store, token, true
+	if s, _ := v.store(); s != nil && token != "" {
+		if err := s.Store(alias, v, token); err != nil {
+			return fmt.Errorf("unable to save the token for '%s' in its %s token store: %s", alias, store, err)
+		}
+	}
+	if old != nil && token != "" {
+		return old.Store(alias, v, "")
+	}
+	return nil
+}
+
+// Forget removes the target aliased as alias, and its token, wherever that
+// is kept.
+func (c *Config) Forget(alias string) error {
+	if v, ok := c.Vaults[alias]; ok {
+		if store, _ := v.store(); store != nil {
+			if err := store.Store(alias, v, ""); err != nil {
+				return fmt.Errorf("unable to remove the token for '%s' from its %s token store: %s", alias, v.TokenStore, err)
+			}
+		}
+	}
+	delete(c.Vaults, alias)
+	if c.Current == alias {
+		c.Current = ""
+	}
+	return nil
+}
+
 func (c *Config) SetToken(token string) error {
 	if c.Current == "" {
 		return fmt.Errorf("No target selected")
@@ -265,7 +380,7 @@ func (c *Config) SetToken(token string) error {
 	if !ok {
 		return fmt.Errorf("Unknown target '%s'", c.Current)
 	}
-	v.Token = token
+	v.Token, v.loaded = token, true
 	return nil
 }
 
@@ -297,6 +412,20 @@ func (c *Config) CACerts() []string {
 	return nil
 }
 
+func (c *Config) ClientCert() (cert, key string) {
+	if v, ok, _ := c.Find(c.Current); ok {
+		return v.ClientCert, v.ClientKey
+	}
+	return "", ""
+}
+
+func (c *Config) TokenStore() string {
+	if v, ok, _ := c.Find(c.Current); ok {
+		return v.TokenStore
+	}
+	return ""
+}
+
 func (c *Config) Namespace() string {
 	if v, ok, _ := c.Find(c.Current); ok {
 		return v.Namespace
@@ -304,6 +433,17 @@ func (c *Config) Namespace() string {
 	return ""
 }
 
+// aliasOf returns the alias of a target, which is what its token is kept
+// under, in token stores.
+func (c *Config) aliasOf(v *Vault) string {
+	for alias, maybe := range c.Vaults {
+		if maybe == v {
+			return alias
+		}
+	}
+	return ""
+}
+
 func (c *Config) Find(alias string) (*Vault, bool, error) {
 	if v, ok := c.Vaults[alias]; ok {
 		return v, true, nil
@@ -349,7 +489,8 @@ func (c *Config) Vault(which string) (*Vault, error) {
 }
 
 //Cleanup will clean up any temporary files that the rc package may have made.
-// Cleanup is thread-safe and can be called multiple times.
+// Cleanup is thread-safe and can be called multiple times.  Programs using
+// the package must call it before exiting, including on signals.
 func Cleanup() {
 	cleanupLock.Lock()
 	for _, filename := range toCleanup {
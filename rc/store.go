@@ -0,0 +1,313 @@
+package rc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	fmt "github.com/jhunt/go-ansi"
+	"github.com/mattn/go-isatty"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/starkandwayne/safe/prompt"
+)
+
+// Unattended stops token stores from prompting for anything, for when
+// there is no one there to answer (like while completing a command).
+var Unattended bool
+
+// A TokenStore keeps the tokens of targets somewhere other than in plain
+// text, in ~/.saferc.  Storing an empty token removes it.
+type TokenStore interface {
+	Get(alias string, v *Vault) (string, error)
+	Store(alias string, v *Vault, token string) error
+}
+
+// store returns where the token of the target is kept, or nil if it's kept
+// in ~/.saferc.
+func (v *Vault) store() (TokenStore, error) {
+	switch {
+	case v.TokenStore == "" || v.TokenStore == "saferc":
+		return nil, nil
+	case v.TokenStore == "encrypted":
+		return encryptedStore{}, nil
+	case strings.HasPrefix(v.TokenStore, "helper:"):
+		return helperStore{command: strings.TrimPrefix(v.TokenStore, "helper:")}, nil
+	}
+	return nil, fmt.Errorf("unknown token store '%s' (should be one of saferc, encrypted or helper:COMMAND)", v.TokenStore)
+}
+
+// ValidTokenStore returns an error if store isn't one that safe knows of.
+func ValidTokenStore(store string) error {
+	_, err := (&Vault{TokenStore: store}).store()
+	return err
+}
+
+// token returns the token of the target aliased as alias, fetching it from
+// its store the first time round.
+func (v *Vault) token(alias string) (string, error) {
+	store, err := v.store()
+	if err != nil || store == nil || v.loaded {
+		return v.Token, err
+	}
+	token, err := store.Get(alias, v)
+	if err != nil {
+		return "", fmt.Errorf("unable to get the token for '%s' from its %s token store: %s", alias, v.TokenStore, err)
+	}
+	v.Token, v.loaded = token, true
+	return token, nil
+}
+
+// tokenFile is where the encrypted token store lives.
+func tokenFile() string {
+	if file := os.Getenv("SAFE_TOKEN_FILE"); file != "" {
+		return file
+	}
+	return fmt.Sprintf("%s/.safe_tokens", userHomeDir())
+}
+
+// encryptedStore keeps every target's token in one file, encrypted with a
+// key derived either from the contents of $SAFE_TOKEN_KEY_FILE (any file
+// of random bytes, like an age identity, will do), or from a passphrase,
+// from $SAFE_TOKEN_PASSPHRASE or, failing that, typed in.  The file stays
+// encrypted the way it was first encrypted unless $SAFE_TOKEN_KDF says
+// otherwise.
+type encryptedStore struct{}
+
+type encryptedTokens struct {
+	KDF   string `json:"kdf"`
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Box   []byte `json:"box"`
+}
+
+// passphrase is remembered, so that it's only asked for once.
+var passphrase string
+
+// tokenKDF works out how the key of the encrypted token store should be
+// derived, when writing it: as $SAFE_TOKEN_KDF says, if it's set, or as
+// it was before (current), or, for a new store, from $SAFE_TOKEN_KEY_FILE,
+// if that's set, and a passphrase otherwise.
+func tokenKDF(current string) (string, error) {
+	switch kdf := os.Getenv("SAFE_TOKEN_KDF"); kdf {
+	case "":
+	case "keyfile":
+		return kdf, nil
+	case "passphrase", "scrypt":
+		return "scrypt", nil
+	default:
+		return "", fmt.Errorf("unknown $SAFE_TOKEN_KDF '%s' (should be passphrase or keyfile)", kdf)
+	}
+	if current != "" {
+		return current, nil
+	}
+	if os.Getenv("SAFE_TOKEN_KEY_FILE") != "" {
+		return "keyfile", nil
+	}
+	return "scrypt", nil
+}
+
+func tokenKey(kdf string, salt []byte, confirm bool) (*[32]byte, error) {
+	var key [32]byte
+	switch kdf {
+	case "keyfile":
+		file := os.Getenv("SAFE_TOKEN_KEY_FILE")
+		if file == "" {
+			return nil, fmt.Errorf("%s was encrypted with a key file; set $SAFE_TOKEN_KEY_FILE to its path", tokenFile())
+		}
+		secret, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte("safe tokens")), key[:]); err != nil {
+			return nil, err
+		}
+
+	case "scrypt":
+		pass := os.Getenv("SAFE_TOKEN_PASSPHRASE")
+		if pass == "" && passphrase == "" {
+			if Unattended || !isatty.IsTerminal(os.Stdin.Fd()) {
+				return nil, fmt.Errorf("no passphrase for %s; set $SAFE_TOKEN_PASSPHRASE, or $SAFE_TOKEN_KEY_FILE", tokenFile())
+			}
+			passphrase = prompt.Secure("Passphrase for @C{%s}: ", tokenFile())
+			if confirm && prompt.Secure("Passphrase for @C{%s} @Y{(again)}: ", tokenFile()) != passphrase {
+				passphrase = ""
+				return nil, fmt.Errorf("passphrases do not match")
+			}
+			if passphrase == "" {
+				return nil, fmt.Errorf("no passphrase given")
+			}
+		}
+		if pass == "" {
+			pass = passphrase
+		}
+		k, err := scrypt.Key([]byte(pass), salt, 1<<15, 8, 1, 32)
+		if err != nil {
+			return nil, err
+		}
+		copy(key[:], k)
+
+	default:
+		return nil, fmt.Errorf("%s was encrypted in a way (%s) that this version of safe does not understand", tokenFile(), kdf)
+	}
+	return &key, nil
+}
+
+// read decrypts the token store, and returns the tokens in it, and how
+// its key was derived (or nothing, if there is no store yet).
+func (encryptedStore) read() (map[string]string, string, error) {
+	tokens := map[string]string{}
+	b, err := ioutil.ReadFile(tokenFile())
+	if os.IsNotExist(err) {
+		return tokens, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	var enc encryptedTokens
+	if err = json.Unmarshal(b, &enc); err != nil || len(enc.Nonce) != 24 {
+		return nil, "", fmt.Errorf("%s is corrupt", tokenFile())
+	}
+	key, err := tokenKey(enc.KDF, enc.Salt, false)
+	if err != nil {
+		return nil, "", err
+	}
+	var nonce [24]byte
+	copy(nonce[:], enc.Nonce)
+	plain, ok := secretbox.Open(nil, enc.Box, &nonce, key)
+	if !ok {
+		if enc.KDF == "scrypt" {
+			passphrase = ""
+		}
+		return nil, "", fmt.Errorf("unable to decrypt %s (wrong passphrase or key file?)", tokenFile())
+	}
+	if err = json.Unmarshal(plain, &tokens); err != nil {
+		return nil, "", fmt.Errorf("%s is corrupt", tokenFile())
+	}
+	return tokens, enc.KDF, nil
+}
+
+// write encrypts tokens into the token store, with a fresh salt and nonce,
+// and a key derived as kdf says.  Unless confirm is false, a passphrase
+// that has to be typed in is asked for twice.
+func (s encryptedStore) write(tokens map[string]string, kdf string, confirm bool) error {
+	enc := encryptedTokens{KDF: kdf, Salt: make([]byte, 32), Nonce: make([]byte, 24)}
+	if _, err := rand.Read(enc.Salt); err != nil {
+		return err
+	}
+	if _, err := rand.Read(enc.Nonce); err != nil {
+		return err
+	}
+	key, err := tokenKey(enc.KDF, enc.Salt, confirm)
+	if err != nil {
+		return err
+	}
+
+	plain, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	copy(nonce[:], enc.Nonce)
+	enc.Box = secretbox.Seal(nil, plain, &nonce, key)
+
+	b, err := json.Marshal(enc)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tokenFile(), b, 0600)
+}
+
+func (s encryptedStore) Get(alias string, v *Vault) (string, error) {
+	tokens, _, err := s.read()
+	if err != nil {
+		return "", err
+	}
+	return tokens[alias], nil
+}
+
+func (s encryptedStore) Store(alias string, v *Vault, token string) error {
+	tokens, current, err := s.read()
+	if err != nil {
+		return err
+	}
+	kdf, err := tokenKDF(current)
+	if err != nil {
+		return err
+	}
+	//Writing the store again is also how it gets encrypted a new way
+	if tokens[alias] == token && (current == "" || kdf == current) {
+		return nil
+	}
+	if token == "" {
+		delete(tokens, alias)
+	} else {
+		tokens[alias] = token
+	}
+	return s.write(tokens, kdf, kdf != current)
+}
+
+// helperStore hands tokens to (and gets them from) a credential helper: a
+// program, run through the shell, with one argument (get, store or erase),
+// that reads a description of the target from its standard input as
+// key=value lines, ending with a blank line:
+//
+//	alias=prod
+//	url=https://vault.example.com
+//	namespace=
+//	token=s.xyzzy            (for store only)
+//
+// To get, it prints `token=...' to its standard output, or nothing if it
+// doesn't have a token for the target.
+type helperStore struct {
+	command string
+}
+
+func (h helperStore) Get(alias string, v *Vault) (string, error) {
+	out, err := runHelper(h.command, "get", alias, v.URL, v.Namespace)
+	return out["token"], err
+}
+
+func (h helperStore) Store(alias string, v *Vault, token string) error {
+	if token == "" {
+		_, err := runHelper(h.command, "erase", alias, v.URL, v.Namespace)
+		return err
+	}
+	_, err := runHelper(h.command, "store", alias, v.URL, v.Namespace, "token="+token)
+	return err
+}
+
+// runHelper runs a credential helper, handing it the target and any other
+// key=value lines given, and returns the key=value lines that it prints.
+func runHelper(command, action, alias, url, namespace string, lines ...string) (map[string]string, error) {
+	var in bytes.Buffer
+	fmt.Fprintf(&in, "alias=%s\nurl=%s\nnamespace=%s\n", alias, url, namespace)
+	for _, line := range lines {
+		fmt.Fprintf(&in, "%s\n", line)
+	}
+	in.WriteString("\n")
+
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", command+` "$@"`, command, action)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = &in, &out, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("`%s %s' failed: %s", command, action, err)
+	}
+
+	values := map[string]string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if kv := strings.SplitN(strings.TrimSpace(line), "=", 2); len(kv) == 2 {
+			values[kv[0]] = kv[1]
+		}
+	}
+	return values, nil
+}
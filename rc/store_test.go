@@ -0,0 +1,253 @@
+package rc_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/safe/rc"
+)
+
+var _ = Describe("Token stores", func() {
+	var home string
+	var saved map[string]*string
+
+	env := []string{
+		"HOME", "SAFE_TOKEN_FILE", "SAFE_TOKEN_PASSPHRASE", "SAFE_TOKEN_KEY_FILE", "SAFE_TOKEN_KDF",
+		"VAULT_ADDR", "VAULT_TOKEN", "VAULT_SKIP_VERIFY", "VAULT_NAMESPACE",
+	}
+
+	BeforeEach(func() {
+		saved = map[string]*string{}
+		for _, name := range env {
+			if value, ok := os.LookupEnv(name); ok {
+				saved[name] = &value
+			} else {
+				saved[name] = nil
+			}
+			os.Unsetenv(name)
+		}
+
+		var err error
+		home, err = ioutil.TempDir("", "safe-rc-test")
+		Expect(err).NotTo(HaveOccurred())
+		os.Setenv("HOME", home)
+		rc.Unattended = true
+	})
+
+	AfterEach(func() {
+		for name, value := range saved {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+		os.RemoveAll(home)
+	})
+
+	file := func(name string) string {
+		return filepath.Join(home, name)
+	}
+	contents := func(name string) string {
+		b, err := ioutil.ReadFile(file(name))
+		Expect(err).NotTo(HaveOccurred())
+		return string(b)
+	}
+
+	// target saves a target aliased as prod, with the given token store
+	// and token.
+	target := func(store, token string) {
+		cfg := rc.Read()
+		Expect(cfg.SetTarget("prod", rc.Vault{URL: "https://vault.example.com"})).To(Succeed())
+		Expect(cfg.SetTokenStore("prod", store)).To(Succeed())
+		Expect(cfg.SetToken(token)).To(Succeed())
+		Expect(cfg.Write()).To(Succeed())
+	}
+	// token reads the token of the target aliased as prod back.
+	token := func() string {
+		cfg := rc.Read()
+		Expect(cfg.Apply("prod")).To(Succeed())
+		return os.Getenv("VAULT_TOKEN")
+	}
+	// encrypted returns how the encrypted token store is encrypted.
+	encrypted := func() (kdf string, salt, nonce, box []byte) {
+		var enc struct {
+			KDF   string `json:"kdf"`
+			Salt  []byte `json:"salt"`
+			Nonce []byte `json:"nonce"`
+			Box   []byte `json:"box"`
+		}
+		Expect(json.Unmarshal([]byte(contents(".safe_tokens")), &enc)).To(Succeed())
+		return enc.KDF, enc.Salt, enc.Nonce, enc.Box
+	}
+
+	It("keeps tokens in ~/.saferc by default", func() {
+		target("saferc", "s.plain")
+		Expect(contents(".saferc")).To(ContainSubstring("s.plain"))
+		Expect(token()).To(Equal("s.plain"))
+	})
+
+	Context("that are encrypted with a passphrase", func() {
+		BeforeEach(func() {
+			os.Setenv("SAFE_TOKEN_PASSPHRASE", "sekrit")
+		})
+
+		It("keeps tokens out of ~/.saferc and ~/.svtoken", func() {
+			target("encrypted", "s.scrypt")
+			Expect(contents(".saferc")).NotTo(ContainSubstring("s.scrypt"))
+			Expect(contents(".svtoken")).NotTo(ContainSubstring("s.scrypt"))
+			Expect(contents(".safe_tokens")).NotTo(ContainSubstring("s.scrypt"))
+			Expect(token()).To(Equal("s.scrypt"))
+		})
+
+		It("derives the key with scrypt, from a fresh salt every time", func() {
+			target("encrypted", "s.first")
+			kdf, salt, nonce, box := encrypted()
+			Expect(kdf).To(Equal("scrypt"))
+			Expect(salt).To(HaveLen(32))
+			Expect(nonce).To(HaveLen(24))
+
+			target("encrypted", "s.second")
+			_, salt2, nonce2, box2 := encrypted()
+			Expect(salt2).NotTo(Equal(salt))
+			Expect(nonce2).NotTo(Equal(nonce))
+			Expect(box2).NotTo(Equal(box))
+			Expect(token()).To(Equal("s.second"))
+		})
+
+		It("refuses to open the store with the wrong passphrase", func() {
+			target("encrypted", "s.scrypt")
+			os.Setenv("SAFE_TOKEN_PASSPHRASE", "wrong")
+			cfg := rc.Read()
+			Expect(cfg.SetTokenStore("prod", "saferc")).To(MatchError(ContainSubstring("wrong passphrase or key file")))
+		})
+
+		It("refuses to go on without a passphrase, when there's no one to ask", func() {
+			os.Unsetenv("SAFE_TOKEN_PASSPHRASE")
+			cfg := rc.Read()
+			Expect(cfg.SetTarget("prod", rc.Vault{URL: "https://vault.example.com"})).To(Succeed())
+			Expect(cfg.SetToken("s.scrypt")).To(Succeed())
+			Expect(cfg.SetTokenStore("prod", "encrypted")).To(MatchError(ContainSubstring("no passphrase")))
+		})
+
+		It("stays encrypted with a passphrase when there is a key file too", func() {
+			target("encrypted", "s.first")
+			Expect(ioutil.WriteFile(file("key"), []byte("random bytes"), 0600)).To(Succeed())
+			os.Setenv("SAFE_TOKEN_KEY_FILE", file("key"))
+			target("encrypted", "s.second")
+
+			kdf, _, _, _ := encrypted()
+			Expect(kdf).To(Equal("scrypt"))
+			Expect(token()).To(Equal("s.second"))
+		})
+
+		It("switches to a key file when told to", func() {
+			target("encrypted", "s.scrypt")
+			Expect(ioutil.WriteFile(file("key"), []byte("random bytes"), 0600)).To(Succeed())
+			os.Setenv("SAFE_TOKEN_KEY_FILE", file("key"))
+			os.Setenv("SAFE_TOKEN_KDF", "keyfile")
+			cfg := rc.Read()
+			Expect(cfg.Apply("prod")).To(Succeed())
+			Expect(cfg.Write()).To(Succeed())
+
+			kdf, _, _, _ := encrypted()
+			Expect(kdf).To(Equal("keyfile"))
+			os.Unsetenv("SAFE_TOKEN_PASSPHRASE")
+			Expect(token()).To(Equal("s.scrypt"))
+		})
+	})
+
+	Context("that are encrypted with a key file", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(file("key"), []byte("random bytes"), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(file("other"), []byte("other bytes"), 0600)).To(Succeed())
+			os.Setenv("SAFE_TOKEN_KEY_FILE", file("key"))
+		})
+
+		It("derives the key from the contents of the key file", func() {
+			target("encrypted", "s.keyfile")
+			kdf, _, _, _ := encrypted()
+			Expect(kdf).To(Equal("keyfile"))
+			Expect(contents(".safe_tokens")).NotTo(ContainSubstring("s.keyfile"))
+			Expect(token()).To(Equal("s.keyfile"))
+		})
+
+		It("refuses to open the store with a different key file", func() {
+			target("encrypted", "s.keyfile")
+			os.Setenv("SAFE_TOKEN_KEY_FILE", file("other"))
+			cfg := rc.Read()
+			Expect(cfg.SetTokenStore("prod", "saferc")).To(MatchError(ContainSubstring("wrong passphrase or key file")))
+		})
+
+		It("refuses to open the store without a key file", func() {
+			target("encrypted", "s.keyfile")
+			os.Unsetenv("SAFE_TOKEN_KEY_FILE")
+			cfg := rc.Read()
+			Expect(cfg.SetTokenStore("prod", "saferc")).To(MatchError(ContainSubstring("set $SAFE_TOKEN_KEY_FILE")))
+		})
+
+		It("keeps the tokens of other targets", func() {
+			target("encrypted", "s.prod")
+			cfg := rc.Read()
+			Expect(cfg.SetTarget("dev", rc.Vault{URL: "https://dev.example.com"})).To(Succeed())
+			Expect(cfg.SetTokenStore("dev", "encrypted")).To(Succeed())
+			Expect(cfg.SetToken("s.dev")).To(Succeed())
+			Expect(cfg.Write()).To(Succeed())
+
+			Expect(token()).To(Equal("s.prod"))
+			cfg = rc.Read()
+			Expect(cfg.Forget("prod")).To(Succeed())
+			Expect(cfg.Apply("dev")).To(Succeed())
+			Expect(os.Getenv("VAULT_TOKEN")).To(Equal("s.dev"))
+		})
+	})
+
+	Context("that are credential helpers", func() {
+		var helper string
+
+		BeforeEach(func() {
+			helper = file("helper")
+			Expect(ioutil.WriteFile(helper, []byte(`#!/bin/sh
+dir=$(dirname "$0")
+cat > "$dir/$1.in"
+case "$1" in
+get)   test -f "$dir/token" && echo "token=$(cat "$dir/token")" ;;
+store) sed -n 's/^token=//p' "$dir/store.in" > "$dir/token" ;;
+erase) rm -f "$dir/token" ;;
+esac
+`), 0700)).To(Succeed())
+		})
+
+		It("hands tokens to the helper to store, describing the target", func() {
+			target("helper:"+helper, "s.helper")
+			Expect(contents("store.in")).To(Equal("alias=prod\nurl=https://vault.example.com\nnamespace=\ntoken=s.helper\n\n"))
+			Expect(contents("token")).To(Equal("s.helper\n"))
+			Expect(contents(".saferc")).NotTo(ContainSubstring("s.helper"))
+		})
+
+		It("gets tokens from the helper", func() {
+			target("helper:"+helper, "s.helper")
+			Expect(token()).To(Equal("s.helper"))
+			Expect(contents("get.in")).To(Equal("alias=prod\nurl=https://vault.example.com\nnamespace=\n\n"))
+		})
+
+		It("has the helper erase the tokens of targets that are forgotten", func() {
+			target("helper:"+helper, "s.helper")
+			cfg := rc.Read()
+			Expect(cfg.Forget("prod")).To(Succeed())
+			Expect(contents("erase.in")).To(Equal("alias=prod\nurl=https://vault.example.com\nnamespace=\n\n"))
+			Expect(file("token")).NotTo(BeAnExistingFile())
+		})
+
+		It("fails when the helper does", func() {
+			cfg := rc.Read()
+			Expect(cfg.SetTarget("prod", rc.Vault{URL: "https://vault.example.com"})).To(Succeed())
+			Expect(cfg.SetToken("s.helper")).To(Succeed())
+			Expect(cfg.SetTokenStore("prod", "helper:exit 3")).To(MatchError(ContainSubstring("`exit 3 store' failed")))
+		})
+	})
+})
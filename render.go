@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	fmt "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// templateCert is what the `cert` template function returns: everything that
+// `safe x509 show --json` knows about the certificate, plus its PEM blocks.
+type templateCert struct {
+	certOutput
+	Certificate string
+	Key         string
+	Combined    string
+}
+
+// secretRenderer resolves the secrets referenced by a template, reading each
+// one from the Vault only once.
+type secretRenderer struct {
+	v     *vault.Vault
+	cache map[string]*vault.Secret
+}
+
+func (r *secretRenderer) read(path string) (*vault.Secret, error) {
+	if s, ok := r.cache[path]; ok {
+		return s, nil
+	}
+	s, err := r.v.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	r.cache[path] = s
+	return s, nil
+}
+
+func (r *secretRenderer) secret(path string) (string, error) {
+	secret, key, version := vault.ParsePath(path)
+	if key == "" {
+		return "", fmt.Errorf("secret \"%s\" needs a path:key (use secrets to get every key)", path)
+	}
+	s, err := r.read(vault.EncodePath(secret, "", version))
+	if err != nil {
+		return "", err
+	}
+	if !s.Has(key) {
+		return "", vault.NewKeyNotFoundError(secret, key)
+	}
+	return s.Get(key), nil
+}
+
+func (r *secretRenderer) secrets(path string) (map[string]string, error) {
+	if vault.PathHasKey(path) {
+		return nil, fmt.Errorf("secrets \"%s\" takes a path without a key (use secret to get just one)", path)
+	}
+	s, err := r.read(path)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	for _, key := range s.Keys() {
+		m[key] = s.Get(key)
+	}
+	return m, nil
+}
+
+func (r *secretRenderer) cert(path string) (*templateCert, error) {
+	s, err := r.read(path)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := s.X509(false)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &templateCert{
+		certOutput:  newCertOutput(path, cert),
+		Certificate: s.Get("certificate"),
+		Key:         s.Get("key"),
+		Combined:    s.Get("combined"),
+	}, nil
+}
+
+// renderTemplate executes the Go text/template in src, with the secret,
+// secrets and cert functions looking things up in the Vault.  Any reference
+// to something that isn't there is an error, and no output is returned.
+func renderTemplate(v *vault.Vault, name string, src []byte) ([]byte, error) {
+	r := &secretRenderer{v: v, cache: make(map[string]*vault.Secret)}
+	t, err := template.New(name).Option("missingkey=error").Funcs(template.FuncMap{
+		"secret":  r.secret,
+		"secrets": r.secrets,
+		"cert":    r.cert,
+	}).Parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := t.Execute(&out, nil); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// writeSecretFile writes b to file with the given mode, regardless of the
+// umask.  The file is replaced atomically, so no one ever sees it half
+// written, or with looser permissions.
+func writeSecretFile(file string, b []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"time"
+
+	fmt "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// signedBy checks whether cert was issued by ca.  A certificate counts if
+// ca's key signed it, or if it names ca as its issuer -- the latter so that
+// leaves still get picked up after their CA has been reissued with a new key.
+func signedBy(cert, ca *vault.X509) bool {
+	if cert.Certificate.CheckSignatureFrom(ca.Certificate) == nil {
+		return true
+	}
+	return bytes.Equal(cert.Certificate.RawIssuer, ca.Certificate.RawSubject)
+}
+
+// renewSignedBy renews every certificate underneath root that was issued by
+// the CA at caPath, keeping each one's subject, SANs, key usages and (unless
+// a ttl is given) lifetime.
+func renewSignedBy(v *vault.Vault, root, caPath, ttl, sigAlgorithm string) error {
+	caPath = vault.Canonicalize(caPath)
+	s, err := v.Read(caPath)
+	if err != nil {
+		return err
+	}
+	ca, err := s.X509(true)
+	if err != nil {
+		return err
+	}
+
+	var sigAlgo x509.SignatureAlgorithm
+	if sigAlgorithm != "" {
+		if sigAlgo, err = vault.TranslateSignatureAlgorithm(sigAlgorithm); err != nil {
+			return err
+		}
+	}
+
+	var lifetime time.Duration
+	if ttl != "" {
+		if lifetime, err = duration(ttl); err != nil {
+			return err
+		}
+	}
+
+	secrets, err := v.ConstructSecrets(root, vault.TreeOpts{FetchKeys: true})
+	if err != nil {
+		return err
+	}
+
+	var renewed, skipped int
+	for _, secret := range secrets {
+		if len(secret.Versions) == 0 || secret.Path == caPath {
+			continue
+		}
+		data := secret.Versions[len(secret.Versions)-1].Data
+		if cert, e := data.X509(false); e != nil || !signedBy(cert, ca) {
+			continue
+		}
+		cert, e := data.X509(true)
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "@Y{skipping} @C{%s}@Y{: %s}\n", secret.Path, e)
+			skipped++
+			continue
+		}
+
+		if sigAlgo != x509.UnknownSignatureAlgorithm {
+			cert.Certificate.SignatureAlgorithm = sigAlgo
+		}
+		life := lifetime
+		if life == 0 {
+			life = cert.Certificate.NotAfter.Sub(cert.Certificate.NotBefore)
+		}
+		was := cert.ExpiryString()
+
+		if err = ca.Sign(cert, life); err != nil {
+			err = fmt.Errorf("unable to renew %s: %s", secret.Path, err)
+			break
+		}
+		if err = cert.SaveTo(v, secret.Path, false); err != nil {
+			err = fmt.Errorf("unable to save renewed %s: %s", secret.Path, err)
+			break
+		}
+		renewed++
+		fmt.Printf("@G{renewed} @C{%s} (%s): expiry @Y{%s} => @G{%s}\n", secret.Path, cert.Subject(), was, cert.ExpiryString())
+	}
+
+	//Every renewal bumps the CA's serial number, so save it even if we
+	// failed part way through.
+	if renewed > 0 {
+		if saveErr := ca.SaveTo(v, caPath, false); saveErr != nil && err == nil {
+			err = fmt.Errorf("unable to save the serial number of %s: %s", caPath, saveErr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "\nrenewed %d certificates signed by %s", renewed, caPath)
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, " (%d skipped)", skipped)
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	return nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	fmt "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// A rotation is a secret that is past its age, and what `safe rotate` will
+// (or did) do about it.
+type rotation struct {
+	Path   string   `json:"path"`
+	Kind   string   `json:"kind"`
+	Keys   []string `json:"keys,omitempty"`
+	Age    string   `json:"age,omitempty"`
+	MaxAge string   `json:"max_age"`
+	Status string   `json:"status"`
+	Reason string   `json:"reason,omitempty"`
+
+	passwords map[string]vault.PasswordGenerator
+	entries   []*manifestEntry
+}
+
+const (
+	rotationDue     = "due"
+	rotationRotated = "rotated"
+	rotationSkipped = "skipped"
+	rotationFailed  = "failed"
+)
+
+// formatAge rounds an age to the nearest day, or hour for young secrets.
+func formatAge(d time.Duration) string {
+	if d < 48*time.Hour {
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+// findRotations walks each of the given paths, and works out how to rotate
+// every secret older than its rotation-interval metadata tag, or (if it
+// doesn't have one) olderThan.  Entries in the manifest say exactly how to
+// regenerate a secret; failing that, the secret itself and its metadata
+// tags (see infer) are used.
+func findRotations(v *vault.Vault, paths []string, olderThan string, m *manifest) (rotations []*rotation, checked int, err error) {
+	rotations = []*rotation{}
+	entries := make(map[string][]*manifestEntry)
+	if m != nil {
+		for i := range m.Secrets {
+			e := &m.Secrets[i]
+			entries[e.secret] = append(entries[e.secret], e)
+		}
+	}
+
+	for _, path := range paths {
+		secrets, err := v.ConstructSecrets(path, vault.TreeOpts{FetchKeys: true, FetchMetadata: true})
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, s := range secrets {
+			if len(s.Versions) == 0 {
+				continue
+			}
+			checked++
+
+			maxAge := olderThan
+			if s.Metadata != nil && s.Metadata.CustomMetadata["rotation-interval"] != "" {
+				maxAge = s.Metadata.CustomMetadata["rotation-interval"]
+			}
+			if maxAge == "" {
+				continue
+			}
+			limit, err := duration(maxAge)
+			if err != nil {
+				return nil, 0, fmt.Errorf("%s: %s", s.Path, err)
+			}
+
+			latest := s.Versions[len(s.Versions)-1]
+			r := &rotation{Path: s.Path, MaxAge: maxAge, Status: rotationDue}
+			if latest.CreatedAt.IsZero() {
+				r.Kind = "secret"
+				r.Status, r.Reason = rotationSkipped, "KV v1 backends don't record when secrets were written"
+				rotations = append(rotations, r)
+				continue
+			}
+			age := time.Since(latest.CreatedAt)
+			if age < limit {
+				continue
+			}
+			r.Age = formatAge(age)
+
+			if es, ok := entries[s.Path]; ok {
+				r.Kind, r.entries = "manifest", es
+				for _, e := range es {
+					if e.key != "" {
+						r.Keys = append(r.Keys, e.key)
+					}
+				}
+			} else if err := r.infer(latest.Data, s.Metadata); err != nil {
+				r.Status, r.Reason = rotationSkipped, err.Error()
+			}
+			rotations = append(rotations, r)
+		}
+	}
+	return rotations, checked, nil
+}
+
+// generatorTag is the metadata tag that `safe gen --remember' leaves on the
+// secrets it writes to in KV v2 backends, saying how it generated the
+// password in key, so that it can be rotated into another one just like it.
+func generatorTag(key string) string {
+	return "rotate-generator:" + key
+}
+
+// rememberGenerator tags the secret at path with how the password in key
+// was generated.  Secrets in KV v1 backends have nowhere to keep that.
+func rememberGenerator(v *vault.Vault, path, key string, opts vault.PasswordOptions) error {
+	m, err := secretMetadata(v, path)
+	if err != nil || m == nil {
+		return err
+	}
+	b, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	if m.CustomMetadata[generatorTag(key)] == string(b) {
+		return nil
+	}
+	m.CustomMetadata[generatorTag(key)] = string(b)
+	return v.SetMetadata(path, *m)
+}
+
+// infer works out how to rotate a secret from what's in it, and its
+// metadata.  Passwords are regenerated the way their rotate-generator:KEY
+// tag says or, failing that, with the same length and classes of
+// characters (or the rotate-policy tag) as they have now.
+func (r *rotation) infer(data *vault.Secret, meta *vault.SecretMetadata) error {
+	switch {
+	case data.IsX509() && data.Has("key"):
+		r.Kind = "x509"
+		return nil
+	case data.Has("private") && data.Has("public") && data.Has("fingerprint"):
+		r.Kind = "ssh"
+		return nil
+	case data.Has("private") && data.Has("public"):
+		r.Kind = "rsa"
+		return nil
+	}
+
+	r.Kind = "password"
+	if meta == nil || meta.CustomMetadata["rotate-keys"] == "" {
+		return fmt.Errorf("not sure which keys to regenerate; set its rotate-keys metadata, or give a manifest")
+	}
+
+	r.passwords = make(map[string]vault.PasswordGenerator)
+	for _, key := range strings.Split(meta.CustomMetadata["rotate-keys"], ",") {
+		key = strings.TrimSpace(key)
+		if !data.Has(key) {
+			return fmt.Errorf("has no %s key to regenerate", key)
+		}
+		opts := vault.InferPasswordOptions(data.Get(key))
+		if spec := meta.CustomMetadata[generatorTag(key)]; spec != "" {
+			opts = vault.PasswordOptions{}
+			if err := json.Unmarshal([]byte(spec), &opts); err != nil {
+				return fmt.Errorf("cannot regenerate %s: its %s tag is malformed: %s", key, generatorTag(key), err)
+			}
+		}
+		if policy := meta.CustomMetadata["rotate-policy"]; policy != "" && (opts.Generator == "" || opts.Generator == vault.GeneratorRandom) {
+			opts.Policy = policy
+		}
+		gen, err := vault.NewPasswordGenerator(opts)
+		if err != nil {
+			return fmt.Errorf("cannot regenerate %s: %s", key, err)
+		}
+		r.Keys = append(r.Keys, key)
+		r.passwords[key] = gen
+	}
+	return nil
+}
+
+// rotate regenerates the secret.  Passwords keep their length and policy,
+// keys their type and strength, and certificates are renewed by their CA
+// with the same lifetime as before.
+func (r *rotation) rotate(v *vault.Vault) error {
+	if r.Kind == "manifest" {
+		for _, e := range r.entries {
+			if err := (planStep{Entry: e, Action: planRotate}).apply(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	s, err := v.Read(r.Path)
+	if err != nil {
+		return err
+	}
+
+	switch r.Kind {
+	case "x509":
+		cert, err := s.X509(true)
+		if err != nil {
+			return err
+		}
+		ca, caPath, err := v.FindSigningCA(cert, r.Path, "")
+		if err != nil {
+			return err
+		}
+		if err := ca.Sign(cert, cert.Certificate.NotAfter.Sub(cert.Certificate.NotBefore)); err != nil {
+			return err
+		}
+		if caPath != r.Path {
+			if err := ca.SaveTo(v, caPath, false); err != nil {
+				return err
+			}
+		}
+		return cert.SaveTo(v, r.Path, false)
+
+	case "ssh", "rsa":
+		keyType, bits, err := privateKeyStrength(s.Get("private"))
+		if err != nil {
+			return err
+		}
+		if r.Kind == "ssh" {
+			err = s.SSHKey(keyType, bits, false)
+		} else {
+			err = s.RSAKey(keyType, bits, false)
+		}
+		if err != nil {
+			return err
+		}
+
+	case "password":
+		for _, key := range r.Keys {
+			if err := s.Password(key, r.passwords[key], false); err != nil {
+				return err
+			}
+		}
+	}
+	return v.Write(r.Path, s)
+}
+
+func printRotations(rotations []*rotation, checked int) {
+	due := 0
+	t := table{}
+	for _, r := range rotations {
+		var status string
+		switch r.Status {
+		case rotationDue:
+			status = "@Y{would rotate}"
+		case rotationRotated:
+			status = "@G{rotated}"
+		case rotationSkipped:
+			status = "@M{skipped}"
+		case rotationFailed:
+			status = "@R{failed}"
+		}
+
+		what := r.Kind
+		if len(r.Keys) > 0 {
+			what = fmt.Sprintf("%s (%s)", r.Kind, strings.Join(r.Keys, ", "))
+		}
+		if r.Reason != "" {
+			what += ": " + r.Reason
+		}
+		age := fmt.Sprintf("%s old, max %s", r.Age, r.MaxAge)
+		if r.Age == "" {
+			age = fmt.Sprintf("age unknown, max %s", r.MaxAge)
+		} else {
+			due++
+		}
+		t.addRow(fmt.Sprintf(status), fmt.Sprintf("@C{%s}", r.Path), age, what)
+	}
+	t.print()
+	fmt.Fprintf(os.Stderr, "%d of %d secrets were due for rotation\n", due, checked)
+}
@@ -99,7 +99,7 @@ func (r *Runner) Help(out io.Writer, topic string) {
 	ansi.Fprintf(out, "@R{Unrecognized command or help topic '%s'}\n", topic)
 	fmt.Fprintf(out, "Try 'safe help' to get started with safe,\n")
 	fmt.Fprintf(out, " or 'safe commands' for a list of valid commands\n")
-	os.Exit(1)
+	exit(1)
 }
 
 func (r *Runner) ExitWithUsage(topic string) {
@@ -112,7 +112,14 @@ func (r *Runner) ExitWithUsage(topic string) {
 			}
 		}
 	}
-	os.Exit(1)
+	exit(1)
+}
+
+// IsDestructive tells whether command is one that changes things in the
+// Vault, going by its help topic.
+func (r *Runner) IsDestructive(command string) bool {
+	help, ok := r.Topics[command]
+	return ok && help != nil && help.Type == DestructiveCommand
 }
 
 func (r *Runner) Execute(command string, args ...string) error {
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+type searchHit struct {
+	Path  string
+	Key   string
+	Value string
+}
+
+// searchSecrets walks each of the given paths, and returns every key of
+// every secret for which match returns true.
+func searchSecrets(v *vault.Vault, paths []string, match func(path, key, value string) bool) ([]searchHit, error) {
+	hits := []searchHit{}
+	for _, path := range paths {
+		secrets, err := v.ConstructSecrets(path, vault.TreeOpts{FetchKeys: true})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, s := range secrets {
+			if len(s.Versions) == 0 {
+				continue
+			}
+			data := s.Versions[len(s.Versions)-1].Data
+			for _, key := range data.Keys() {
+				if match(s.Path, key, data.Get(key)) {
+					hits = append(hits, searchHit{Path: s.Path, Key: key, Value: data.Get(key)})
+				}
+			}
+		}
+	}
+	return hits, nil
+}
+
+// searchRegexp compiles a pattern given to `safe find` or `safe grep`.  Globs
+// are anchored, and their `*` and `?` match slashes as well; regular
+// expressions can match anywhere.
+func searchRegexp(pattern string, glob, ignoreCase bool) (*regexp.Regexp, error) {
+	if glob {
+		pattern = "^" + globToRegexp(pattern) + "$"
+	}
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// findMatcher matches a secret if the pattern matches its key, its name,
+// its full path, or its path:key.
+func findMatcher(re *regexp.Regexp) func(path, key, value string) bool {
+	return func(path, key, value string) bool {
+		name := path[strings.LastIndex(path, "/")+1:]
+		return re.MatchString(key) || re.MatchString(name) || re.MatchString(path) || re.MatchString(path+":"+key)
+	}
+}
+
+// matchingLines returns the lines of value that re matches.
+func matchingLines(re *regexp.Regexp, value string) []string {
+	var lines []string
+	for _, line := range strings.Split(value, "\n") {
+		if re.MatchString(line) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	fmt "github.com/jhunt/go-ansi"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/starkandwayne/safe/rc"
+	"github.com/starkandwayne/safe/vault"
+)
+
+// A shellSession is what `safe shell' keeps between commands: one Vault for
+// each Vault it has talked to, so that the connection (and any proxying) is
+// only set up once, and so that each remembers its current directory.
+type shellSession struct {
+	lock   sync.Mutex
+	vaults map[string]*shellVault
+}
+
+type shellVault struct {
+	settings string
+	vault    *vault.Vault
+}
+
+// session is only set inside `safe shell'.
+var session *shellSession
+
+// shellExit is what exit panics with inside the shell, so that a command
+// that fails ends on its own, and not the whole session.
+type shellExit int
+
+func shellID(conf vault.VaultConfig) (id, settings string) {
+	ca, _ := ioutil.ReadFile(os.Getenv("VAULT_CACERT"))
+	return conf.URL + "|" + conf.Namespace, fmt.Sprintf("%t|%t|%s|%s|%s", conf.SkipVerify, conf.RequireCAS, conf.ClientCert, conf.ClientKey, ca)
+}
+
+// reuse returns the Vault that was connected to before with conf, if there
+// is one, switching it over to the token in conf.
+func (s *shellSession) reuse(conf vault.VaultConfig) *vault.Vault {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id, settings := shellID(conf)
+	if known, ok := s.vaults[id]; ok && known.settings == settings {
+		known.vault.SetToken(conf.Token)
+		return known.vault
+	}
+	return nil
+}
+
+// keep remembers v for reuse.  If it replaces one that was set up
+// differently (say, with --insecure), it starts off in the same directory.
+func (s *shellSession) keep(conf vault.VaultConfig, v *vault.Vault) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id, settings := shellID(conf)
+	if old, ok := s.vaults[id]; ok && old.vault.Pwd() != "" {
+		v.Cd(old.vault.Pwd())
+	}
+	s.vaults[id] = &shellVault{settings: settings, vault: v}
+}
+
+// pwd returns the current directory of the Vault in the environment, if
+// there is a session and it has connected to it.
+func (s *shellSession) pwd() string {
+	if s == nil {
+		return ""
+	}
+	return s.pwdOf(os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_NAMESPACE"))
+}
+
+func (s *shellSession) pwdOf(url, namespace string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if known, ok := s.vaults[url+"|"+namespace]; ok {
+		return known.vault.Pwd()
+	}
+	return ""
+}
+
+// runShell reads commands, a line at a time, and hands them to run (apart
+// from the ones that only make sense in the shell), until it runs out of
+// input or is told to exit.
+func runShell(r *Runner, root *completionNode, target string, run func(words []string)) error {
+	session = &shellSession{vaults: make(map[string]*shellVault)}
+	defer func() { session = nil }()
+
+	var in shellInput = &pipedInput{in: bufio.NewReader(os.Stdin)}
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		in = newTTYInput(r, root, target)
+	}
+	for {
+		line, err := in.readLine(shellPrompt(target))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		words, err := splitWords(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "@R{!! %s}\n", err)
+			continue
+		}
+		if len(words) == 0 {
+			continue
+		}
+		if words[0] == "exit" || words[0] == "quit" {
+			return nil
+		}
+		shellLine(target, words, run)
+	}
+}
+
+func shellLine(target string, words []string, run func(words []string)) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(shellExit); !ok {
+				panic(e)
+			}
+		}
+		rc.Cleanup()
+	}()
+
+	resetVaultEnv()
+	switch words[0] {
+	case "cd":
+		if len(words) > 2 {
+			fmt.Fprintf(os.Stderr, "@Y{USAGE: cd [PATH]}\n")
+			return
+		}
+		rc.Apply(target)
+		v := connect(true)
+		dir := "/"
+		if len(words) == 2 {
+			dir = words[1]
+		}
+		if err := v.Cd(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "@R{!! %s}\n", err)
+		}
+
+	case "pwd":
+		if len(words) > 1 {
+			fmt.Fprintf(os.Stderr, "@Y{USAGE: pwd}\n")
+			return
+		}
+		rc.Apply(target)
+		pwd := connect(true).Pwd()
+		if pwd == "" {
+			pwd = "/"
+		}
+		fmt.Printf("%s\n", pwd)
+
+	default:
+		run(words)
+	}
+}
+
+// shellPrompt shows the target, and the current directory in it.
+func shellPrompt(target string) string {
+	cfg := rc.Read()
+	if target == "" {
+		target = cfg.Current
+	}
+	v, err := cfg.Vault(target)
+	if err != nil || v == nil {
+		return fmt.Sprintf("@G{safe}> ")
+	}
+	if pwd := session.pwdOf(v.URL, v.Namespace); pwd != "" {
+		return fmt.Sprintf("@G{safe} @Y{%s}:@C{%s}> ", target, pwd)
+	}
+	return fmt.Sprintf("@G{safe} @Y{%s}> ", target)
+}
+
+// splitWords splits a line up the way a (simple) shell would: on spaces,
+// except inside quotes, or where they are escaped with a backslash.
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord, escaped := false, false
+	var quote rune
+	for _, c := range line {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+type shellInput interface {
+	readLine(prompt string) (string, error)
+}
+
+// pipedInput reads commands from something other than a terminal, without
+// prompting for them.
+type pipedInput struct {
+	in *bufio.Reader
+}
+
+func (p *pipedInput) readLine(prompt string) (string, error) {
+	line, err := p.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// ttyInput reads commands from a terminal, with line editing, history and
+// tab completion.  The terminal is only in raw mode while a line is being
+// typed in, so that the commands themselves can prompt as usual.
+type ttyInput struct {
+	fd   int
+	term *terminal.Terminal
+}
+
+// interruptible turns Ctrl-C into Ctrl-U, so that it clears the line being
+// typed in, instead of ending the session.
+type interruptible struct {
+	io.Reader
+}
+
+func (i interruptible) Read(b []byte) (int, error) {
+	n, err := i.Reader.Read(b)
+	for j := range b[:n] {
+		if b[j] == 0x03 {
+			b[j] = 0x15
+		}
+	}
+	return n, err
+}
+
+func newTTYInput(r *Runner, root *completionNode, target string) *ttyInput {
+	t := &ttyInput{fd: int(os.Stdin.Fd())}
+	t.term = terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{interruptible{os.Stdin}, os.Stderr}, "")
+	t.term.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		rc.Unattended = true
+		defer func() { rc.Unattended = false }()
+		return t.complete(r, root, target, line, pos)
+	}
+	return t
+}
+
+func (t *ttyInput) readLine(prompt string) (string, error) {
+	state, err := terminal.MakeRaw(t.fd)
+	if err != nil {
+		return "", err
+	}
+	defer terminal.Restore(t.fd, state)
+
+	if width, height, err := terminal.GetSize(t.fd); err == nil && width > 0 {
+		t.term.SetSize(width, height)
+	}
+	t.term.SetPrompt(prompt)
+	line, err := t.term.ReadLine()
+	if err == terminal.ErrPasteIndicator {
+		err = nil
+	}
+	if err == io.EOF {
+		t.term.Write([]byte("\n"))
+	}
+	return line, err
+}
+
+// complete completes the word under the cursor as far as it can.  If that
+// isn't far enough to tell the candidates apart, they are listed.
+func (t *ttyInput) complete(r *Runner, root *completionNode, target, line string, pos int) (string, int, bool) {
+	prefix := line[:pos]
+	words := strings.Fields(prefix)
+	if len(words) == 0 || strings.HasSuffix(prefix, " ") {
+		words = append(words, "")
+	}
+	cur := words[len(words)-1]
+
+	var matches []completion
+	switch {
+	case len(words) == 1:
+		for _, builtin := range []string{"cd", "pwd", "exit", "quit"} {
+			if strings.HasPrefix(builtin, cur) {
+				matches = append(matches, completion{Word: builtin})
+			}
+		}
+		matches = append(matches, r.complete(root, words)...)
+
+	case words[0] == "cd" && len(words) == 2:
+		for _, c := range completePaths(target, cur) {
+			if strings.HasSuffix(c.Word, "/") && strings.HasPrefix(c.Word, cur) {
+				matches = append(matches, c)
+			}
+		}
+
+	default:
+		if target != "" {
+			words = append([]string{"-T", target}, words...)
+		}
+		matches = r.complete(root, words)
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+
+	word := matches[0].Word
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m.Word, word) {
+			word = word[:len(word)-1]
+		}
+	}
+	switch {
+	case len(matches) == 1 && !strings.HasSuffix(word, "/"):
+		word += " "
+	case len(matches) > 1 && word == cur:
+		names := make([]string, 0, len(matches))
+		for _, m := range matches {
+			names = append(names, m.Word)
+		}
+		t.term.Write([]byte(strings.Join(names, "  ") + "\n"))
+		return "", 0, false
+	}
+
+	completed := prefix[:len(prefix)-len(cur)] + word
+	return completed + line[pos:], len(completed), true
+}
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/starkandwayne/safe/rc"
+)
+
+var (
+	signals = make(chan os.Signal, 1)
+
+	forwardLock sync.Mutex
+	forwardTo   *os.Process
 )
 
 func Signals() {
@@ -14,10 +25,42 @@ func Signals() {
 		prev = nil
 	}
 
-	s := make(chan os.Signal, 1)
-	signal.Notify(s, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
-	for range s {
-		terminal.Restore(int(os.Stdin.Fd()), prev)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	for sig := range signals {
+		forwardLock.Lock()
+		p := forwardTo
+		forwardLock.Unlock()
+
+		if p != nil {
+			p.Signal(sig)
+			continue
+		}
+
+		if prev != nil {
+			terminal.Restore(int(os.Stdin.Fd()), prev)
+		}
+		finishAudit(fmt.Errorf("interrupted by %s", sig))
+		if transaction != nil {
+			rollback()
+		}
+		rc.Cleanup()
 		os.Exit(1)
 	}
 }
+
+// ForwardSignals passes the signals that would otherwise stop safe (and
+// SIGHUP, SIGUSR1 and SIGUSR2) on to p, until the returned function is
+// called.  This lets a child process decide for itself how to shut down.
+func ForwardSignals(p *os.Process) func() {
+	forwardLock.Lock()
+	forwardTo = p
+	forwardLock.Unlock()
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	return func() {
+		signal.Reset(syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+		forwardLock.Lock()
+		forwardTo = nil
+		forwardLock.Unlock()
+	}
+}
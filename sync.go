@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	fmt "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+type syncOpts struct {
+	DryRun       bool
+	Delete       bool
+	Deep         bool
+	SkipIfExists bool
+	Quiet        bool
+}
+
+// syncTree makes the subtree at dstPath (in dst) look like the subtree at
+// srcPath (in src).  Secrets that are already identical are not rewritten,
+// so as not to pile up useless versions on the destination.
+func syncTree(src *vault.Vault, srcPath string, dst *vault.Vault, dstPath string, opts syncOpts) error {
+	srcPath = vault.Canonicalize(srcPath)
+	dstPath = vault.Canonicalize(dstPath)
+
+	if opts.Deep {
+		mount, err := dst.Client().MountPath(dstPath)
+		if err != nil {
+			return err
+		}
+		version, err := dst.MountVersion(mount)
+		if err != nil {
+			return fmt.Errorf("Could not determine mount version of `%s': %s", mount, err)
+		}
+		if version != 2 {
+			return fmt.Errorf("--deep requires a versioned (KV v2) destination, but `%s' is not", mount)
+		}
+	}
+
+	treeOpts := vault.TreeOpts{
+		FetchKeys:           true,
+		FetchAllVersions:    opts.Deep,
+		AllowDeletedSecrets: opts.Deep,
+	}
+	from, err := src.ConstructSecrets(srcPath, treeOpts)
+	if err != nil {
+		return err
+	}
+	to, err := dst.ConstructSecrets(dstPath, treeOpts)
+	if err != nil && !vault.IsNotFound(err) {
+		return err
+	}
+
+	existing := make(map[string]vault.SecretEntry)
+	for _, s := range to {
+		existing[relativePath(dstPath, s.Path)] = s
+	}
+
+	var created, updated, pruned, skipped int
+	seen := make(map[string]bool)
+	for _, s := range from {
+		rel := relativePath(srcPath, s.Path)
+		seen[rel] = true
+		path := joinPath(dstPath, rel)
+
+		old, exists := existing[rel]
+		if exists && sameSecret(s, old, opts.Deep) {
+			continue
+		}
+		if exists && opts.SkipIfExists {
+			if !opts.Quiet {
+				fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to overwrite} @C{%s}@R{, as it is already present in the destination}\n", path)
+			}
+			skipped++
+			continue
+		}
+
+		if exists {
+			updated++
+			fmt.Printf("@Y{~ %s}\n", path)
+		} else {
+			created++
+			fmt.Printf("@G{+ %s}\n", path)
+		}
+		if opts.DryRun {
+			continue
+		}
+
+		if opts.Deep {
+			for i := range s.Versions {
+				//Without undeleting them on the source, we can't read deleted
+				// versions.  Keep their place in history, but not their data.
+				if s.Versions[i].State == vault.SecretStateDeleted {
+					s.Versions[i].State = vault.SecretStateDestroyed
+				}
+			}
+			err = s.Copy(dst, path, vault.TreeCopyOpts{Clear: true, Pad: true})
+		} else {
+			err = dst.Write(path, s.Versions[len(s.Versions)-1].Data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Delete {
+		for _, s := range to {
+			if seen[relativePath(dstPath, s.Path)] {
+				continue
+			}
+			if len(s.Versions) > 0 && s.Versions[len(s.Versions)-1].State != vault.SecretStateAlive {
+				continue
+			}
+			pruned++
+			fmt.Printf("@R{- %s}\n", s.Path)
+			if opts.DryRun {
+				continue
+			}
+			if err := dst.Delete(s.Path, vault.DeleteOpts{All: true}); err != nil {
+				return err
+			}
+		}
+	}
+
+	verb := "synced"
+	if opts.DryRun {
+		verb = "would sync"
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d created, %d updated, %d pruned", verb, created, updated, pruned)
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, ", %d skipped", skipped)
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	return nil
+}
+
+func relativePath(root, path string) string {
+	return strings.Trim(strings.TrimPrefix(vault.Canonicalize(path), root), "/")
+}
+
+func joinPath(root, rel string) string {
+	if rel == "" {
+		return root
+	}
+	return root + "/" + rel
+}
+
+// sameSecret checks whether a and b hold the same data; when deep is set,
+// their version histories have to match as well.
+func sameSecret(a, b vault.SecretEntry, deep bool) bool {
+	if !deep {
+		return len(a.Versions) > 0 && len(b.Versions) > 0 &&
+			len(vault.DiffSecret(a.Versions[len(a.Versions)-1].Data, b.Versions[len(b.Versions)-1].Data)) == 0
+	}
+
+	if len(a.Versions) != len(b.Versions) {
+		return false
+	}
+	for i := range a.Versions {
+		x, y := a.Versions[i], b.Versions[i]
+		if x.Number != y.Number {
+			return false
+		}
+		//Deleted versions are replicated as destroyed, so treat those as equal
+		if (x.State == vault.SecretStateAlive) != (y.State == vault.SecretStateAlive) {
+			return false
+		}
+		if x.State == vault.SecretStateAlive && len(vault.DiffSecret(x.Data, y.Data)) > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+
+	fmt "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// transaction is set with --transaction, and every Vault that safe connects
+// to joins it, so that if any of the commands fails, everything that the
+// ones before it changed can be undone.
+var transaction *vault.Transaction
+
+// exit is os.Exit, except that the command that is running still makes it
+// into the audit journal, failing in the middle of a transaction rolls it
+// back first, and inside `safe shell' it only ends the command.
+func exit(code int) {
+	if code != 0 {
+		finishAudit(fmt.Errorf("exited with status %d", code))
+	} else {
+		finishAudit(nil)
+	}
+	if transaction != nil && code != 0 {
+		rollback()
+	}
+	if session != nil {
+		panic(shellExit(code))
+	}
+	os.Exit(code)
+}
+
+// rollback undoes everything done so far in the transaction, and reports on
+// what it had to do to each secret.
+func rollback() {
+	paths := transaction.Paths()
+	done := transaction.Rollback()
+	if len(done) == 0 {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "@Y{rolling back %d secret(s) changed in this transaction}\n", len(done))
+	failed := 0
+	t := table{out: os.Stderr}
+	for _, rb := range done {
+		if rb.Error != nil {
+			failed++
+			t.addRow(fmt.Sprintf("@R{failed}"), fmt.Sprintf("@C{%s}", rb.Path), fmt.Sprintf("%s: @R{%s}", rb.Action, rb.Error))
+			continue
+		}
+		status := fmt.Sprintf("@G{done}")
+		if rb.Action == vault.Unchanged {
+			status = "--"
+		}
+		t.addRow(status, fmt.Sprintf("@C{%s}", rb.Path), rb.Action)
+	}
+	t.print()
+
+	var err error
+	if failed > 0 {
+		err = fmt.Errorf("unable to roll back %d of %d secret(s)", failed, len(done))
+		fmt.Fprintf(os.Stderr, "@R{!! %s; they will have to be put right by hand}\n", err)
+	} else {
+		fmt.Fprintf(os.Stderr, "@Y{transaction rolled back}\n")
+	}
+	recordAudit("", "rollback", paths, err)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"regexp"
@@ -86,6 +87,8 @@ type table struct {
 	headers []string
 	rows    [][]string
 	numCols int
+	//out is where the table is printed; standard output, if nil
+	out io.Writer
 }
 
 func (t *table) setHeader(headers ...string) {
@@ -96,7 +99,7 @@ func (t *table) setHeader(headers ...string) {
 
 func (t *table) addRow(cols ...string) {
 	t._assertValidRowWidth(len(cols))
-	if !ansi.ShouldColorize(os.Stdout) {
+	if !ansi.ShouldColorize(t._out()) {
 		for i := range cols {
 			cols[i] = t._stripColor(cols[i])
 		}
@@ -120,6 +123,13 @@ func (t *table) print() {
 	}
 }
 
+func (t *table) _out() io.Writer {
+	if t.out == nil {
+		return os.Stdout
+	}
+	return t.out
+}
+
 func (t *table) _assertValidRowWidth(numCols int) {
 	if numCols == 0 {
 		panic("Cannot append row with zero columns")
@@ -208,11 +218,11 @@ func (t *table) _printRow(row []string, widths []int) {
 
 	//no spaces at the end of the last col
 	t._printCell(row[len(row)-1], 0)
-	os.Stdout.Write([]byte{'\n'})
+	t._out().Write([]byte{'\n'})
 }
 
 func (t *table) _printCell(cell string, spaces int) {
-	os.Stdout.Write([]byte(cell))
+	t._out().Write([]byte(cell))
 
 	if spaces == 0 {
 		return
@@ -223,12 +233,12 @@ func (t *table) _printCell(cell string, spaces int) {
 		spaceBuf[idx] = ' '
 	}
 
-	os.Stdout.Write(spaceBuf)
+	t._out().Write(spaceBuf)
 }
 
 func (t *table) _sprintf(f string, args ...interface{}) string {
 	ret := ansi.Sprintf(f, args...)
-	if !ansi.ShouldColorize(os.Stdout) {
+	if !ansi.ShouldColorize(t._out()) {
 		ret = t._stripColor(ret)
 	}
 	return ret
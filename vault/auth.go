@@ -0,0 +1,129 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+)
+
+// authResponse is the part of a login response that safe cares about.
+type authResponse struct {
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Data map[string]interface{} `json:"data"`
+}
+
+func (v *Vault) authRequest(method, path string, body interface{}) (*authResponse, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := v.Curl(method, path, data)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 400 {
+		return nil, DecodeErrorResponse(b)
+	}
+
+	var out authResponse
+	if err = json.Unmarshal(b, &out); err != nil {
+		return nil, fmt.Errorf("Received an unexpected response from the Vault: %s", err)
+	}
+	return &out, nil
+}
+
+// login authenticates against the auth backend mounted at mount, with the
+// given parameters, and returns the new token.
+func (v *Vault) login(mount string, params map[string]interface{}) (string, error) {
+	out, err := v.authRequest("POST", fmt.Sprintf("auth/%s/login", mount), params)
+	if err != nil {
+		return "", err
+	}
+	if out.Auth.ClientToken == "" {
+		return "", fmt.Errorf("The Vault did not return a token")
+	}
+	return out.Auth.ClientToken, nil
+}
+
+// AuthJWT logs in with a JSON Web Token, through a jwt auth backend.  If
+// role is empty, the backend's default role is used.
+func (v *Vault) AuthJWT(mount, role, jwt string) (string, error) {
+	params := map[string]interface{}{"jwt": jwt}
+	if role != "" {
+		params["role"] = role
+	}
+	return v.login(mount, params)
+}
+
+// AuthKubernetes logs in as role with a Kubernetes service account token,
+// through a kubernetes auth backend.
+func (v *Vault) AuthKubernetes(mount, role, jwt string) (string, error) {
+	return v.login(mount, map[string]interface{}{"role": role, "jwt": jwt})
+}
+
+// AuthCert logs in with the client certificate that the Vault was set up
+// with, through a cert auth backend.  If role is empty, the Vault tries
+// every role whose certificates would match.
+func (v *Vault) AuthCert(mount, role string) (string, error) {
+	params := map[string]interface{}{}
+	if role != "" {
+		params["name"] = role
+	}
+	return v.login(mount, params)
+}
+
+// OIDCAuthURL starts an OIDC login, through an oidc auth backend, and
+// returns the URL of the identity provider's page that the user has to log
+// in at.  Once they have, the provider sends them back to redirect, with
+// the parameters that OIDCCallback needs.
+func (v *Vault) OIDCAuthURL(mount, role, redirect, nonce string) (string, error) {
+	params := map[string]interface{}{
+		"redirect_uri": redirect,
+		"client_nonce": nonce,
+	}
+	if role != "" {
+		params["role"] = role
+	}
+	out, err := v.authRequest("POST", fmt.Sprintf("auth/%s/oidc/auth_url", mount), params)
+	if err != nil {
+		return "", err
+	}
+	u, _ := out.Data["auth_url"].(string)
+	if u == "" {
+		return "", fmt.Errorf("The Vault did not return an authorization URL; check that the role exists, and allows %s as a redirect URI", redirect)
+	}
+	return u, nil
+}
+
+// OIDCCallback finishes an OIDC login, given the parameters that the
+// identity provider redirected the user back with, and returns the new
+// token.
+func (v *Vault) OIDCCallback(mount, nonce string, callback url.Values) (string, error) {
+	query := url.Values{}
+	for _, param := range []string{"state", "code", "id_token"} {
+		query.Set(param, callback.Get(param))
+	}
+	query.Set("client_nonce", nonce)
+
+	out, err := v.authRequest("GET", fmt.Sprintf("auth/%s/oidc/callback?%s", mount, query.Encode()), nil)
+	if err != nil {
+		return "", err
+	}
+	if out.Auth.ClientToken == "" {
+		return "", fmt.Errorf("The Vault did not return a token")
+	}
+	return out.Auth.ClientToken, nil
+}
@@ -0,0 +1,130 @@
+package vault
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cloudfoundry-community/vaultkv"
+)
+
+type casConflict struct {
+	path    string
+	version uint
+}
+
+func (e casConflict) Error() string {
+	if e.version == 0 {
+		return fmt.Sprintf("`%s' was written by someone else since it was read", e.path)
+	}
+	return fmt.Sprintf("`%s' was changed by someone else since version %d was read", e.path, e.version)
+}
+
+// IsCASConflict returns true if the given error came from a check-and-set
+// write that lost out to someone else's write.
+func IsCASConflict(err error) bool {
+	_, is := err.(casConflict)
+	return is
+}
+
+// splitMount splits a path into the mount that it lives in, and the path
+// relative to that mount.
+func (v *Vault) splitMount(path string) (mount, subpath string, err error) {
+	path = strings.Trim(Canonicalize(path), "/")
+	mount, err = v.client.MountPath(path)
+	if err != nil {
+		return "", "", err
+	}
+	mount = strings.Trim(mount, "/")
+	return mount, strings.Trim(strings.TrimPrefix(path, mount), "/"), nil
+}
+
+// currentVersion returns the latest version of the (KV v2) secret at path,
+// deleted or not, or zero if there isn't one.
+func (v *Vault) currentVersion(path string) (uint, error) {
+	if mountVersion, err := v.MountVersion(path); err != nil || mountVersion != 2 {
+		return 0, err
+	}
+	versions, err := v.Versions(path)
+	if err != nil {
+		if IsNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return versions[len(versions)-1].Version, nil
+}
+
+// deletedVersion returns the latest version of the (KV v2) secret at path,
+// for a secret that wasn't found when it was read; zero if it has no
+// versions at all.  If the latest version is alive, someone has written the
+// secret since it was read.
+func (v *Vault) deletedVersion(path string) (uint, error) {
+	versions, err := v.Versions(path)
+	if err != nil {
+		if IsNotFound(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("unable to check-and-set `%s': could not read its metadata: %s", path, err)
+	}
+	if len(versions) == 0 {
+		return 0, nil
+	}
+	latest := versions[len(versions)-1]
+	if latest.Alive() {
+		return 0, casConflict{path: path}
+	}
+	return latest.Version, nil
+}
+
+// writeCAS writes s to path with check-and-set, so that it only succeeds if
+// no one else has written to the secret since s was read.  Secrets that
+// weren't read are checked against whatever is there now.
+func (v *Vault) writeCAS(path string, s *Secret) error {
+	mountVersion, err := v.MountVersion(path)
+	if err != nil {
+		return err
+	}
+	if mountVersion != 2 {
+		if v.requireCAS {
+			return fmt.Errorf("check-and-set is required, but `%s' is in a KV v%d backend, which does not support it", path, mountVersion)
+		}
+		_, err := v.client.Set(path, s.data, nil)
+		if vaultkv.IsNotFound(err) {
+			err = NewSecretNotFoundError(path)
+		}
+		return err
+	}
+
+	//Secrets read from somewhere else (i.e. being copied) count as unread
+	cas := s.version
+	if s.readFrom != Canonicalize(path) {
+		if cas, err = v.currentVersion(path); err != nil {
+			return fmt.Errorf("unable to check-and-set `%s': could not read its metadata: %s", path, err)
+		}
+	} else if cas == 0 {
+		//Nothing was there when it was read, but there may still be
+		// versions (deleted ones) to check-and-set against
+		if cas, err = v.deletedVersion(path); err != nil {
+			return err
+		}
+	}
+
+	mount, subpath, err := v.splitMount(path)
+	if err != nil {
+		return err
+	}
+	meta, err := v.client.Client.V2Set(mount, subpath, s.data, vaultkv.V2SetOpts{}.WithCAS(cas))
+	if err != nil {
+		if _, bad := err.(*vaultkv.ErrBadRequest); bad && strings.Contains(err.Error(), "check-and-set") {
+			return casConflict{path: path, version: cas}
+		}
+		if vaultkv.IsNotFound(err) {
+			err = NewSecretNotFoundError(path)
+		}
+		return err
+	}
+
+	//Writing it again should check against what we just wrote
+	s.readFrom, s.version = Canonicalize(path), meta.Version
+	return nil
+}
@@ -0,0 +1,149 @@
+package vault_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/safe/vault"
+)
+
+var _ = Describe("Check-and-set", func() {
+	var kv *fakeKV
+	var v *vault.Vault
+	var requireCAS bool
+
+	BeforeEach(func() {
+		kv = newFakeKV()
+		kv.put("secret/db", map[string]string{"password": "old"})
+		requireCAS = false
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		v, err = vault.NewVault(vault.VaultConfig{URL: kv.server.URL, Token: "root", RequireCAS: requireCAS})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		kv.Close()
+	})
+
+	read := func(path string) *vault.Secret {
+		s, err := v.Read(path)
+		Expect(err).NotTo(HaveOccurred())
+		return s
+	}
+
+	It("writes back secrets that no one else has changed since they were read", func() {
+		s := read("secret/db")
+		Expect(s.Set("password", "new", false)).To(Succeed())
+		Expect(v.Write("secret/db", s)).To(Succeed())
+		Expect(read("secret/db").Get("password")).To(Equal("new"))
+	})
+
+	It("refuses to overwrite changes made since the secret was read", func() {
+		s := read("secret/db")
+		kv.put("secret/db", map[string]string{"password": "theirs"})
+
+		Expect(s.Set("password", "mine", false)).To(Succeed())
+		err := v.Write("secret/db", s)
+		Expect(vault.IsCASConflict(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("since version 1 was read"))
+		Expect(read("secret/db").Get("password")).To(Equal("theirs"))
+	})
+
+	It("checks later writes against the version it wrote", func() {
+		s := read("secret/db")
+		Expect(s.Set("password", "new", false)).To(Succeed())
+		Expect(v.Write("secret/db", s)).To(Succeed())
+		Expect(s.Set("password", "newer", false)).To(Succeed())
+		Expect(v.Write("secret/db", s)).To(Succeed())
+
+		kv.put("secret/db", map[string]string{"password": "theirs"})
+		Expect(vault.IsCASConflict(v.Write("secret/db", s))).To(BeTrue())
+	})
+
+	It("checks secrets whose latest version was deleted against that version", func() {
+		kv.v2["secret/db"][0].deleted = true
+		s, err := v.Read("secret/db")
+		Expect(vault.IsNotFound(err)).To(BeTrue())
+
+		Expect(s.Set("password", "new", false)).To(Succeed())
+		Expect(v.Write("secret/db", s)).To(Succeed())
+		n, _ := kv.latest("secret/db")
+		Expect(n).To(Equal(uint(2)))
+	})
+
+	It("does not read the metadata of secrets that aren't there until they are written", func() {
+		kv.v2["secret/db"][0].deleted = true
+		s, err := v.Read("secret/db")
+		Expect(vault.IsNotFound(err)).To(BeTrue())
+		Expect(kv.metadataReads).To(BeZero())
+
+		Expect(s.Set("password", "new", false)).To(Succeed())
+		Expect(v.Write("secret/db", s)).To(Succeed())
+		Expect(kv.metadataReads).To(Equal(1))
+	})
+
+	It("refuses to overwrite secrets written since they were read as deleted", func() {
+		kv.v2["secret/db"][0].deleted = true
+		s, err := v.Read("secret/db")
+		Expect(vault.IsNotFound(err)).To(BeTrue())
+		kv.put("secret/db", map[string]string{"password": "theirs"})
+
+		Expect(s.Set("password", "mine", false)).To(Succeed())
+		err = v.Write("secret/db", s)
+		Expect(vault.IsCASConflict(err)).To(BeTrue())
+		Expect(read("secret/db").Get("password")).To(Equal("theirs"))
+	})
+
+	It("says so when it can't read the metadata to check against", func() {
+		kv.v2["secret/db"][0].deleted = true
+		kv.forbidden["secret/db"] = true
+		s, err := v.Read("secret/db")
+		Expect(vault.IsNotFound(err)).To(BeTrue())
+
+		Expect(s.Set("password", "new", false)).To(Succeed())
+		err = v.Write("secret/db", s)
+		Expect(vault.IsCASConflict(err)).To(BeFalse())
+		Expect(err).To(MatchError(ContainSubstring("could not read its metadata")))
+	})
+
+	It("does not check secrets that weren't read", func() {
+		s := vault.NewSecret()
+		Expect(s.Set("password", "new", false)).To(Succeed())
+		Expect(v.Write("secret/db", s)).To(Succeed())
+	})
+
+	It("treats secrets read from somewhere else as unread", func() {
+		kv.put("secret/other", map[string]string{"password": "copied"})
+		s := read("secret/other")
+		kv.put("secret/other", map[string]string{"password": "again"})
+		Expect(v.Write("secret/db", s)).To(Succeed())
+		Expect(read("secret/db").Get("password")).To(Equal("copied"))
+	})
+
+	Context("when it is required", func() {
+		BeforeEach(func() {
+			requireCAS = true
+		})
+
+		It("checks secrets that weren't read against what is there now", func() {
+			s := vault.NewSecret()
+			Expect(s.Set("password", "new", false)).To(Succeed())
+			Expect(v.Write("secret/db", s)).To(Succeed())
+			Expect(v.Write("secret/new", s)).To(Succeed())
+
+			n, _ := kv.latest("secret/db")
+			Expect(n).To(Equal(uint(2)))
+			n, _ = kv.latest("secret/new")
+			Expect(n).To(Equal(uint(1)))
+		})
+
+		It("refuses to write to KV v1 backends", func() {
+			s := vault.NewSecret()
+			Expect(s.Set("password", "new", false)).To(Succeed())
+			Expect(v.Write("v1/db", s)).To(MatchError(ContainSubstring("KV v1 backend, which does not support it")))
+			Expect(kv.v1Paths()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,114 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	pathpkg "path"
+	"strings"
+)
+
+// Pwd returns the directory that relative paths are resolved against, or
+// the empty string if there isn't one (and every path is absolute).
+func (v *Vault) Pwd() string {
+	return v.cwd
+}
+
+// Cd changes the directory that relative paths are resolved against.  The
+// new directory must be a mount, or something that can be listed; `/' goes
+// back to the top, where every path is absolute.
+func (v *Vault) Cd(path string) error {
+	if _, err := v.mounts(); err != nil {
+		return fmt.Errorf("unable to tell mounts from relative paths: %s", err)
+	}
+
+	dir := Canonicalize(v.join(path))
+	if dir != "" && !v.underMount(dir, true) {
+		paths, err := v.List(dir)
+		if err != nil && !IsNotFound(err) {
+			return err
+		}
+		if len(paths) == 0 {
+			return fmt.Errorf("no such directory `%s'", dir)
+		}
+	}
+	v.cwd = dir
+	return nil
+}
+
+// resolve turns a path relative to the current directory into an absolute
+// one.  Paths that start with `/', or with the name of a mount, are already
+// absolute; paths starting with `./' or `../' never are.  Resolving a path
+// that has already been resolved changes nothing, so internal callers of
+// public methods don't need to care.
+func (v *Vault) resolve(path string) string {
+	if v.cwd == "" || path == "" {
+		return path
+	}
+	return v.join(path)
+}
+
+func (v *Vault) join(path string) string {
+	relative := path == "." || path == ".." || strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../")
+	if !relative && (strings.HasPrefix(path, "/") || v.underMount(path, false)) {
+		return path
+	}
+
+	joined := pathpkg.Join(v.cwd, path)
+	if joined == "." || joined == ".." || strings.HasPrefix(joined, "../") {
+		return ""
+	}
+	if strings.HasSuffix(path, "/") {
+		joined += "/"
+	}
+	return joined
+}
+
+// underMount returns true if path is a mount, or is somewhere inside one.
+// If it's only the mount itself that counts, so does exactly.
+func (v *Vault) underMount(path string, exactly bool) bool {
+	mounts, _ := v.mounts()
+	path = Canonicalize(path) + "/"
+	for _, mount := range mounts {
+		if path == mount || (!exactly && strings.HasPrefix(path, mount)) {
+			return true
+		}
+	}
+	return false
+}
+
+// mounts lists (and remembers) every secrets mount, each with a trailing
+// `/'.  The UI endpoint is tried first, since most policies allow it; the
+// mount table needs more privileges.
+func (v *Vault) mounts() ([]string, error) {
+	if v.mountList != nil {
+		return v.mountList, nil
+	}
+
+	var found []string
+	res, err := v.Curl("GET", "sys/internal/ui/mounts", nil)
+	if err == nil {
+		defer res.Body.Close()
+		var ui struct {
+			Data struct {
+				Secret map[string]interface{} `json:"secret"`
+			} `json:"data"`
+		}
+		if err = json.NewDecoder(res.Body).Decode(&ui); err == nil && res.StatusCode == 200 {
+			for name := range ui.Data.Secret {
+				found = append(found, strings.Trim(name, "/")+"/")
+			}
+		}
+	}
+	if len(found) == 0 {
+		names, err := v.ListMounts()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			found = append(found, strings.Trim(name, "/")+"/")
+		}
+	}
+
+	v.mountList = found
+	return found, nil
+}
@@ -0,0 +1,114 @@
+package vault
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	DiffAdded uint = iota
+	DiffRemoved
+	DiffChanged
+)
+
+// SecretDiff describes how a single secret differs between two trees.  Path
+// is relative to the roots that were compared.
+type SecretDiff struct {
+	Path  string
+	State uint
+	Keys  []KeyDiff
+}
+
+// KeyDiff describes how a single key differs between two versions of a
+// secret.  Old is empty for added keys, New is empty for removed keys.
+type KeyDiff struct {
+	Key   string
+	State uint
+	Old   string
+	New   string
+}
+
+// Diff compares the latest version of every secret in `left` (rooted at
+// leftRoot) against the same relative path in `right` (rooted at rightRoot),
+// and returns the differences sorted by path.  Secrets that are identical on
+// both sides are not included.
+func Diff(left Secrets, leftRoot string, right Secrets, rightRoot string) []SecretDiff {
+	l := relativeLatest(left, leftRoot)
+	r := relativeLatest(right, rightRoot)
+
+	var diffs []SecretDiff
+	for path, old := range l {
+		nu, ok := r[path]
+		if !ok {
+			d := SecretDiff{Path: path, State: DiffRemoved}
+			for _, k := range old.Keys() {
+				d.Keys = append(d.Keys, KeyDiff{Key: k, State: DiffRemoved, Old: old.Get(k)})
+			}
+			diffs = append(diffs, d)
+			continue
+		}
+
+		if keys := DiffSecret(old, nu); len(keys) > 0 {
+			diffs = append(diffs, SecretDiff{Path: path, State: DiffChanged, Keys: keys})
+		}
+	}
+
+	for path, nu := range r {
+		if _, ok := l[path]; ok {
+			continue
+		}
+		d := SecretDiff{Path: path, State: DiffAdded}
+		for _, k := range nu.Keys() {
+			d.Keys = append(d.Keys, KeyDiff{Key: k, State: DiffAdded, New: nu.Get(k)})
+		}
+		diffs = append(diffs, d)
+	}
+
+	sort.Slice(diffs, func(i, j int) bool { return PathLessThan(diffs[i].Path, diffs[j].Path) })
+	return diffs
+}
+
+// DiffSecret compares the keys of two secrets, returning the differences
+// sorted by key name.
+func DiffSecret(old, nu *Secret) []KeyDiff {
+	var keys []KeyDiff
+	for _, k := range old.Keys() {
+		if !nu.Has(k) {
+			keys = append(keys, KeyDiff{Key: k, State: DiffRemoved, Old: old.Get(k)})
+		} else if old.Get(k) != nu.Get(k) {
+			keys = append(keys, KeyDiff{Key: k, State: DiffChanged, Old: old.Get(k), New: nu.Get(k)})
+		}
+	}
+	for _, k := range nu.Keys() {
+		if !old.Has(k) {
+			keys = append(keys, KeyDiff{Key: k, State: DiffAdded, New: nu.Get(k)})
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	return keys
+}
+
+func relativeLatest(s Secrets, root string) map[string]*Secret {
+	root = strings.Trim(Canonicalize(root), "/")
+	m := make(map[string]*Secret)
+	for _, entry := range s {
+		if len(entry.Versions) == 0 {
+			continue
+		}
+		latest := entry.Versions[len(entry.Versions)-1]
+		if latest.State != SecretStateAlive || latest.Data == nil {
+			continue
+		}
+
+		path := strings.Trim(entry.Path, "/")
+		if root != "" {
+			if path != root && !strings.HasPrefix(path, root+"/") {
+				continue
+			}
+			path = strings.TrimPrefix(strings.TrimPrefix(path, root), "/")
+		}
+		m[path] = latest.Data
+	}
+	return m
+}
@@ -0,0 +1,59 @@
+package vault_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/safe/vault"
+)
+
+var _ = Describe("Diff", func() {
+	entry := func(path string, kv ...string) vault.SecretEntry {
+		s := vault.NewSecret()
+		for i := 0; i < len(kv); i += 2 {
+			s.Set(kv[i], kv[i+1], false)
+		}
+		return vault.SecretEntry{
+			Path:     path,
+			Versions: []vault.SecretVersion{{Data: s, Number: 1, State: vault.SecretStateAlive}},
+		}
+	}
+
+	It("compares secrets relative to their roots", func() {
+		left := vault.Secrets{
+			entry("secret/prod/app", "user", "a", "pass", "1"),
+			entry("secret/prod/db", "host", "x"),
+			entry("secret/prod/same", "k", "v"),
+		}
+		right := vault.Secrets{
+			entry("secret/staging/app", "user", "a", "pass", "2", "extra", "3"),
+			entry("secret/staging/same", "k", "v"),
+			entry("secret/staging/new", "k", "v"),
+		}
+
+		diffs := vault.Diff(left, "secret/prod", right, "secret/staging/")
+		Expect(diffs).To(HaveLen(3))
+
+		Expect(diffs[0].Path).To(Equal("app"))
+		Expect(diffs[0].State).To(Equal(vault.DiffChanged))
+		Expect(diffs[0].Keys).To(Equal([]vault.KeyDiff{
+			{Key: "extra", State: vault.DiffAdded, New: "3"},
+			{Key: "pass", State: vault.DiffChanged, Old: "1", New: "2"},
+		}))
+
+		Expect(diffs[1].Path).To(Equal("db"))
+		Expect(diffs[1].State).To(Equal(vault.DiffRemoved))
+
+		Expect(diffs[2].Path).To(Equal("new"))
+		Expect(diffs[2].State).To(Equal(vault.DiffAdded))
+	})
+
+	It("ignores secrets outside of the root, and deleted secrets", func() {
+		left := vault.Secrets{entry("secret/prod/app", "k", "v"), entry("secret/production/app", "k", "v")}
+		right := vault.Secrets{entry("secret/prod/app", "k", "v")}
+		deleted := entry("secret/prod/gone", "k", "v")
+		deleted.Versions[0].State = vault.SecretStateDeleted
+		right = append(right, deleted)
+
+		Expect(vault.Diff(left, "secret/prod", right, "secret/prod")).To(BeEmpty())
+	})
+})
@@ -0,0 +1,249 @@
+package vault_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeKV is just enough of a Vault to test reading and writing secrets
+// against: a KV v2 backend mounted at secret/, and a KV v1 backend at v1/.
+// Writes to any of the paths in failing fail, and so do reads of the
+// metadata of any of the paths in forbidden.  metadataReads counts the
+// reads of metadata.
+type fakeKV struct {
+	server *httptest.Server
+
+	lock          sync.Mutex
+	v1            map[string]map[string]string
+	v2            map[string][]*fakeVersion
+	failing       map[string]bool
+	forbidden     map[string]bool
+	metadataReads int
+}
+
+type fakeVersion struct {
+	data      map[string]string
+	created   time.Time
+	deleted   bool
+	destroyed bool
+}
+
+func newFakeKV() *fakeKV {
+	kv := &fakeKV{
+		v1:        map[string]map[string]string{},
+		v2:        map[string][]*fakeVersion{},
+		failing:   map[string]bool{},
+		forbidden: map[string]bool{},
+	}
+	kv.server = httptest.NewServer(http.HandlerFunc(kv.serve))
+	return kv
+}
+
+func (kv *fakeKV) Close() {
+	kv.server.Close()
+}
+
+// put writes a new version of a KV v2 secret, as someone else might.
+func (kv *fakeKV) put(path string, data map[string]string) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	kv.v2[path] = append(kv.v2[path], &fakeVersion{data: data, created: time.Now()})
+}
+
+// latest returns the latest version of a KV v2 secret, deleted or not.
+func (kv *fakeKV) latest(path string) (uint, *fakeVersion) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	versions := kv.v2[path]
+	if len(versions) == 0 {
+		return 0, nil
+	}
+	return uint(len(versions)), versions[len(versions)-1]
+}
+
+func (kv *fakeKV) reply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if body != nil {
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+func (kv *fakeKV) fail(w http.ResponseWriter, status int, message string) {
+	kv.reply(w, status, map[string][]string{"errors": {message}})
+}
+
+func (kv *fakeKV) serve(w http.ResponseWriter, r *http.Request) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	switch {
+	case path == "sys/internal/ui/mounts":
+		kv.reply(w, 200, map[string]interface{}{"data": map[string]interface{}{"secret": map[string]interface{}{
+			"secret/": map[string]interface{}{"type": "kv", "options": map[string]string{"version": "2"}},
+			"v1/":     map[string]interface{}{"type": "kv", "options": map[string]string{"version": "1"}},
+		}}})
+
+	case r.URL.Query().Get("list") != "":
+		kv.fail(w, 404, "")
+
+	case strings.HasPrefix(path, "v1/"):
+		kv.serveV1(w, r, path)
+
+	case strings.HasPrefix(path, "secret/"):
+		parts := strings.SplitN(strings.TrimPrefix(path, "secret/"), "/", 2)
+		if len(parts) != 2 {
+			kv.fail(w, 404, "")
+			return
+		}
+		kv.serveV2(w, r, parts[0], "secret/"+parts[1])
+
+	default:
+		kv.fail(w, 404, "no handler for route")
+	}
+}
+
+func (kv *fakeKV) serveV1(w http.ResponseWriter, r *http.Request, path string) {
+	switch r.Method {
+	case "GET":
+		data, ok := kv.v1[path]
+		if !ok {
+			kv.fail(w, 404, "")
+			return
+		}
+		kv.reply(w, 200, map[string]interface{}{"data": data})
+
+	case "PUT", "POST":
+		if kv.failing[path] {
+			kv.fail(w, 500, "injected failure")
+			return
+		}
+		data := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&data)
+		kv.v1[path] = data
+		kv.reply(w, 204, nil)
+
+	case "DELETE":
+		delete(kv.v1, path)
+		kv.reply(w, 204, nil)
+	}
+}
+
+func (kv *fakeKV) serveV2(w http.ResponseWriter, r *http.Request, op, path string) {
+	versions := kv.v2[path]
+	var body struct {
+		Options struct {
+			CAS *uint `json:"cas"`
+		} `json:"options"`
+		Data     map[string]string `json:"data"`
+		Versions []uint            `json:"versions"`
+	}
+	if r.Method != "GET" && r.Method != "DELETE" {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	mark := func(f func(*fakeVersion)) {
+		for _, n := range body.Versions {
+			if n >= 1 && int(n) <= len(versions) {
+				f(versions[n-1])
+			}
+		}
+		kv.reply(w, 204, nil)
+	}
+
+	switch {
+	case op == "data" && r.Method == "GET":
+		n := len(versions)
+		if q := r.URL.Query().Get("version"); q != "" && q != "0" {
+			n, _ = strconv.Atoi(q)
+		}
+		if n < 1 || n > len(versions) || versions[n-1].deleted || versions[n-1].destroyed {
+			kv.fail(w, 404, "")
+			return
+		}
+		kv.reply(w, 200, map[string]interface{}{"data": map[string]interface{}{
+			"data":     versions[n-1].data,
+			"metadata": map[string]interface{}{"version": n, "created_time": versions[n-1].created.Format(time.RFC3339Nano)},
+		}})
+
+	case op == "data" && (r.Method == "PUT" || r.Method == "POST"):
+		if kv.failing[path] {
+			kv.fail(w, 500, "injected failure")
+			return
+		}
+		if body.Options.CAS != nil && *body.Options.CAS != uint(len(versions)) {
+			kv.fail(w, 400, "check-and-set parameter did not match the current version")
+			return
+		}
+		now := time.Now()
+		kv.v2[path] = append(versions, &fakeVersion{data: body.Data, created: now})
+		kv.reply(w, 200, map[string]interface{}{"data": map[string]interface{}{
+			"version": len(versions) + 1, "created_time": now.Format(time.RFC3339Nano),
+		}})
+
+	case op == "data" && r.Method == "DELETE":
+		if len(versions) > 0 {
+			versions[len(versions)-1].deleted = true
+		}
+		kv.reply(w, 204, nil)
+
+	case op == "delete":
+		mark(func(v *fakeVersion) { v.deleted = true })
+	case op == "undelete":
+		mark(func(v *fakeVersion) { v.deleted = false })
+	case op == "destroy":
+		mark(func(v *fakeVersion) { v.destroyed, v.data = true, nil })
+
+	case op == "metadata" && r.Method == "GET":
+		kv.metadataReads++
+		if kv.forbidden[path] {
+			kv.fail(w, 403, "permission denied")
+			return
+		}
+		if len(versions) == 0 {
+			kv.fail(w, 404, "")
+			return
+		}
+		meta := map[string]interface{}{}
+		for i, v := range versions {
+			deleted := ""
+			if v.deleted {
+				deleted = v.created.Format(time.RFC3339Nano)
+			}
+			meta[strconv.Itoa(i+1)] = map[string]interface{}{
+				"created_time":  v.created.Format(time.RFC3339Nano),
+				"deletion_time": deleted,
+				"destroyed":     v.destroyed,
+			}
+		}
+		kv.reply(w, 200, map[string]interface{}{"data": map[string]interface{}{
+			"current_version": len(versions),
+			"versions":        meta,
+		}})
+
+	case op == "metadata" && r.Method == "DELETE":
+		delete(kv.v2, path)
+		kv.reply(w, 204, nil)
+
+	default:
+		kv.fail(w, 405, "unsupported operation")
+	}
+}
+
+// v1Paths returns the paths of every KV v1 secret, sorted.
+func (kv *fakeKV) v1Paths() []string {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	paths := []string{}
+	for path := range kv.v1 {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,148 @@
+package vault
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// The types of asymmetric key that safe can generate, for SSH and RSA
+// keypairs, and X.509 certificates.
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// NormalizeKeyType checks that keyType is one we know how to generate, and
+// returns its canonical name.  An empty keyType means RSA.
+func NormalizeKeyType(keyType string) (string, error) {
+	switch strings.ToLower(keyType) {
+	case "", KeyTypeRSA:
+		return KeyTypeRSA, nil
+	case KeyTypeECDSA, "ec":
+		return KeyTypeECDSA, nil
+	case KeyTypeEd25519:
+		return KeyTypeEd25519, nil
+	}
+	return "", fmt.Errorf("unsupported key type '%s', must be one of: rsa, ecdsa, ed25519", keyType)
+}
+
+// DefaultKeyBits is the key strength used when none is given: 2048-bit RSA,
+// and P-256 for ECDSA.  Ed25519 keys are always 256 bits.
+func DefaultKeyBits(keyType string) int {
+	if keyType == KeyTypeRSA || keyType == "" {
+		return 2048
+	}
+	return 256
+}
+
+// GenerateKey generates a new private key.  For RSA keys, bits is the size of
+// the modulus; for ECDSA keys, it picks the curve (256, 384 or 521). Ed25519
+// keys have a fixed size, so bits must be 0 or 256.
+func GenerateKey(keyType string, bits int) (crypto.Signer, error) {
+	keyType, err := NormalizeKeyType(keyType)
+	if err != nil {
+		return nil, err
+	}
+	if bits == 0 {
+		bits = DefaultKeyBits(keyType)
+	}
+
+	switch keyType {
+	case KeyTypeECDSA:
+		var curve elliptic.Curve
+		switch bits {
+		case 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("invalid ECDSA key strength '%d', must be one of: 256, 384, 521", bits)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+
+	case KeyTypeEd25519:
+		if bits != 256 {
+			return nil, fmt.Errorf("invalid Ed25519 key strength '%d', Ed25519 keys are always 256 bits", bits)
+		}
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+
+	if bits < 1024 {
+		return nil, fmt.Errorf("invalid RSA key strength '%d', must be at least 1024", bits)
+	}
+	return rsa.GenerateKey(rand.Reader, bits)
+}
+
+// KeyStrength returns the type and size in bits of a public or private key.
+func KeyStrength(key interface{}) (string, int) {
+	if signer, ok := key.(crypto.Signer); ok {
+		key = signer.Public()
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return KeyTypeRSA, k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return KeyTypeECDSA, k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return KeyTypeEd25519, 256
+	}
+	return "unknown", 0
+}
+
+// encodePrivateKey PEM-encodes a private key in the most widely understood
+// format for its type: PKCS#1 for RSA (as safe always has), SEC 1 for ECDSA
+// and PKCS#8 for Ed25519.
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	var block *pem.Block
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+
+	default:
+		b, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: b}
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// parsePrivateKey parses a DER-encoded private key of any of the types that
+// encodePrivateKey produces.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
@@ -0,0 +1,70 @@
+package vault_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/safe/vault"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("Keys", func() {
+	It("generates keys of each type and strength", func() {
+		for _, tc := range []struct {
+			keyType string
+			bits    int
+			want    int
+		}{
+			{"rsa", 1024, 1024},
+			{"ecdsa", 0, 256},
+			{"ecdsa", 384, 384},
+			{"ed25519", 0, 256},
+		} {
+			key, err := vault.GenerateKey(tc.keyType, tc.bits)
+			Expect(err).NotTo(HaveOccurred())
+			t, bits := vault.KeyStrength(key)
+			Expect(t).To(Equal(tc.keyType))
+			Expect(bits).To(Equal(tc.want))
+		}
+	})
+
+	It("rejects key strengths that don't make sense", func() {
+		_, err := vault.GenerateKey("ecdsa", 2048)
+		Expect(err).To(HaveOccurred())
+		_, err = vault.GenerateKey("ed25519", 4096)
+		Expect(err).To(HaveOccurred())
+		_, err = vault.GenerateKey("dsa", 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("writes SSH private keys that can be read back", func() {
+		for _, keyType := range []string{"rsa", "ecdsa", "ed25519"} {
+			s := vault.NewSecret()
+			Expect(s.SSHKey(keyType, 0, false)).To(Succeed())
+
+			signer, err := ssh.ParsePrivateKey([]byte(s.Get("private")))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))).To(Equal(s.Get("public")))
+		}
+	})
+
+	It("issues and validates certificates with non-RSA keys", func() {
+		ca, err := vault.NewCertificate("/cn=ca", []string{"ca"}, []string{"key_cert_sign"}, "", "ecdsa", 384)
+		Expect(err).NotTo(HaveOccurred())
+		ca.MakeCA()
+		Expect(ca.Sign(ca, 0)).To(Succeed())
+
+		cert, err := vault.NewCertificate("/cn=leaf", []string{"leaf"}, []string{"server_auth"}, "", "ed25519", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ca.Sign(cert, 0)).To(Succeed())
+		Expect(cert.Certificate.SignatureAlgorithm.String()).To(Equal("ECDSA-SHA384"))
+
+		s, err := cert.Secret(false)
+		Expect(err).NotTo(HaveOccurred())
+		parsed, err := s.X509(true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed.Validate()).To(Succeed())
+		Expect(parsed.KeyType()).To(Equal("ed25519"))
+		Expect(parsed.CheckStrength(256)).To(Succeed())
+		Expect(parsed.Certificate.CheckSignatureFrom(ca.Certificate)).To(Succeed())
+	})
+})
@@ -0,0 +1,139 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry-community/vaultkv"
+)
+
+// SecretMetadata is the metadata that a KV v2 backend keeps for each secret,
+// alongside (but separate from) its versions.  CustomMetadata holds arbitrary
+// tags, such as an owner or a rotation interval.  Versions comes along with
+// the rest, oldest first, but can't be set.
+type SecretMetadata struct {
+	MaxVersions        uint                `json:"max_versions"`
+	CASRequired        bool                `json:"cas_required"`
+	DeleteVersionAfter string              `json:"delete_version_after"`
+	CustomMetadata     map[string]string   `json:"custom_metadata"`
+	Versions           []vaultkv.KVVersion `json:"-"`
+}
+
+// Tags returns the names of the custom metadata tags, sorted.
+func (m SecretMetadata) Tags() []string {
+	tags := make([]string, 0, len(m.CustomMetadata))
+	for tag := range m.CustomMetadata {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// metadataPath returns the API path of the metadata for the secret at path,
+// which must live in a KV v2 backend.
+func (v *Vault) metadataPath(path string) (string, error) {
+	path = Canonicalize(path)
+	version, err := v.MountVersion(path)
+	if err != nil {
+		return "", err
+	}
+	if version != 2 {
+		return "", fmt.Errorf("`%s' is in a KV v%d backend, which does not keep metadata", path, version)
+	}
+
+	mount, subpath, err := v.splitMount(path)
+	if err != nil {
+		return "", err
+	}
+	if subpath == "" {
+		return "", fmt.Errorf("`%s' is a mount, not a secret", path)
+	}
+	return fmt.Sprintf("%s/metadata/%s", mount, subpath), nil
+}
+
+// Metadata retrieves the metadata of the secret at path, versions and all,
+// so that anything after both only has to ask the Vault once.
+func (v *Vault) Metadata(path string) (*SecretMetadata, error) {
+	path = v.resolve(path)
+	secret, _, _ := ParsePath(path)
+	api, err := v.metadataPath(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw struct {
+		SecretMetadata
+		Versions map[string]struct {
+			CreatedTime  string `json:"created_time"`
+			DeletionTime string `json:"deletion_time"`
+			Destroyed    bool   `json:"destroyed"`
+		} `json:"versions"`
+	}
+	err = v.client.Client.Get(api, &raw)
+	if vaultkv.IsNotFound(err) {
+		return nil, NewSecretNotFoundError(secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := raw.SecretMetadata
+	if m.CustomMetadata == nil {
+		m.CustomMetadata = map[string]string{}
+	}
+	for number, version := range raw.Versions {
+		n, err := strconv.ParseUint(number, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse metadata of `%s': bad version `%s'", secret, number)
+		}
+		created, _ := time.Parse(time.RFC3339Nano, version.CreatedTime)
+		/* a version that was never deleted has a blank deletion_time */
+		_, err = time.Parse(time.RFC3339Nano, version.DeletionTime)
+		m.Versions = append(m.Versions, vaultkv.KVVersion{
+			Version:   uint(n),
+			CreatedAt: created,
+			Deleted:   err == nil,
+			Destroyed: version.Destroyed,
+		})
+	}
+	sort.Slice(m.Versions, func(i, j int) bool { return m.Versions[i].Version < m.Versions[j].Version })
+	return &m, nil
+}
+
+// SetMetadata replaces the metadata of the secret at path.  Vault replaces
+// the custom metadata wholesale, so any tags that should be kept must be
+// present in m.
+func (v *Vault) SetMetadata(path string, m SecretMetadata) error {
+	path = v.resolve(path)
+	secret, _, _ := ParsePath(path)
+	api, err := v.metadataPath(secret)
+	if err != nil {
+		return err
+	}
+	if m.CustomMetadata == nil {
+		m.CustomMetadata = map[string]string{}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	res, err := v.Curl("POST", api, data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 && res.StatusCode != 204 {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		return DecodeErrorResponse(body)
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+package vault
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// A PasswordGenerator generates new passwords, and can tell whether an
+// existing password looks like one of its own.
+type PasswordGenerator interface {
+	Generate() (string, error)
+
+	// Check returns an error explaining why the password could not have
+	// been generated by this generator, or nil if it could have been.
+	Check(password string) error
+
+	// String describes the passwords generated, i.e. "64-character password".
+	String() string
+}
+
+// The password generators that NewPasswordGenerator knows about.
+const (
+	GeneratorRandom        = "random"
+	GeneratorPassphrase    = "passphrase"
+	GeneratorPronounceable = "pronounceable"
+)
+
+// PasswordOptions configures a PasswordGenerator.  Length is in characters,
+// except for passphrases, where it is in words.  Policy and the composition
+// rules (the Min* counts, Unique and Unambiguous) only apply to random
+// passwords, and Separator only to passphrases.
+type PasswordOptions struct {
+	Generator string `json:"generator,omitempty"`
+	Length    int    `json:"length,omitempty"`
+	Policy    string `json:"policy,omitempty"`
+
+	MinLower    int  `json:"min_lower,omitempty"`
+	MinUpper    int  `json:"min_upper,omitempty"`
+	MinDigits   int  `json:"min_digits,omitempty"`
+	MinSymbols  int  `json:"min_symbols,omitempty"`
+	Unique      bool `json:"unique,omitempty"`
+	Unambiguous bool `json:"unambiguous,omitempty"`
+
+	Separator string `json:"separator,omitempty"`
+}
+
+// NewPasswordGenerator returns the generator named in opts, after checking
+// that its options make sense.  An empty name means a random password.
+func NewPasswordGenerator(opts PasswordOptions) (PasswordGenerator, error) {
+	if opts.Length < 0 {
+		return nil, fmt.Errorf("invalid password length %d", opts.Length)
+	}
+
+	switch opts.Generator {
+	case "", GeneratorRandom:
+		return newRandomPassword(opts)
+
+	case GeneratorPassphrase, GeneratorPronounceable:
+		if opts.Policy != "" || opts.MinLower+opts.MinUpper+opts.MinDigits+opts.MinSymbols > 0 || opts.Unique || opts.Unambiguous {
+			return nil, fmt.Errorf("character policies and composition rules only apply to random passwords, not %ss", opts.Generator)
+		}
+		if opts.Generator == GeneratorPassphrase {
+			if opts.Length == 0 {
+				opts.Length = 6
+			}
+			return &passphrase{words: opts.Length, separator: opts.Separator, list: effWordList}, nil
+		}
+		if opts.Length == 0 {
+			opts.Length = 64
+		}
+		return &pronounceablePassword{length: opts.Length}, nil
+	}
+	return nil, fmt.Errorf("unrecognized password generator '%s', must be one of: random, passphrase, pronounceable", opts.Generator)
+}
+
+// InferPasswordOptions works out the options that a random password was
+// most likely generated with: its length, and a policy that allows every
+// class of character found in it.  Any symbol at all lets in every symbol,
+// so that the policy doesn't narrow each time the password is regenerated.
+func InferPasswordOptions(password string) PasswordOptions {
+	var lower, upper, digit, symbol bool
+	for i := 0; i < len(password); i++ {
+		switch c := password[i]; {
+		case charClasses[0].matches(c):
+			lower = true
+		case charClasses[1].matches(c):
+			upper = true
+		case charClasses[2].matches(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	var policy strings.Builder
+	if lower {
+		policy.WriteString("a-z")
+	}
+	if upper {
+		policy.WriteString("A-Z")
+	}
+	if digit {
+		policy.WriteString("0-9")
+	}
+	if symbol {
+		policy.WriteString("[:punct:]")
+	}
+	return PasswordOptions{Length: utf8.RuneCountInString(password), Policy: policy.String()}
+}
+
+// randomIndex picks a number in [0,n) using a cryptographically secure
+// source of randomness.
+func randomIndex(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(i.Int64()), nil
+}
+
+// ambiguous characters are too easily mistaken for one another when a
+// password has to be read off a screen and typed in.
+const ambiguous = "0O1lI|"
+
+type randomPassword struct {
+	length  int
+	policy  string
+	charset string
+
+	// minimum counts, keyed by character class
+	min    map[string]int
+	unique bool
+}
+
+var charClasses = []struct {
+	name    string
+	matches func(byte) bool
+}{
+	{"lowercase", func(c byte) bool { return c >= 'a' && c <= 'z' }},
+	{"uppercase", func(c byte) bool { return c >= 'A' && c <= 'Z' }},
+	{"digit", func(c byte) bool { return c >= '0' && c <= '9' }},
+	{"symbol", func(c byte) bool { return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') }},
+}
+
+func newRandomPassword(opts PasswordOptions) (*randomPassword, error) {
+	p := &randomPassword{
+		length: opts.Length,
+		policy: opts.Policy,
+		unique: opts.Unique,
+		min: map[string]int{
+			"lowercase": opts.MinLower,
+			"uppercase": opts.MinUpper,
+			"digit":     opts.MinDigits,
+			"symbol":    opts.MinSymbols,
+		},
+	}
+	if p.length == 0 {
+		p.length = 64
+	}
+	if p.policy == "" {
+		p.policy = "a-zA-Z0-9"
+	}
+
+	re, err := regexp.Compile("[^" + p.policy + "]")
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy '%s': %s", p.policy, err)
+	}
+	p.charset = re.ReplaceAllString(chars, "")
+	if opts.Unambiguous {
+		p.charset = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(ambiguous, r) {
+				return -1
+			}
+			return r
+		}, p.charset)
+	}
+	if p.charset == "" {
+		return nil, fmt.Errorf("policy '%s' does not allow any characters", p.policy)
+	}
+
+	total := 0
+	for _, class := range charClasses {
+		n := p.min[class.name]
+		if n < 0 {
+			return nil, fmt.Errorf("invalid minimum number of %s characters (%d)", class.name, n)
+		}
+		if n > 0 && len(p.pool(class.matches)) == 0 {
+			return nil, fmt.Errorf("cannot require %s characters; policy '%s' does not allow any", class.name, p.policy)
+		}
+		if p.unique && n > len(p.pool(class.matches)) {
+			return nil, fmt.Errorf("cannot require %d %s characters without repeating any", n, class.name)
+		}
+		total += n
+	}
+	if total > p.length {
+		return nil, fmt.Errorf("cannot fit %d required characters into a %d-character password", total, p.length)
+	}
+	if p.unique && p.length > len(p.charset) {
+		return nil, fmt.Errorf("cannot generate a %d-character password without repeating characters; policy '%s' only allows %d different characters", p.length, p.policy, len(p.charset))
+	}
+	return p, nil
+}
+
+// pool returns the characters in the charset that are in a given class.
+func (p *randomPassword) pool(matches func(byte) bool) []byte {
+	var pool []byte
+	for i := 0; i < len(p.charset); i++ {
+		if matches(p.charset[i]) {
+			pool = append(pool, p.charset[i])
+		}
+	}
+	return pool
+}
+
+func (p *randomPassword) Generate() (string, error) {
+	var (
+		password []byte
+		used     = map[byte]bool{}
+	)
+
+	pick := func(matches func(byte) bool) error {
+		var pool []byte
+		for _, c := range p.pool(matches) {
+			if !p.unique || !used[c] {
+				pool = append(pool, c)
+			}
+		}
+		i, err := randomIndex(len(pool))
+		if err != nil {
+			return err
+		}
+		password = append(password, pool[i])
+		used[pool[i]] = true
+		return nil
+	}
+
+	//First, satisfy the minimums for each class of character...
+	for _, class := range charClasses {
+		for n := 0; n < p.min[class.name]; n++ {
+			if err := pick(class.matches); err != nil {
+				return "", err
+			}
+		}
+	}
+	//...then fill out the rest from the whole charset...
+	for len(password) < p.length {
+		if err := pick(func(byte) bool { return true }); err != nil {
+			return "", err
+		}
+	}
+	//...and shuffle, so that the required characters could be anywhere.
+	for i := len(password) - 1; i > 0; i-- {
+		j, err := randomIndex(i + 1)
+		if err != nil {
+			return "", err
+		}
+		password[i], password[j] = password[j], password[i]
+	}
+	return string(password), nil
+}
+
+func (p *randomPassword) Check(password string) error {
+	if len(password) != p.length {
+		return fmt.Errorf("length is %d, not %d", len(password), p.length)
+	}
+	seen := map[byte]bool{}
+	for i := 0; i < len(password); i++ {
+		c := password[i]
+		if !strings.ContainsRune(p.charset, rune(c)) {
+			return fmt.Errorf("does not match policy [%s]", p.policy)
+		}
+		if p.unique && seen[c] {
+			return fmt.Errorf("repeats characters")
+		}
+		seen[c] = true
+	}
+	for _, class := range charClasses {
+		n := 0
+		for i := 0; i < len(password); i++ {
+			if class.matches(password[i]) {
+				n++
+			}
+		}
+		if n < p.min[class.name] {
+			return fmt.Errorf("has %d %s characters, not at least %d", n, class.name, p.min[class.name])
+		}
+	}
+	return nil
+}
+
+func (p *randomPassword) String() string {
+	return fmt.Sprintf("%d-character password", p.length)
+}
+
+type passphrase struct {
+	words     int
+	separator string
+	list      []string
+}
+
+func (p *passphrase) Generate() (string, error) {
+	words := make([]string, p.words)
+	for i := range words {
+		n, err := randomIndex(len(p.list))
+		if err != nil {
+			return "", err
+		}
+		words[i] = p.list[n]
+	}
+	return strings.Join(words, p.separator), nil
+}
+
+func (p *passphrase) Check(password string) error {
+	//Without a separator, there's no telling where one word ends and the
+	// next begins, so take it on faith.
+	if p.separator == "" {
+		return nil
+	}
+	if n := len(strings.Split(password, p.separator)); n != p.words {
+		return fmt.Errorf("has %d words, not %d", n, p.words)
+	}
+	return nil
+}
+
+func (p *passphrase) String() string {
+	return fmt.Sprintf("%d-word passphrase", p.words)
+}
+
+// pronounceablePassword alternates consonants and vowels, so that passwords
+// can be read out loud.  They are all lowercase, and so weaker than random
+// passwords of the same length: a 64-character pronounceable password has
+// around 210 bits of entropy.
+type pronounceablePassword struct {
+	length int
+}
+
+const (
+	consonants = "bcdfghjklmnprstvwz"
+	vowels     = "aeiou"
+)
+
+func (p *pronounceablePassword) Generate() (string, error) {
+	vowel, err := randomIndex(2)
+	if err != nil {
+		return "", err
+	}
+
+	password := make([]byte, p.length)
+	for i := range password {
+		set := consonants
+		if (i+vowel)%2 == 1 {
+			set = vowels
+		}
+		n, err := randomIndex(len(set))
+		if err != nil {
+			return "", err
+		}
+		password[i] = set[n]
+	}
+	return string(password), nil
+}
+
+func (p *pronounceablePassword) Check(password string) error {
+	if len(password) != p.length {
+		return fmt.Errorf("length is %d, not %d", len(password), p.length)
+	}
+	if strings.Trim(password, consonants+vowels) != "" {
+		return fmt.Errorf("is not pronounceable")
+	}
+	return nil
+}
+
+func (p *pronounceablePassword) String() string {
+	return fmt.Sprintf("%d-character pronounceable password", p.length)
+}
@@ -0,0 +1,97 @@
+package vault_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/safe/vault"
+)
+
+var _ = Describe("Password generators", func() {
+	It("satisfies composition rules", func() {
+		gen, err := vault.NewPasswordGenerator(vault.PasswordOptions{
+			Length:     12,
+			Policy:     "a-z0-9!@",
+			MinDigits:  4,
+			MinSymbols: 2,
+			Unique:     true,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 50; i++ {
+			pw, err := gen.Generate()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pw).To(MatchRegexp(`^[a-z0-9!@]{12}$`))
+			Expect(strings.Count(pw, "!") + strings.Count(pw, "@")).To(Equal(2))
+			Expect(len(strings.Map(func(r rune) rune {
+				if r >= '0' && r <= '9' {
+					return r
+				}
+				return -1
+			}, pw))).To(BeNumerically(">=", 4))
+			Expect(gen.Check(pw)).To(Succeed())
+		}
+
+		Expect(gen.Check("aabbccddeeff")).NotTo(Succeed())
+		Expect(gen.Check("abcdefghijkl")).NotTo(Succeed())
+	})
+
+	It("rejects rules that cannot be satisfied", func() {
+		for _, opts := range []vault.PasswordOptions{
+			{Length: 4, MinDigits: 3, MinUpper: 2},
+			{Length: 8, Policy: "a-z", MinDigits: 1},
+			{Length: 11, Policy: "0-9", Unique: true},
+			{Length: 8, Policy: "01lI", Unambiguous: true},
+			{Generator: "passphrase", MinDigits: 1},
+			{Generator: "diceware"},
+		} {
+			_, err := vault.NewPasswordGenerator(opts)
+			Expect(err).To(HaveOccurred())
+		}
+	})
+
+	It("generates passphrases", func() {
+		gen, err := vault.NewPasswordGenerator(vault.PasswordOptions{Generator: "passphrase", Separator: "-"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gen.String()).To(Equal("6-word passphrase"))
+
+		pw, err := gen.Generate()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pw).To(MatchRegexp(`^[a-z]+(-[a-z]+){5}$`))
+		Expect(gen.Check(pw)).To(Succeed())
+		Expect(gen.Check("correct-horse-battery-staple")).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("Inferring password options", func() {
+	It("allows only the classes of characters that were used", func() {
+		opts := vault.InferPasswordOptions("abcDEF123-!")
+		Expect(opts.Length).To(Equal(11))
+		Expect(opts.Policy).To(Equal(`a-zA-Z0-9[:punct:]`))
+
+		gen, err := vault.NewPasswordGenerator(opts)
+		Expect(err).NotTo(HaveOccurred())
+		pw, err := gen.Generate()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pw).To(MatchRegexp(`^[a-zA-Z0-9[:punct:]]{11}$`))
+		Expect(gen.Check("abcDEF123-!")).To(Succeed())
+
+		Expect(vault.InferPasswordOptions("0123456789").Policy).To(Equal("0-9"))
+	})
+
+	It("allows every symbol, not just the ones that were used", func() {
+		gen, err := vault.NewPasswordGenerator(vault.InferPasswordOptions("abc-"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gen.Check("abc~")).To(Succeed())
+	})
+
+	It("copes with spaces and characters outside of ASCII", func() {
+		for _, pw := range []string{"correct horse", "tab\there", "grüße"} {
+			opts := vault.InferPasswordOptions(pw)
+			_, err := vault.NewPasswordGenerator(opts)
+			Expect(err).NotTo(HaveOccurred(), pw)
+		}
+		Expect(vault.InferPasswordOptions("grüße").Length).To(Equal(5))
+	})
+})
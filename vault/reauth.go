@@ -0,0 +1,85 @@
+package vault
+
+import (
+	"net/http"
+	"strings"
+)
+
+// A Reauthenticator logs in again, once the token that a Vault was using
+// has expired (or been revoked), and returns the new one.
+type Reauthenticator func() (string, error)
+
+// SetReauthenticator has requests that the Vault refuses, because the
+// token is no longer any good, retried with the token that reauth logs in
+// for.  If that fails, it isn't tried again.  Other requests may be in
+// flight while reauth runs, so it must not log in with this Vault's client,
+// which would change its token out from under them.
+func (v *Vault) SetReauthenticator(reauth Reauthenticator) {
+	v.reauthLock.Lock()
+	defer v.reauthLock.Unlock()
+	v.reauth, v.reauthFailed = reauth, false
+}
+
+// reauthenticate returns the token to retry a request that was refused
+// with old, logging in again if old has expired.  If the request was
+// refused for some other reason (say, a policy), there is nothing to retry.
+func (v *Vault) reauthenticate(old string) (string, bool) {
+	v.reauthLock.Lock()
+	defer v.reauthLock.Unlock()
+	if v.reauth == nil || v.reauthFailed {
+		return "", false
+	}
+	if token := v.Token(); token != old {
+		/* another request has logged in again already */
+		return token, true
+	}
+
+	res, err := v.Curl("GET", "auth/token/lookup-self", nil)
+	if err != nil {
+		return "", false
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		return "", false
+	}
+
+	token, err := v.reauth()
+	if err != nil || token == "" {
+		v.reauthFailed = true
+		return "", false
+	}
+	v.SetToken(token)
+	return token, true
+}
+
+// reauthTransport retries requests that are refused because the token
+// has expired, once the Vault has logged in again.
+type reauthTransport struct {
+	vault *Vault
+	base  http.RoundTripper
+}
+
+func (t *reauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	/* logging in (and checking tokens) is never retried */
+	if err != nil || res.StatusCode != http.StatusForbidden || strings.Contains(req.URL.Path, "/v1/auth/") {
+		return res, err
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return res, err
+	}
+
+	token, ok := t.vault.reauthenticate(req.Header.Get("X-Vault-Token"))
+	if !ok {
+		return res, err
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return res, nil
+		}
+	}
+	retry.Header.Set("X-Vault-Token", token)
+	res.Body.Close()
+	return t.base.RoundTrip(retry)
+}
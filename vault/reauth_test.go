@@ -0,0 +1,102 @@
+package vault_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/safe/vault"
+)
+
+var _ = Describe("Reauthentication", func() {
+	var server *httptest.Server
+	var v *vault.Vault
+	var valid, policy string
+	var logins int
+
+	BeforeEach(func() {
+		valid, policy, logins = "new", "", 0
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get("X-Vault-Token")
+			switch {
+			case token != valid:
+				w.WriteHeader(http.StatusForbidden)
+			case r.URL.Path == "/v1/"+policy:
+				w.WriteHeader(http.StatusForbidden)
+			default:
+				w.WriteHeader(http.StatusOK)
+			}
+		}))
+
+		var err error
+		v, err = vault.NewVault(vault.VaultConfig{URL: server.URL, Token: "old"})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	status := func(path string) int {
+		res, err := v.Curl("GET", path, nil)
+		Expect(err).NotTo(HaveOccurred())
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	It("retries a refused request once it has logged in again", func() {
+		v.SetReauthenticator(func() (string, error) {
+			logins++
+			return "new", nil
+		})
+		Expect(status("secret/x")).To(Equal(http.StatusOK))
+		Expect(status("secret/y")).To(Equal(http.StatusOK))
+		Expect(logins).To(Equal(1))
+	})
+
+	It("logs in again once, for all of the requests refused at the same time", func() {
+		v.SetReauthenticator(func() (string, error) {
+			logins++
+			return "new", nil
+		})
+
+		statuses := make(chan int)
+		for i := 0; i < 20; i++ {
+			go func(i int) {
+				defer GinkgoRecover()
+				statuses <- status(fmt.Sprintf("secret/%d", i))
+			}(i)
+		}
+		for i := 0; i < 20; i++ {
+			Expect(<-statuses).To(Equal(http.StatusOK))
+		}
+		Expect(logins).To(Equal(1))
+		Expect(v.Token()).To(Equal("new"))
+	})
+
+	It("does not log in again when the token is still good", func() {
+		valid, policy = "old", "secret/x"
+		v.SetReauthenticator(func() (string, error) {
+			logins++
+			return "new", nil
+		})
+		Expect(status("secret/x")).To(Equal(http.StatusForbidden))
+		Expect(logins).To(Equal(0))
+	})
+
+	It("gives up after failing to log in again", func() {
+		v.SetReauthenticator(func() (string, error) {
+			logins++
+			return "", fmt.Errorf("no password to log in with")
+		})
+		Expect(status("secret/x")).To(Equal(http.StatusForbidden))
+		Expect(status("secret/x")).To(Equal(http.StatusForbidden))
+		Expect(logins).To(Equal(1))
+	})
+
+	It("leaves refused requests alone without a way to log in again", func() {
+		Expect(status("secret/x")).To(Equal(http.StatusForbidden))
+	})
+})
@@ -1,24 +1,20 @@
 package vault
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 )
 
-func rsakey(bits int) (string, string, error) {
-	key, err := rsa.GenerateKey(rand.Reader, bits)
+func rsakey(keyType string, bits int) (string, string, error) {
+	key, err := GenerateKey(keyType, bits)
 	if err != nil {
 		return "", "", err
 	}
 
-	private := pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(key),
-		},
-	)
+	private, err := encodePrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
 
 	b, err := x509.MarshalPKIXPublicKey(key.Public())
 	if err != nil {
@@ -19,10 +19,16 @@ import (
 // want, including passwords, RSAKey keys, usernames, etc.
 type Secret struct {
 	data map[string]string
+
+	//readFrom is set on secrets that came from Vault.Read, so that writing
+	// them back can check that no one else has written the secret since.
+	// version is the (KV v2) version that was read; zero if there wasn't one.
+	readFrom string
+	version  uint
 }
 
 func NewSecret() *Secret {
-	return &Secret{make(map[string]string)}
+	return &Secret{data: make(map[string]string)}
 }
 
 func (s Secret) MarshalJSON() ([]byte, error) {
@@ -150,9 +156,9 @@ func (s *Secret) DHParam(length int, skipIfExists bool) error {
 	return nil
 }
 
-// Password creates and stores a new randomized password.
-func (s *Secret) Password(key string, length int, policy string, skipIfExists bool) error {
-	r, err := random(length, policy)
+// Password creates and stores a new password, made by the given generator.
+func (s *Secret) Password(key string, gen PasswordGenerator, skipIfExists bool) error {
+	r, err := gen.Generate()
 	if err != nil {
 		return err
 	}
@@ -231,8 +237,9 @@ func (s *Secret) keypair(private, public string, fingerprint string, skipIfExist
 
 // RSAKey generates a new public/private keypair, and stores
 // it in the secret, under the 'public' and 'private' keys.
-func (s *Secret) RSAKey(bits int, skipIfExists bool) error {
-	private, public, err := rsakey(bits)
+// Despite the name, keyType can be any of the KeyType* constants.
+func (s *Secret) RSAKey(keyType string, bits int, skipIfExists bool) error {
+	private, public, err := rsakey(keyType, bits)
 	if err != nil {
 		return err
 	}
@@ -241,8 +248,8 @@ func (s *Secret) RSAKey(bits int, skipIfExists bool) error {
 
 // SSHKey generates a new public/private keypair, and stores
 // it in the secret, under the 'public' and 'private' keys.
-func (s *Secret) SSHKey(bits int, skipIfExists bool) error {
-	private, public, fingerprint, err := sshkey(bits)
+func (s *Secret) SSHKey(keyType string, bits int, skipIfExists bool) error {
+	private, public, fingerprint, err := sshkey(keyType, bits)
 	if err != nil {
 		return err
 	}
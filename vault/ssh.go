@@ -1,28 +1,32 @@
 package vault
 
 import (
+	"crypto/ed25519"
 	"crypto/md5"
 	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"strings"
 )
 
-func sshkey(bits int) (string, string, string, error) {
-	key, err := rsa.GenerateKey(rand.Reader, bits)
+func sshkey(keyType string, bits int) (string, string, string, error) {
+	key, err := GenerateKey(keyType, bits)
 	if err != nil {
 		return "", "", "", err
 	}
 
-	private := pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(key),
-		},
-	)
+	var private []byte
+	if k, ok := key.(ed25519.PrivateKey); ok {
+		//OpenSSH only reads Ed25519 keys in its own format
+		private, err = encodeOpenSSHEd25519(k)
+	} else {
+		private, err = encodePrivateKey(key)
+	}
+	if err != nil {
+		return "", "", "", err
+	}
 
 	pub := key.Public()
 	pubkey, err := ssh.NewPublicKey(pub)
@@ -40,3 +44,58 @@ func sshkey(bits int) (string, string, string, error) {
 
 	return string(private), string(public), string(fingerprint), nil
 }
+
+// encodeOpenSSHEd25519 writes an unencrypted "openssh-key-v1" private key,
+// as described in OpenSSH's PROTOCOL.key.
+func encodeOpenSSHEd25519(key ed25519.PrivateKey) ([]byte, error) {
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+	priv := struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+		Pad     []byte `ssh:"rest"`
+	}{
+		Check1:  binary.BigEndian.Uint32(check[:]),
+		Check2:  binary.BigEndian.Uint32(check[:]),
+		Keytype: ssh.KeyAlgoED25519,
+		Pub:     []byte(key.Public().(ed25519.PublicKey)),
+		Priv:    []byte(key),
+	}
+	//The private section is padded out to the cipher's block size (8, for
+	// "none") with the bytes 1, 2, 3...
+	n := len(ssh.Marshal(priv)) % 8
+	for i := 0; n != 0 && i < 8-n; i++ {
+		priv.Pad = append(priv.Pad, byte(i+1))
+	}
+
+	w := struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{
+		CipherName:   "none",
+		KdfName:      "none",
+		NumKeys:      1,
+		PubKey:       pub.Marshal(),
+		PrivKeyBlock: ssh.Marshal(priv),
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte("openssh-key-v1\x00"), ssh.Marshal(w)...),
+	}), nil
+}
@@ -0,0 +1,252 @@
+package vault
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cloudfoundry-community/vaultkv"
+)
+
+// A Transaction keeps track of what every secret looked like before it was
+// first changed, by any Vault that has joined it, so that all of those
+// changes can be undone if something later on goes wrong.  For KV v2
+// backends, this is the latest version (and its contents, in case it gets
+// destroyed); for KV v1 backends, it's the whole secret.
+type Transaction struct {
+	lock        sync.Mutex
+	changes     []*txChange
+	seen        map[string]bool
+	over        bool
+	rolledBack  bool
+	writing     sync.WaitGroup
+	rollingBack sync.Mutex
+}
+
+type txChange struct {
+	vault   *Vault
+	path    string
+	kv      uint
+	version uint
+	alive   bool
+	data    map[string]string
+}
+
+// A Rollback is what had to be done to one secret to roll a Transaction
+// back, and whether it worked.
+type Rollback struct {
+	Path   string
+	Action string
+	Error  error
+}
+
+// Unchanged is the Action of secrets that didn't need rolling back.
+const Unchanged = "nothing to do"
+
+func NewTransaction() *Transaction {
+	return &Transaction{seen: make(map[string]bool)}
+}
+
+// Join makes the Vault record everything it is about to change in t.
+func (v *Vault) Join(t *Transaction) {
+	v.tx = t
+}
+
+// Paths returns the secrets that have been changed, in the order they were
+// first changed.
+func (t *Transaction) Paths() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	paths := make([]string, 0, len(t.changes))
+	for _, c := range t.changes {
+		paths = append(paths, c.path)
+	}
+	return paths
+}
+
+// ErrRolledBack is what changing a secret fails with, once the transaction
+// that the Vault joined has been rolled back (say, from a signal handler).
+var ErrRolledBack = fmt.Errorf("the transaction has been rolled back")
+
+// touch records the state of the secret at path, unless it has already been
+// recorded.  It must be called before anything changes the secret, and the
+// function it returns once the change has been made, so that a rollback
+// waits for it, instead of racing it.
+func (v *Vault) touch(path string) (func(), error) {
+	if v.tx == nil {
+		return func() {}, nil
+	}
+	v.tx.lock.Lock()
+	defer v.tx.lock.Unlock()
+	if v.tx.rolledBack {
+		return func() {}, ErrRolledBack
+	}
+	if v.tx.over {
+		return func() {}, nil
+	}
+	path, _, _ = ParsePath(path)
+	path = Canonicalize(path)
+	id := fmt.Sprintf("%s|%s|%s", v.client.Client.VaultURL, v.client.Client.Namespace, path)
+	if !v.tx.seen[id] {
+		if err := v.record(path); err != nil {
+			return func() {}, err
+		}
+		v.tx.seen[id] = true
+	}
+	v.tx.writing.Add(1)
+	return v.tx.writing.Done, nil
+}
+
+// record adds the state of the secret at path to the transaction.
+func (v *Vault) record(path string) error {
+	c := &txChange{vault: v, path: path}
+	kv, err := v.MountVersion(path)
+	if err != nil {
+		return fmt.Errorf("unable to record `%s' for rolling back: %s", path, err)
+	}
+	c.kv = kv
+	if kv == 2 {
+		if c.version, err = v.currentVersion(path); err != nil {
+			return fmt.Errorf("unable to record `%s' for rolling back: %s", path, err)
+		}
+	}
+	s, err := v.Read(path)
+	if err != nil && !IsNotFound(err) {
+		return fmt.Errorf("unable to record `%s' for rolling back: %s", path, err)
+	}
+	if err == nil {
+		c.alive, c.data = true, s.data
+	}
+
+	v.tx.changes = append(v.tx.changes, c)
+	return nil
+}
+
+// Rollback puts every secret changed during the transaction back the way it
+// was, newest change first, and ends the transaction.  Secrets in KV v2
+// backends that were overwritten get their old contents written back as a
+// new version; secrets that didn't exist are deleted.  Once a transaction
+// is over, rolling it back does nothing.  Changes that are being made when
+// it is rolled back are waited for; any made after fail with ErrRolledBack.
+// Rolling back while another rollback is under way waits for it to finish.
+func (t *Transaction) Rollback() []Rollback {
+	t.rollingBack.Lock()
+	defer t.rollingBack.Unlock()
+	t.lock.Lock()
+	if t.over {
+		t.lock.Unlock()
+		return nil
+	}
+	t.over, t.rolledBack = true, true
+	t.lock.Unlock()
+	t.writing.Wait()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	done := make([]Rollback, 0, len(t.changes))
+	for i := len(t.changes) - 1; i >= 0; i-- {
+		c := t.changes[i]
+		action, err := c.rollback()
+		done = append(done, Rollback{Path: c.path, Action: action, Error: err})
+	}
+	return done
+}
+
+// Commit ends the transaction, keeping every change.
+func (t *Transaction) Commit() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.over = true
+}
+
+func (c *txChange) rollback() (string, error) {
+	v := c.vault
+	if c.kv != 2 {
+		s, err := v.Read(c.path)
+		if err != nil && !IsNotFound(err) {
+			return "check", err
+		}
+		exists := err == nil
+		switch {
+		case !c.alive && !exists:
+			return Unchanged, nil
+		case !c.alive:
+			return "delete", v.client.Delete(c.path, &vaultkv.KVDeleteOpts{V1Destroy: true})
+		case exists && sameData(s.data, c.data):
+			return Unchanged, nil
+		}
+		_, err = v.client.Set(c.path, c.data, nil)
+		return "restore", err
+	}
+
+	versions, err := v.Versions(c.path)
+	if err != nil && !IsNotFound(err) {
+		return "check", err
+	}
+	if len(versions) == 0 {
+		if c.version == 0 {
+			return Unchanged, nil
+		}
+		//Even the metadata is gone; all we can do is write it back
+		if !c.alive {
+			return Unchanged, nil
+		}
+		return fmt.Sprintf("restore version %d as a new version", c.version), c.restore(0)
+	}
+
+	if c.version == 0 {
+		return "delete", v.client.DestroyAll(c.path)
+	}
+
+	latest := versions[len(versions)-1]
+	if latest.Version == c.version {
+		switch {
+		case latest.Alive() == c.alive:
+			return Unchanged, nil
+		case !c.alive:
+			return fmt.Sprintf("delete version %d again", c.version), v.client.Delete(c.path, &vaultkv.KVDeleteOpts{Versions: []uint{c.version}})
+		case latest.Deleted && !latest.Destroyed:
+			return fmt.Sprintf("undelete version %d", c.version), v.client.Undelete(c.path, []uint{c.version})
+		}
+	}
+
+	if !c.alive {
+		//It was deleted before, so delete everything written since
+		var since []uint
+		for _, version := range versions {
+			if version.Version > c.version && version.Alive() {
+				since = append(since, version.Version)
+			}
+		}
+		switch len(since) {
+		case 0:
+			return Unchanged, nil
+		case 1:
+			return fmt.Sprintf("delete version %d", since[0]), v.client.Delete(c.path, &vaultkv.KVDeleteOpts{Versions: since})
+		}
+		return fmt.Sprintf("delete versions %d-%d", since[0], since[len(since)-1]), v.client.Delete(c.path, &vaultkv.KVDeleteOpts{Versions: since})
+	}
+	return fmt.Sprintf("restore version %d as a new version", c.version), c.restore(latest.Version)
+}
+
+// restore writes the old contents of a KV v2 secret back, with
+// check-and-set, in case the secret requires it.
+func (c *txChange) restore(cas uint) error {
+	mount, subpath, err := c.vault.splitMount(c.path)
+	if err != nil {
+		return err
+	}
+	_, err = c.vault.client.Client.V2Set(mount, subpath, c.data, vaultkv.V2SetOpts{}.WithCAS(cas))
+	return err
+}
+
+func sameData(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+package vault_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/safe/vault"
+)
+
+var _ = Describe("Transactions", func() {
+	var kv *fakeKV
+	var v *vault.Vault
+	var tx *vault.Transaction
+
+	BeforeEach(func() {
+		kv = newFakeKV()
+		var err error
+		v, err = vault.NewVault(vault.VaultConfig{URL: kv.server.URL, Token: "root"})
+		Expect(err).NotTo(HaveOccurred())
+		tx = vault.NewTransaction()
+		v.Join(tx)
+	})
+
+	AfterEach(func() {
+		kv.Close()
+	})
+
+	secret := func(key, value string) *vault.Secret {
+		s := vault.NewSecret()
+		Expect(s.Set(key, value, false)).To(Succeed())
+		return s
+	}
+	value := func(path, key string) string {
+		s, err := v.Read(path)
+		Expect(err).NotTo(HaveOccurred())
+		return s.Get(key)
+	}
+	rollback := func() []vault.Rollback {
+		done := tx.Rollback()
+		for _, r := range done {
+			Expect(r.Error).NotTo(HaveOccurred(), r.Path)
+		}
+		return done
+	}
+
+	Context("in KV v1 backends", func() {
+		BeforeEach(func() {
+			kv.v1["v1/db"] = map[string]string{"password": "old"}
+		})
+
+		It("puts back the previous value of secrets that were changed", func() {
+			Expect(v.Write("v1/db", secret("password", "new"))).To(Succeed())
+			Expect(rollback()).To(Equal([]vault.Rollback{{Path: "v1/db", Action: "restore"}}))
+			Expect(value("v1/db", "password")).To(Equal("old"))
+		})
+
+		It("deletes secrets that didn't exist", func() {
+			Expect(v.Write("v1/new", secret("password", "new"))).To(Succeed())
+			Expect(rollback()).To(Equal([]vault.Rollback{{Path: "v1/new", Action: "delete"}}))
+			Expect(kv.v1Paths()).To(Equal([]string{"v1/db"}))
+		})
+
+		It("puts back secrets that were deleted", func() {
+			Expect(v.Delete("v1/db", vault.DeleteOpts{})).To(Succeed())
+			rollback()
+			Expect(value("v1/db", "password")).To(Equal("old"))
+		})
+	})
+
+	Context("in KV v2 backends", func() {
+		BeforeEach(func() {
+			kv.put("secret/db", map[string]string{"password": "old"})
+		})
+
+		It("writes the previous version back as a new version", func() {
+			Expect(v.Write("secret/db", secret("password", "new"))).To(Succeed())
+			Expect(rollback()).To(Equal([]vault.Rollback{{Path: "secret/db", Action: "restore version 1 as a new version"}}))
+
+			n, latest := kv.latest("secret/db")
+			Expect(n).To(Equal(uint(3)))
+			Expect(latest.data).To(Equal(map[string]string{"password": "old"}))
+		})
+
+		It("destroys secrets that didn't exist", func() {
+			Expect(v.Write("secret/new", secret("password", "new"))).To(Succeed())
+			Expect(rollback()).To(Equal([]vault.Rollback{{Path: "secret/new", Action: "delete"}}))
+
+			n, _ := kv.latest("secret/new")
+			Expect(n).To(BeZero())
+		})
+
+		It("undeletes versions that were deleted", func() {
+			Expect(v.Delete("secret/db", vault.DeleteOpts{})).To(Succeed())
+			Expect(rollback()).To(Equal([]vault.Rollback{{Path: "secret/db", Action: "undelete version 1"}}))
+			Expect(value("secret/db", "password")).To(Equal("old"))
+		})
+
+		It("writes versions that were destroyed back as a new version", func() {
+			Expect(v.Delete("secret/db", vault.DeleteOpts{Destroy: true})).To(Succeed())
+			Expect(rollback()).To(Equal([]vault.Rollback{{Path: "secret/db", Action: "restore version 1 as a new version"}}))
+			Expect(value("secret/db", "password")).To(Equal("old"))
+		})
+
+		It("deletes versions written since the secret was deleted", func() {
+			kv.v2["secret/db"][0].deleted = true
+			Expect(v.Write("secret/db", secret("password", "new"))).To(Succeed())
+			Expect(v.Write("secret/db", secret("password", "newer"))).To(Succeed())
+			Expect(rollback()).To(Equal([]vault.Rollback{{Path: "secret/db", Action: "delete versions 2-3"}}))
+
+			_, err := v.Read("secret/db")
+			Expect(vault.IsNotFound(err)).To(BeTrue())
+		})
+	})
+
+	It("undoes what did change when something later on fails", func() {
+		kv.put("secret/a", map[string]string{"password": "old"})
+		kv.put("secret/b", map[string]string{"password": "old"})
+		kv.failing["secret/b"] = true
+
+		Expect(v.Write("secret/a", secret("password", "new"))).To(Succeed())
+		Expect(v.Write("secret/b", secret("password", "new"))).NotTo(Succeed())
+		Expect(tx.Paths()).To(Equal([]string{"secret/a", "secret/b"}))
+
+		Expect(rollback()).To(Equal([]vault.Rollback{
+			{Path: "secret/b", Action: vault.Unchanged},
+			{Path: "secret/a", Action: "restore version 1 as a new version"},
+		}))
+		Expect(value("secret/a", "password")).To(Equal("old"))
+		Expect(value("secret/b", "password")).To(Equal("old"))
+	})
+
+	It("only records the state of a secret before it was first changed", func() {
+		kv.put("secret/db", map[string]string{"password": "old"})
+		Expect(v.Write("secret/db", secret("password", "new"))).To(Succeed())
+		Expect(v.Write("secret/db", secret("password", "newer"))).To(Succeed())
+		Expect(tx.Paths()).To(Equal([]string{"secret/db"}))
+
+		rollback()
+		Expect(value("secret/db", "password")).To(Equal("old"))
+	})
+
+	It("refuses to change anything once it has been rolled back", func() {
+		Expect(v.Write("secret/db", secret("password", "new"))).To(Succeed())
+		rollback()
+		Expect(v.Write("secret/db", secret("password", "newer"))).To(MatchError(vault.ErrRolledBack))
+		Expect(tx.Rollback()).To(BeEmpty())
+	})
+
+	It("keeps every change once it has been committed", func() {
+		Expect(v.Write("secret/db", secret("password", "new"))).To(Succeed())
+		tx.Commit()
+		Expect(tx.Rollback()).To(BeEmpty())
+		Expect(value("secret/db", "password")).To(Equal("new"))
+	})
+})
@@ -6,6 +6,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/cloudfoundry-community/vaultkv"
 	"github.com/jhunt/go-ansi"
@@ -115,11 +116,14 @@ type secretTree struct {
 	MountVersion uint
 	Value        string
 	Version      uint
+	CreatedAt    time.Time
 	Deleted      bool
 	Destroyed    bool
+	Metadata     *SecretMetadata
 }
 
 func (v *Vault) ConstructSecrets(path string, opts TreeOpts) (s Secrets, err error) {
+	path = v.resolve(path)
 	constructTreeOpts := opts
 	//It's easier to analyze which secrets to purge once we have it structured as an array.
 	//So we let the tree just naively fetch secrets, and then we can clean up the results later
@@ -217,18 +221,23 @@ func (t secretTree) convertToSecrets() Secrets {
 	t.DepthFirstMap(func(t *secretTree) {
 		if t.Type == treeTypeSecret || t.Type == treeTypeDirAndSecret {
 			thisEntry := SecretEntry{
-				Path: Canonicalize(t.Name),
+				Path:         Canonicalize(t.Name),
+				MountVersion: t.MountVersion,
 			}
 
 			for _, version := range t.Branches {
 				if version.Type != treeTypeVersion {
 					continue
 				}
+				if version.Metadata != nil {
+					thisEntry.Metadata = version.Metadata
+				}
 
 				thisVersion := SecretVersion{
-					Data:   NewSecret(),
-					Number: version.Version,
-					State:  SecretStateAlive,
+					Data:      NewSecret(),
+					Number:    version.Version,
+					State:     SecretStateAlive,
+					CreatedAt: version.CreatedAt,
 				}
 
 				if version.Destroyed {
@@ -277,6 +286,12 @@ func (s *Secrets) Append(e SecretEntry) {
 type SecretEntry struct {
 	Path     string
 	Versions []SecretVersion
+	//MountVersion is the KV version of the backend the secret lives in, if
+	// known. Zero if the entry didn't come from a tree walk.
+	MountVersion uint
+	//Metadata is only fetched for secrets in KV v2 backends, and only if
+	// FetchMetadata was set. Nil otherwise.
+	Metadata *SecretMetadata
 }
 
 const (
@@ -289,6 +304,8 @@ type SecretVersion struct {
 	Data   *Secret
 	Number uint
 	State  uint
+	//CreatedAt is only known for versions read from a KV v2 backend
+	CreatedAt time.Time
 }
 
 type TreeOpts struct {
@@ -308,6 +325,9 @@ type TreeOpts struct {
 	GetDeletedVersions bool
 	//Only perform gets. If the target is not a secret, then an error is returned
 	GetOnly bool
+	//Whether to get the metadata (i.e. the custom metadata tags) of secrets
+	// in v2 backends
+	FetchMetadata bool
 }
 
 func (v *Vault) constructTree(path string, opts TreeOpts) (*secretTree, error) {
@@ -433,11 +453,11 @@ func (t *secretTree) getWorkType(opts TreeOpts) uint16 {
 		ret = opTypeList
 	case treeTypeDirAndSecret:
 		ret = opTypeList
-		if opts.FetchKeys || !opts.SkipVersionInfo {
+		if opts.FetchKeys || opts.FetchMetadata || !opts.SkipVersionInfo {
 			ret |= opTypeVersions
 		}
 	case treeTypeSecret:
-		if opts.FetchKeys || !opts.SkipVersionInfo {
+		if opts.FetchKeys || opts.FetchMetadata || !opts.SkipVersionInfo {
 			ret |= opTypeVersions
 		}
 	case treeTypeVersion:
@@ -482,6 +502,12 @@ type TreeCopyOpts struct {
 }
 
 func (s SecretEntry) Copy(v *Vault, dst string, opts TreeCopyOpts) error {
+	release, err := v.touch(dst)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	if opts.Clear {
 		err := v.Client().DestroyAll(dst)
 		if err != nil {
@@ -618,13 +644,20 @@ func (s Secrets) printableTree(color, secrets bool, index int) *tree.Node {
 	}
 	isSecret := index == len(firstSplit)-1
 
-	var dirFmt, secFmt, keyFmt = "%s/", "%s", ":%s"
+	var dirFmt, secFmt, keyFmt, tagFmt = "%s/", "%s", ":%s", "  [%s]"
 	if color {
-		dirFmt, secFmt, keyFmt = "@B{%s/}", "@G{%s}", "@Y{:%s}"
+		dirFmt, secFmt, keyFmt, tagFmt = "@B{%s/}", "@G{%s}", "@Y{:%s}", "  @M{[%s]}"
 	}
 
 	if isSecret {
 		thisName = ansi.Sprintf(secFmt, thisName)
+		if m := s[0].Metadata; m != nil && len(m.CustomMetadata) > 0 {
+			var tags []string
+			for _, tag := range m.Tags() {
+				tags = append(tags, tag+"="+m.CustomMetadata[tag])
+			}
+			thisName += ansi.Sprintf(tagFmt, strings.Join(tags, ", "))
+		}
 	} else {
 		thisName = ansi.Sprintf(dirFmt, thisName)
 	}
@@ -895,7 +928,18 @@ func (w *treeWorker) workVersions(t secretTree) ([]secretTree, error) {
 		}, nil
 	}
 
-	versions, err := w.vault.Versions(path)
+	//The metadata has the versions in it, so there's no need to ask twice
+	var versions []vaultkv.KVVersion
+	var metadata *SecretMetadata
+	var err error
+	if w.opts.FetchMetadata {
+		metadata, err = w.vault.Metadata(path)
+		if err == nil {
+			versions = metadata.Versions
+		}
+	} else {
+		versions, err = w.vault.Versions(path)
+	}
 	//For v2 backends, this is the first non-list Vault access.
 	// If we're unable to get a path that we could list because of permissions,
 	// don't explode.
@@ -912,6 +956,7 @@ func (w *treeWorker) workVersions(t secretTree) ([]secretTree, error) {
 			Name:      t.Name,
 			Type:      treeTypeVersion,
 			Version:   versions[i].Version,
+			CreatedAt: versions[i].CreatedAt,
 			Deleted:   versions[i].Deleted,
 			Destroyed: versions[i].Destroyed,
 		})
@@ -921,5 +966,9 @@ func (w *treeWorker) workVersions(t secretTree) ([]secretTree, error) {
 		ret = ret[len(ret)-1:]
 	}
 
+	if len(ret) > 0 {
+		ret[len(ret)-1].Metadata = metadata
+	}
+
 	return ret, nil
 }
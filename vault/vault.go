@@ -13,14 +13,28 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/cloudfoundry-community/vaultkv"
 	"github.com/jhunt/go-ansi"
 )
 
 type Vault struct {
-	client *vaultkv.KV
-	debug  bool
+	client     *vaultkv.KV
+	debug      bool
+	requireCAS bool
+	tx         *Transaction
+	cwd        string
+	mountList  []string
+
+	reauth       Reauthenticator
+	reauthFailed bool
+	reauthLock   sync.Mutex
+
+	//token is what the client authenticates with; it is only ever changed
+	// through SetToken, which keeps it and the client's copy in step
+	token     string
+	tokenLock sync.RWMutex
 }
 
 type VaultConfig struct {
@@ -29,6 +43,13 @@ type VaultConfig struct {
 	Namespace  string
 	CACerts    *x509.CertPool
 	SkipVerify bool
+	//ClientCert and ClientKey are the files holding the certificate (and
+	// its key) that safe presents to Vaults that want mutual TLS
+	ClientCert string
+	ClientKey  string
+	//RequireCAS makes every write check-and-set, even for secrets that
+	// weren't read first, and refuses to write to KV v1 backends
+	RequireCAS bool
 }
 
 // NewVault creates a new Vault object.  If an empty token is specified,
@@ -60,35 +81,60 @@ func NewVault(conf VaultConfig) (*Vault, error) {
 		vaultURL.Host = vaultURL.Host + port
 	}
 
+	var clientCerts []tls.Certificate
+	if conf.ClientCert != "" || conf.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(conf.ClientCert, conf.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %s", err)
+		}
+		clientCerts = append(clientCerts, cert)
+	}
+
 	proxyRouter, err := NewProxyRouter()
 	if err != nil {
 		return nil, fmt.Errorf("Error setting up proxy: %s", err)
 	}
 
-	return &Vault{
-		client: (&vaultkv.Client{
-			VaultURL:  vaultURL,
-			AuthToken: conf.Token,
-			Namespace: conf.Namespace,
-			Client: &http.Client{
-				Transport: &http.Transport{
+	v := &Vault{
+		debug:      shouldDebug(),
+		requireCAS: conf.RequireCAS,
+		token:      conf.Token,
+	}
+	v.client = (&vaultkv.Client{
+		VaultURL:  vaultURL,
+		AuthToken: conf.Token,
+		Namespace: conf.Namespace,
+		Client: &http.Client{
+			Transport: &reauthTransport{
+				vault: v,
+				base: &http.Transport{
 					Proxy: proxyRouter.Proxy,
 					TLSClientConfig: &tls.Config{
 						RootCAs:            conf.CACerts,
 						InsecureSkipVerify: conf.SkipVerify,
+						Certificates:       clientCerts,
 					},
 					MaxIdleConnsPerHost: 100,
 				},
 			},
-			Trace: func() (ret io.Writer) {
-				if shouldDebug() {
-					ret = os.Stderr
+			//vaultkv sets up the same thing on every request if
+			// there's nothing there, which races with other requests
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > 10 {
+					return fmt.Errorf("Stopped after 10 redirects")
 				}
-				return ret
-			}(),
-		}).NewKV(),
-		debug: shouldDebug(),
-	}, nil
+				req.Header.Set("X-Vault-Token", via[0].Header.Get("X-Vault-Token"))
+				return nil
+			},
+		},
+		Trace: func() (ret io.Writer) {
+			if shouldDebug() {
+				ret = os.Stderr
+			}
+			return ret
+		}(),
+	}).NewKV()
+	return v, nil
 }
 
 func (v *Vault) Client() *vaultkv.KV {
@@ -96,11 +142,13 @@ func (v *Vault) Client() *vaultkv.KV {
 }
 
 func (v *Vault) MountVersion(path string) (uint, error) {
+	path = v.resolve(path)
 	path = Canonicalize(path)
 	return v.client.MountVersion(path)
 }
 
 func (v *Vault) Versions(path string) ([]vaultkv.KVVersion, error) {
+	path = v.resolve(path)
 	path = Canonicalize(path)
 	ret, err := v.client.Versions(path)
 	if vaultkv.IsNotFound(err) {
@@ -134,18 +182,28 @@ func (v *Vault) Curl(method string, path string, body []byte) (*http.Response, e
 // If there is nothing at that path, a nil *Secret will be returned, with no
 // error.
 func (v *Vault) Read(path string) (secret *Secret, err error) {
+	path = v.resolve(path)
 	path, key, version := ParsePath(path)
 
 	secret = NewSecret()
 
+	//Only the whole of the latest version can be written back with
+	// check-and-set
+	if version == 0 && key == "" {
+		secret.readFrom = Canonicalize(path)
+	}
+
 	raw := map[string]interface{}{}
-	_, err = v.client.Get(path, &raw, &vaultkv.KVGetOpts{Version: uint(version)})
+	meta, err := v.client.Get(path, &raw, &vaultkv.KVGetOpts{Version: uint(version)})
 	if err != nil {
 		if vaultkv.IsNotFound(err) {
+			//Writing it back checks (in writeCAS) that no one has
+			// written it since
 			err = NewSecretNotFoundError(path)
 		}
 		return
 	}
+	secret.version = meta.Version
 
 	if key != "" {
 		val, found := raw[key]
@@ -177,6 +235,7 @@ func (v *Vault) Read(path string) (secret *Secret, err error) {
 // the given path.  Intermediate path nodes are suffixed with a single "/",
 // whereas leaf nodes (the secrets themselves) are not.
 func (v *Vault) List(path string) (paths []string, err error) {
+	path = v.resolve(path)
 	path = Canonicalize(path)
 
 	paths, err = v.client.List(path)
@@ -189,6 +248,7 @@ func (v *Vault) List(path string) (paths []string, err error) {
 
 // Write takes a Secret and writes it to the Vault at the specified path.
 func (v *Vault) Write(path string, s *Secret) error {
+	path = v.resolve(path)
 	path, key, version := ParsePath(path)
 	if key != "" {
 		return fmt.Errorf("cannot write to paths in /path:key notation")
@@ -202,7 +262,17 @@ func (v *Vault) Write(path string, s *Secret) error {
 		return v.deleteIfPresent(path, DeleteOpts{})
 	}
 
-	_, err := v.client.Set(path, s.data, nil)
+	release, err := v.touch(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if s.readFrom == Canonicalize(path) || v.requireCAS {
+		return v.writeCAS(path, s)
+	}
+
+	_, err = v.client.Set(path, s.data, nil)
 	if vaultkv.IsNotFound(err) {
 		err = NewSecretNotFoundError(path)
 	}
@@ -322,6 +392,7 @@ func (v *Vault) verifySecretExists(path string) error {
 // DeleteTree recursively deletes the leaf nodes beneath the given root until
 // the root has no children, and then deletes that.
 func (v *Vault) DeleteTree(root string, opts DeleteOpts) error {
+	root = v.resolve(root)
 	root = Canonicalize(root)
 
 	secrets, err := v.ConstructSecrets(root, TreeOpts{FetchKeys: false, SkipVersionInfo: true, AllowDeletedSecrets: true})
@@ -382,6 +453,7 @@ func (v *Vault) canSemanticallyDelete(path string) error {
 // Delete removes the secret or key stored at the specified path.
 // If destroy is true and the mount is v2, the latest version is destroyed instead
 func (v *Vault) Delete(path string, opts DeleteOpts) error {
+	path = v.resolve(path)
 	path = Canonicalize(path)
 
 	reqState := verifyStateAlive
@@ -411,6 +483,11 @@ func (v *Vault) Delete(path string, opts DeleteOpts) error {
 
 func (v *Vault) deleteEntireSecret(path string, destroy bool, all bool) error {
 	secret, _, version := ParsePath(path)
+	release, err := v.touch(secret)
+	if err != nil {
+		return err
+	}
+	defer release()
 
 	if destroy && all {
 		return v.client.DestroyAll(secret)
@@ -492,15 +569,28 @@ func (v *Vault) deleteSpecificKey(path string) error {
 // DeleteVersions marks the given versions of the given secret as deleted for
 // a v2 backend or actually deletes it for a v1 backend.
 func (v *Vault) DeleteVersions(path string, versions []uint) error {
+	path = v.resolve(path)
+	release, err := v.touch(path)
+	if err != nil {
+		return err
+	}
+	defer release()
 	return v.client.Delete(path, &vaultkv.KVDeleteOpts{Versions: versions, V1Destroy: true})
 }
 
 // DestroyVersions irrevocably destroys the given versions of the given secret
 func (v *Vault) DestroyVersions(path string, versions []uint) error {
+	path = v.resolve(path)
+	release, err := v.touch(path)
+	if err != nil {
+		return err
+	}
+	defer release()
 	return v.client.Destroy(path, versions)
 }
 
 func (v *Vault) Undelete(path string) error {
+	path = v.resolve(path)
 	secret, key, version := ParsePath(path)
 	if key != "" {
 		return fmt.Errorf("Cannot undelete specific key (%s)", path)
@@ -530,6 +620,12 @@ func (v *Vault) Undelete(path string) error {
 		return destroyedErr
 	}
 
+	release, err := v.touch(secret)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	return v.Client().Undelete(secret, []uint{uint(version)})
 }
 
@@ -584,6 +680,7 @@ type MoveCopyOpts struct {
 // no-key -> key is bad. That makes no sense and the user should feel bad.
 // Returns KeyNotFoundError if there is no such specified key in the secret at oldpath
 func (v *Vault) Copy(oldpath, newpath string, opts MoveCopyOpts) error {
+	oldpath, newpath = v.resolve(oldpath), v.resolve(newpath)
 	oldpath = Canonicalize(oldpath)
 	newpath = Canonicalize(newpath)
 
@@ -706,6 +803,7 @@ func (v *Vault) Copy(oldpath, newpath string, opts MoveCopyOpts) error {
 // This function will get confused about 'secret:key' syntax, so don't let those
 // get routed here - they don't make sense for a recursion anyway.
 func (v *Vault) MoveCopyTree(oldRoot, newRoot string, f func(string, string, MoveCopyOpts) error, opts MoveCopyOpts) error {
+	oldRoot, newRoot = v.resolve(oldRoot), v.resolve(newRoot)
 	oldRoot = Canonicalize(oldRoot)
 	newRoot = Canonicalize(newRoot)
 
@@ -758,6 +856,7 @@ func (v *Vault) MoveCopyTree(oldRoot, newRoot string, f func(string, string, Mov
 // A move is semantically a copy and then a deletion of the original item. For
 // more information on the behavior of Move pertaining to keys, look at Copy.
 func (v *Vault) Move(oldpath, newpath string, opts MoveCopyOpts) error {
+	oldpath, newpath = v.resolve(oldpath), v.resolve(newpath)
 	oldpath = Canonicalize(oldpath)
 	newpath = Canonicalize(newpath)
 
@@ -775,6 +874,11 @@ func (v *Vault) Move(oldpath, newpath string, opts MoveCopyOpts) error {
 	}
 
 	if opts.Deep && opts.DeletedVersions {
+		var release func()
+		if release, err = v.touch(oldpath); err != nil {
+			return err
+		}
+		defer release()
 		err = v.client.DestroyAll(oldpath)
 	} else {
 		err = v.Delete(oldpath, DeleteOpts{})
@@ -979,8 +1083,8 @@ func (v *Vault) CreateSignedCertificate(backend, role, path string, params CertO
 	if err = json.Unmarshal(body, &raw); err == nil {
 		if d, ok := raw["data"]; ok {
 			if data, ok := d.(map[string]interface{}); ok {
-				var cert, key, serial string
-				var c, k, s interface{}
+				var cert, key string
+				var c, k interface{}
 				var ok bool
 				if c, ok = data["certificate"]; !ok {
 					return fmt.Errorf("No certificate found when issuing certificate %s:\n%v\n", params.CN, data)
@@ -994,18 +1098,14 @@ func (v *Vault) CreateSignedCertificate(backend, role, path string, params CertO
 				if key, ok = k.(string); !ok {
 					return fmt.Errorf("Invalid data type for private_key %s:\n%v\n", params.CN, data)
 				}
-				if s, ok = data["serial_number"]; !ok {
-					return fmt.Errorf("No serial_number found when issuing certificate %s:\n%v\n", params.CN, data)
-				}
-				if serial, ok = s.(string); !ok {
-					return fmt.Errorf("Invalid data type for serial_number %s:\n%v\n", params.CN, data)
-				}
 
-				secret, err := v.Read(path)
-				if err != nil && !IsNotFound(err) {
-					return err
-				}
-				err = secret.Set("cert", cert, skipIfExists)
+				//Vault leaves off the trailing newlines, which we need
+				// in order to stitch together the combined PEM
+				cert = strings.TrimSpace(cert) + "\n"
+				key = strings.TrimSpace(key) + "\n"
+
+				secret := NewSecret()
+				err = secret.Set("certificate", cert, skipIfExists)
 				if err != nil {
 					return err
 				}
@@ -1017,10 +1117,6 @@ func (v *Vault) CreateSignedCertificate(backend, role, path string, params CertO
 				if err != nil {
 					return err
 				}
-				err = secret.Set("serial", serial, skipIfExists)
-				if err != nil {
-					return err
-				}
 				return v.Write(path, secret)
 			} else {
 				return fmt.Errorf("Invalid response datatype requesting certificate %s:\n%v\n", params.CN, d)
@@ -1043,10 +1139,15 @@ func (v *Vault) RevokeCertificate(backend, serial string) error {
 		if err != nil {
 			return err
 		}
-		if !secret.Has("serial") {
-			return fmt.Errorf("Certificate specified using path %s, but no serial secret was found there", serial)
+		if !secret.Has("certificate") && secret.Has("serial") {
+			serial = secret.Get("serial")
+		} else {
+			cert, err := secret.X509(false)
+			if err != nil {
+				return fmt.Errorf("Certificate specified using path %s, but %s", serial, err)
+			}
+			serial = cert.PKISerial()
 		}
-		serial = secret.Get("serial")
 	}
 
 	d := struct {
@@ -1075,12 +1176,13 @@ func (v *Vault) RevokeCertificate(backend, serial string) error {
 
 func (v *Vault) CheckPKIBackend(backend string) error {
 	if mounted, _ := v.IsMounted("pki", backend); !mounted {
-		return fmt.Errorf("The PKI backend `%s` has not been configured. Try running `safe pki init --backend %s`\n", backend, backend)
+		return fmt.Errorf("The PKI backend `%s` has not been configured. Try running `safe vault secrets enable -path=%s pki`\n", backend, backend)
 	}
 	return nil
 }
 
 func (v *Vault) FindSigningCA(cert *X509, certPath string, signPath string) (*X509, string, error) {
+	certPath, signPath = v.resolve(certPath), v.resolve(signPath)
 	/* find the CA */
 	if signPath != "" {
 		if certPath == signPath {
@@ -1149,3 +1251,19 @@ func (v *Vault) SetURL(u string) {
 	}
 	v.client.Client.VaultURL = vaultURL
 }
+
+// SetToken changes the token that the Vault authenticates with.  It is safe
+// to call while other requests are in flight.
+func (v *Vault) SetToken(token string) {
+	v.tokenLock.Lock()
+	defer v.tokenLock.Unlock()
+	v.token = token
+	v.client.Client.SetAuthToken(token)
+}
+
+// Token returns the token that the Vault authenticates with.
+func (v *Vault) Token() string {
+	v.tokenLock.RLock()
+	defer v.tokenLock.RUnlock()
+	return v.token
+}
@@ -1,11 +1,14 @@
 package vault
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
 	"fmt"
 	"math/big"
@@ -20,12 +23,28 @@ import (
 type X509 struct {
 	Intermediaries []*x509.Certificate
 	Certificate    *x509.Certificate
-	PrivateKey     *rsa.PrivateKey
+	PrivateKey     crypto.Signer
 	Serial         *big.Int
 	CRL            *pkix.CertificateList
 
 	KeyUsage    x509.KeyUsage
 	ExtKeyUsage []x509.ExtKeyUsage
+
+	//Where the certificate was read from, so that saving it back can
+	// check-and-set against the version that was read
+	readFrom string
+	version  uint
+}
+
+// IsX509 returns true if the secret holds a PEM-encoded X.509 certificate in
+// its certificate attribute, the way that 'safe x509 issue' stores them.  It
+// says nothing about whether the certificate is any good; X509 does that.
+func (s Secret) IsX509() bool {
+	if !s.Has("certificate") {
+		return false
+	}
+	block, _ := pem.Decode([]byte(s.Get("certificate")))
+	return block != nil && block.Type == "CERTIFICATE"
 }
 
 func (s Secret) X509(requireKey bool) (*X509, error) {
@@ -80,7 +99,7 @@ func (s Secret) X509(requireKey bool) (*X509, error) {
 		intermediaries = append(intermediaries, c)
 	}
 
-	var key *rsa.PrivateKey
+	var key crypto.Signer
 	if requireKey {
 		v := s.Get("key")
 		block, rest = pem.Decode([]byte(v))
@@ -90,21 +109,13 @@ func (s Secret) X509(requireKey bool) (*X509, error) {
 		if len(rest) > 0 {
 			return nil, fmt.Errorf("contains multiple keys (what?)")
 		}
-		if block.Type != "RSA PRIVATE KEY" && block.Type != "PRIVATE KEY" {
-			return nil, fmt.Errorf("not a valid certificate (type '%s' != 'RSA PRIVATE KEY' or 'PRIVATE KEY')", block.Type)
+		if block.Type != "RSA PRIVATE KEY" && block.Type != "EC PRIVATE KEY" && block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("not a valid certificate (type '%s' != 'RSA PRIVATE KEY', 'EC PRIVATE KEY' or 'PRIVATE KEY')", block.Type)
 		}
 
-		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		key, err = parsePrivateKey(block.Bytes)
 		if err != nil {
-			pkcs8TmpKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-			if err != nil {
-				return nil, fmt.Errorf("not a valid private key (%s)", err)
-			}
-			var isRSAEncoded bool
-			key, isRSAEncoded = pkcs8TmpKey.(*rsa.PrivateKey)
-			if !isRSAEncoded {
-				return nil, fmt.Errorf("private key not RSA encoded")
-			}
+			return nil, fmt.Errorf("not a valid private key (%s)", err)
 		}
 	}
 
@@ -114,6 +125,8 @@ func (s Secret) X509(requireKey bool) (*X509, error) {
 		PrivateKey:     key,
 		KeyUsage:       cert.KeyUsage,
 		ExtKeyUsage:    cert.ExtKeyUsage,
+		readFrom:       s.readFrom,
+		version:        s.version,
 	}
 
 	if s.Has("serial") {
@@ -283,6 +296,7 @@ var signatureAlgorithmLookup = map[string]x509.SignatureAlgorithm{
 	"ecdsa-sha256":  x509.ECDSAWithSHA256,
 	"ecdsa-sha384":  x509.ECDSAWithSHA384,
 	"ecdsa-sha512":  x509.ECDSAWithSHA512,
+	"ed25519":       x509.PureEd25519,
 }
 
 func isNoKeyUsage(in string) bool {
@@ -403,8 +417,15 @@ func TranslateSignatureAlgorithm(signatureAlgorithm string) (sigAlgo x509.Signat
 	return
 }
 
-func NewCertificate(subj string, names, keyUsage []string, signatureAlgorithm string, bits int) (*X509, error) {
-	if bits != 1024 && bits != 2048 && bits != 4096 {
+// NewCertificate generates a new key of the given type and strength (see
+// GenerateKey), and an unsigned certificate for it.  If no signatureAlgorithm
+// is given, the default for the signing CA's key is used when it is signed.
+func NewCertificate(subj string, names, keyUsage []string, signatureAlgorithm string, keyType string, bits int) (*X509, error) {
+	keyType, err := NormalizeKeyType(keyType)
+	if err != nil {
+		return nil, err
+	}
+	if keyType == KeyTypeRSA && bits != 1024 && bits != 2048 && bits != 4096 {
 		return nil, fmt.Errorf("invalid RSA key strength '%d', must be one of: 1024, 2048, 4096", bits)
 	}
 
@@ -415,7 +436,7 @@ func NewCertificate(subj string, names, keyUsage []string, signatureAlgorithm st
 
 	ips, domains, emails := CategorizeSANs(names)
 
-	key, err := rsa.GenerateKey(rand.Reader, bits)
+	key, err := GenerateKey(keyType, bits)
 	if err != nil {
 		return nil, err
 	}
@@ -425,7 +446,7 @@ func NewCertificate(subj string, names, keyUsage []string, signatureAlgorithm st
 		return nil, err
 	}
 
-	translatedSigAlgo := x509.SHA512WithRSA
+	translatedSigAlgo := x509.UnknownSignatureAlgorithm
 	if signatureAlgorithm != "" {
 		translatedSigAlgo, err = TranslateSignatureAlgorithm(signatureAlgorithm)
 		if err != nil {
@@ -437,7 +458,7 @@ func NewCertificate(subj string, names, keyUsage []string, signatureAlgorithm st
 		PrivateKey: key,
 		Certificate: &x509.Certificate{
 			SignatureAlgorithm: translatedSigAlgo,
-			PublicKeyAlgorithm: x509.RSA,
+			PublicKeyAlgorithm: publicKeyAlgorithm(key),
 			Subject:            name,
 			DNSNames:           domains,
 			EmailAddresses:     emails,
@@ -450,28 +471,61 @@ func NewCertificate(subj string, names, keyUsage []string, signatureAlgorithm st
 }
 
 func (x X509) Validate() error {
-	if x.Certificate.PublicKeyAlgorithm != x509.RSA {
-		return fmt.Errorf("invalid (non-RSA) public key algorithm found in certificate")
+	certType, _ := KeyStrength(x.Certificate.PublicKey)
+	keyType, _ := KeyStrength(x.PrivateKey)
+	if certType != keyType {
+		return fmt.Errorf("private key is a %s key, but certificate has a %s public key", keyType, certType)
 	}
 
-	pub := x.Certificate.PublicKey.(*rsa.PublicKey)
-	if pub.N.Cmp(x.PrivateKey.N) != 0 {
-		return fmt.Errorf("modulus for private key does not match modulus in certificate")
-	}
-	if pub.E != x.PrivateKey.E {
-		return fmt.Errorf("exponent for private key does not match exponent in certificate")
+	if pub, ok := x.Certificate.PublicKey.(*rsa.PublicKey); ok {
+		key := x.PrivateKey.(*rsa.PrivateKey)
+		if pub.N.Cmp(key.N) != 0 {
+			return fmt.Errorf("modulus for private key does not match modulus in certificate")
+		}
+		if pub.E != key.E {
+			return fmt.Errorf("exponent for private key does not match exponent in certificate")
+		}
+		return nil
 	}
 
+	a, err := x509.MarshalPKIXPublicKey(x.Certificate.PublicKey)
+	if err != nil {
+		return err
+	}
+	b, err := x509.MarshalPKIXPublicKey(x.PrivateKey.Public())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(a, b) {
+		return fmt.Errorf("private key does not match public key in certificate")
+	}
 	return nil
 }
 
+// KeyType returns the type of the certificate's key (one of the KeyType*
+// constants).
+func (x X509) KeyType() string {
+	t, _ := KeyStrength(x.Certificate.PublicKey)
+	return t
+}
+
+// CheckStrength checks that the certificate's key is one of the given sizes,
+// in bits.  For ECDSA keys, that's the size of the curve; Ed25519 keys are
+// always 256 bits.
 func (x X509) CheckStrength(bits ...int) error {
+	t, n := KeyStrength(x.Certificate.PublicKey)
 	for _, b := range bits {
-		if x.PrivateKey.N.BitLen() == b {
+		if n == b {
 			return nil
 		}
 	}
-	return fmt.Errorf("key is a %d-bit RSA key", x.PrivateKey.N.BitLen())
+	if t == KeyTypeRSA {
+		return fmt.Errorf("key is a %d-bit RSA key", n)
+	}
+	if t == KeyTypeECDSA {
+		return fmt.Errorf("key is a %d-bit ECDSA key", n)
+	}
+	return fmt.Errorf("key is a %d-bit %s key", n, t)
 }
 
 func (x X509) IsCA() bool {
@@ -561,17 +615,19 @@ func (x *X509) MakeCA() {
 
 func (x X509) Secret(skipIfExists bool) (*Secret, error) {
 	s := NewSecret()
+	s.readFrom, s.version = x.readFrom, x.version
 
 	cert := string(pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: x.Certificate.Raw,
 	}))
-	key := string(pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(x.PrivateKey),
-	}))
+	b, err := encodePrivateKey(x.PrivateKey)
+	if err != nil {
+		return s, err
+	}
+	key := string(b)
 
-	err := s.Set("certificate", cert, skipIfExists)
+	err = s.Set("certificate", cert, skipIfExists)
 	if err != nil {
 		return s, err
 	}
@@ -621,7 +677,11 @@ func (ca *X509) SaveTo(v *Vault, path string, skipIfExists bool) error {
 	if err != nil {
 		return err
 	}
-	return v.Write(path, s)
+	if err := v.Write(path, s); err != nil {
+		return err
+	}
+	ca.readFrom, ca.version = s.readFrom, s.version
+	return nil
 }
 
 var maxSerial = big.NewInt(0).Exp(big.NewInt(2), big.NewInt(159), nil)
@@ -642,6 +702,17 @@ func (ca *X509) Sign(x *X509, ttl time.Duration) error {
 	x.Certificate.NotBefore = time.Now()
 	x.Certificate.NotAfter = time.Now().Add(ttl)
 
+	caType, _ := KeyStrength(ca.PrivateKey)
+	if x.Certificate.SignatureAlgorithm == x509.UnknownSignatureAlgorithm {
+		x.Certificate.SignatureAlgorithm = defaultSignatureAlgorithm(ca.PrivateKey)
+	} else if t := signatureKeyType(x.Certificate.SignatureAlgorithm); t != caType {
+		return fmt.Errorf("cannot sign with %s, using a %s key", x.Certificate.SignatureAlgorithm, caType)
+	}
+	//Keep the template in step with the key (which may be brand new), so
+	// that it can sign things itself if it is self-signed, or a CA
+	x.Certificate.PublicKey = x.PrivateKey.Public()
+	x.Certificate.PublicKeyAlgorithm = publicKeyAlgorithm(x.PrivateKey)
+
 	x.Certificate.AuthorityKeyId = ca.getKeyID()
 	x.Certificate.SubjectKeyId, _ = getKeyIDFromPublicKey(x.PrivateKey.Public())
 	raw, err := x509.CreateCertificate(rand.Reader, x.Certificate, ca.Certificate, x.PrivateKey.Public(), ca.PrivateKey)
@@ -667,19 +738,60 @@ func (cert *X509) getKeyID() []byte {
 }
 
 func getKeyIDFromPublicKey(key interface{}) ([]byte, error) {
-	var ret []byte
-	var err error
-	switch k := key.(type) {
-	case *rsa.PublicKey:
-		kASN1 := x509.MarshalPKCS1PublicKey(k)
-		tmpArray := sha1.Sum(kASN1)
-		ret = tmpArray[:]
+	//RFC 5280 (4.2.1.2) method 1: the SHA-1 of the subjectPublicKey bits
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unsupported public key algorithm")
+	}
+	var spki struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(spki.SubjectPublicKey.Bytes)
+	return sum[:], nil
+}
+
+// defaultSignatureAlgorithm picks the algorithm to sign with when none was
+// asked for.  For RSA, that's SHA-512 (as it has always been); ECDSA keys use
+// the hash that matches the strength of their curve.
+func defaultSignatureAlgorithm(key crypto.Signer) x509.SignatureAlgorithm {
+	switch t, bits := KeyStrength(key); {
+	case t == KeyTypeEd25519:
+		return x509.PureEd25519
+	case t == KeyTypeECDSA && bits > 384:
+		return x509.ECDSAWithSHA512
+	case t == KeyTypeECDSA && bits > 256:
+		return x509.ECDSAWithSHA384
+	case t == KeyTypeECDSA:
+		return x509.ECDSAWithSHA256
+	}
+	return x509.SHA512WithRSA
+}
 
-	default:
-		err = fmt.Errorf("Unsupported public key algorithm")
+func publicKeyAlgorithm(key crypto.Signer) x509.PublicKeyAlgorithm {
+	switch t, _ := KeyStrength(key); t {
+	case KeyTypeECDSA:
+		return x509.ECDSA
+	case KeyTypeEd25519:
+		return x509.Ed25519
 	}
+	return x509.RSA
+}
 
-	return ret, err
+// signatureKeyType returns the type of key that can sign with algo.
+func signatureKeyType(algo x509.SignatureAlgorithm) string {
+	switch algo {
+	case x509.ECDSAWithSHA1, x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512:
+		return KeyTypeECDSA
+	case x509.PureEd25519:
+		return KeyTypeEd25519
+	case x509.DSAWithSHA1, x509.DSAWithSHA256:
+		return "dsa"
+	}
+	return KeyTypeRSA
 }
 
 func (ca *X509) Revoke(cert *X509) {
@@ -714,6 +826,61 @@ func (c *X509) FormatSerial() string {
 	return string(ret[:59])
 }
 
+// PKISerial formats the certificate's serial number the way the PKI secrets
+// engine does: colon-separated hex bytes, without any zero-padding.
+func (c *X509) PKISerial() string {
+	b := c.Certificate.SerialNumber.Bytes()
+	ss := make([]string, len(b))
+	for i := range b {
+		ss[i] = fmt.Sprintf("%02x", b[i])
+	}
+	return strings.Join(ss, ":")
+}
+
+// KeyUsageNames returns the key usages and extended key usages of the
+// certificate, named the way HandleJointKeyUsages expects them, always in
+// the same order.
+func (x *X509) KeyUsageNames() []string {
+	names := []string{}
+	for _, ku := range []struct {
+		name  string
+		usage x509.KeyUsage
+	}{
+		{"digital_signature", x509.KeyUsageDigitalSignature},
+		{"non_repudiation", x509.KeyUsageContentCommitment},
+		{"key_encipherment", x509.KeyUsageKeyEncipherment},
+		{"data_encipherment", x509.KeyUsageDataEncipherment},
+		{"key_agreement", x509.KeyUsageKeyAgreement},
+		{"key_cert_sign", x509.KeyUsageCertSign},
+		{"crl_sign", x509.KeyUsageCRLSign},
+		{"encipher_only", x509.KeyUsageEncipherOnly},
+		{"decipher_only", x509.KeyUsageDecipherOnly},
+	} {
+		if x.Certificate.KeyUsage&ku.usage != 0 {
+			names = append(names, ku.name)
+		}
+	}
+
+	for _, eku := range []struct {
+		name  string
+		usage x509.ExtKeyUsage
+	}{
+		{"client_auth", x509.ExtKeyUsageClientAuth},
+		{"server_auth", x509.ExtKeyUsageServerAuth},
+		{"code_signing", x509.ExtKeyUsageCodeSigning},
+		{"email_protection", x509.ExtKeyUsageEmailProtection},
+		{"timestamping", x509.ExtKeyUsageTimeStamping},
+	} {
+		for _, usage := range x.Certificate.ExtKeyUsage {
+			if usage == eku.usage {
+				names = append(names, eku.name)
+				break
+			}
+		}
+	}
+	return names
+}
+
 func (c *X509) ExpiryString() string {
 	return c.Certificate.NotAfter.Format("Jan 02 2006 15:04 MST")
 }
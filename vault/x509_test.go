@@ -0,0 +1,48 @@
+package vault_test
+
+import (
+	"crypto/x509"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/starkandwayne/safe/vault"
+)
+
+var _ = Describe("X509", func() {
+	It("names key usages in the same order every time", func() {
+		cert := &vault.X509{Certificate: &x509.Certificate{
+			KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{
+				x509.ExtKeyUsageTimeStamping,
+				x509.ExtKeyUsageServerAuth,
+				x509.ExtKeyUsageClientAuth,
+			},
+		}}
+
+		for i := 0; i < 20; i++ {
+			Expect(cert.KeyUsageNames()).To(Equal([]string{
+				"digital_signature", "key_cert_sign", "client_auth", "server_auth", "timestamping",
+			}))
+		}
+	})
+
+	It("recognizes secrets that hold certificates", func() {
+		cert, err := vault.NewCertificate("CN=example.com", []string{"example.com"}, []string{"server_auth"}, "", "rsa", 1024)
+		Expect(err).NotTo(HaveOccurred())
+		s, err := cert.Secret(false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.IsX509()).To(BeTrue())
+
+		for _, data := range []map[string]string{
+			{"password": "sekrit"},
+			{"certificate": "not a certificate"},
+			{"certificate": s.Get("key")},
+		} {
+			other := vault.NewSecret()
+			for k, v := range data {
+				Expect(other.Set(k, v, false)).To(Succeed())
+			}
+			Expect(other.IsX509()).To(BeFalse(), "%v", data)
+		}
+	})
+})